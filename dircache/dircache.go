@@ -0,0 +1,535 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// package dircache implements the Git index file, also known as
+// the staging area or directory cache.
+//
+// Versions 2, 3 and 4 of the format are supported. The cached tree
+// extension is decoded, other extensions are kept as opaque data.
+//
+// Cf. Documentation/technical/index-format.txt in Git sources for
+// reference.
+package dircache
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/remyoudompheng/gigot/objects"
+)
+
+// An Index is the contents of an index file.
+type Index struct {
+	Version    uint32
+	Entries    []Entry     // Sorted by path, then stage.
+	Tree       *TreeCache  // The cached tree extension, or nil.
+	Extensions []Extension // Other extensions, in file order.
+}
+
+// An Entry describes a file of the index.
+type Entry struct {
+	Ctime, Mtime time.Time
+	Dev, Ino     uint32
+	Mode         uint32 // Git file mode, e.g. 0100644.
+	UID, GID     uint32
+	Size         uint32
+	Hash         objects.Hash
+	Path         string
+
+	Stage        int  // 0 for normal entries, 1-3 for conflicts.
+	AssumeValid  bool // The file is assumed to be unchanged.
+	SkipWorktree bool // Sparse checkout: the file is not in the work tree.
+	IntentToAdd  bool // Added with git add -N.
+}
+
+// A TreeCache records the tree objects corresponding to
+// directories of the index.
+type TreeCache struct {
+	Name     string // The directory name, relative to its parent.
+	Entries  int    // Number of index entries covered, -1 if invalid.
+	Hash     objects.Hash
+	Subtrees []*TreeCache
+}
+
+// An Extension is an index extension not interpreted by this
+// package, such as resolve-undo (REUC) or untracked cache (UNTR).
+type Extension struct {
+	Signature [4]byte
+	Data      []byte
+}
+
+const (
+	flagAssumeValid  = 0x8000
+	flagExtended     = 0x4000
+	flagStageMask    = 0x3000
+	flagStageShift   = 12
+	flagNameMask     = 0x0fff
+	flagSkipWorktree = 0x4000 // in extended flags.
+	flagIntentToAdd  = 0x2000 // in extended flags.
+)
+
+var (
+	errBadMagic            = errors.New("dircache: bad magic number in index")
+	errUnsupportedVersion  = errors.New("dircache: unsupported index version")
+	errBadChecksum         = errors.New("dircache: index checksum mismatch")
+	errTruncated           = errors.New("dircache: truncated index")
+	errBadEntry            = errors.New("dircache: malformed index entry")
+	errBadTreeCache        = errors.New("dircache: malformed cached tree extension")
+	errIndexLocked         = errors.New("dircache: index is locked")
+	errExtendedFlagsInV2   = errors.New("dircache: extended flags require index version 3")
+	errUnknownExtendedFlag = errors.New("dircache: unknown extended flags")
+)
+
+// ReadFile reads an index file, usually .git/index.
+func ReadFile(path string) (*Index, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Read reads an index from r.
+func Read(r io.Reader) (*Index, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Parse decodes the contents of an index file, verifying its
+// trailing checksum.
+func Parse(data []byte) (*Index, error) {
+	if len(data) < 12+20 {
+		return nil, errTruncated
+	}
+	body, sum := data[:len(data)-20], data[len(data)-20:]
+	if h := sha1.Sum(body); !bytes.Equal(h[:], sum) {
+		return nil, errBadChecksum
+	}
+	if string(body[:4]) != "DIRC" {
+		return nil, errBadMagic
+	}
+	idx := &Index{Version: binary.BigEndian.Uint32(body[4:8])}
+	if idx.Version < 2 || idx.Version > 4 {
+		return nil, errUnsupportedVersion
+	}
+	count := binary.BigEndian.Uint32(body[8:12])
+	p := body[12:]
+	idx.Entries = make([]Entry, 0, count)
+	prev := ""
+	for i := uint32(0); i < count; i++ {
+		e, n, err := parseEntry(p, idx.Version, prev)
+		if err != nil {
+			return nil, err
+		}
+		idx.Entries = append(idx.Entries, e)
+		prev = e.Path
+		p = p[n:]
+	}
+
+	// Extensions.
+	for len(p) > 0 {
+		if len(p) < 8 {
+			return nil, errTruncated
+		}
+		var ext Extension
+		copy(ext.Signature[:], p[:4])
+		size := binary.BigEndian.Uint32(p[4:8])
+		if uint64(size) > uint64(len(p)-8) {
+			return nil, errTruncated
+		}
+		ext.Data = p[8 : 8+size]
+		p = p[8+size:]
+		if string(ext.Signature[:]) == "TREE" {
+			tree, rest, err := parseTreeCache(ext.Data)
+			if err != nil {
+				return nil, err
+			}
+			if len(rest) != 0 {
+				return nil, errBadTreeCache
+			}
+			idx.Tree = tree
+			continue
+		}
+		idx.Extensions = append(idx.Extensions, ext)
+	}
+	return idx, nil
+}
+
+// parseEntry decodes an index entry and returns its length.
+// In version 4, paths are compressed relatively to the path of
+// the previous entry.
+func parseEntry(p []byte, version uint32, prev string) (e Entry, n int, err error) {
+	const fixed = 62 // stat data, hash and flags.
+	if len(p) < fixed {
+		return e, 0, errTruncated
+	}
+	u32 := func(i int) uint32 { return binary.BigEndian.Uint32(p[4*i:]) }
+	e.Ctime = time.Unix(int64(u32(0)), int64(u32(1)))
+	e.Mtime = time.Unix(int64(u32(2)), int64(u32(3)))
+	e.Dev, e.Ino, e.Mode = u32(4), u32(5), u32(6)
+	e.UID, e.GID, e.Size = u32(7), u32(8), u32(9)
+	copy(e.Hash[:], p[40:60])
+	flags := binary.BigEndian.Uint16(p[60:62])
+	e.AssumeValid = flags&flagAssumeValid != 0
+	e.Stage = int(flags&flagStageMask) >> flagStageShift
+	n = fixed
+	if flags&flagExtended != 0 {
+		if version < 3 {
+			return e, 0, errExtendedFlagsInV2
+		}
+		if len(p) < n+2 {
+			return e, 0, errTruncated
+		}
+		ext := binary.BigEndian.Uint16(p[n:])
+		if ext&^(flagSkipWorktree|flagIntentToAdd) != 0 {
+			return e, 0, errUnknownExtendedFlag
+		}
+		e.SkipWorktree = ext&flagSkipWorktree != 0
+		e.IntentToAdd = ext&flagIntentToAdd != 0
+		n += 2
+	}
+
+	if version == 4 {
+		strip, k := readOffset(p[n:])
+		if k == 0 || strip > uint64(len(prev)) {
+			return e, 0, errBadEntry
+		}
+		n += k
+		nul := bytes.IndexByte(p[n:], 0)
+		if nul < 0 {
+			return e, 0, errTruncated
+		}
+		e.Path = prev[:len(prev)-int(strip)] + string(p[n:n+nul])
+		return e, n + nul + 1, nil
+	}
+
+	nul := bytes.IndexByte(p[n:], 0)
+	if nul < 0 {
+		return e, 0, errTruncated
+	}
+	e.Path = string(p[n : n+nul])
+	// Entries are padded with 1 to 8 NUL bytes to a multiple
+	// of 8 bytes.
+	size := (n + nul + 8) &^ 7
+	if size > len(p) {
+		return e, 0, errTruncated
+	}
+	return e, size, nil
+}
+
+// parseTreeCache decodes a cached tree entry and its subtrees:
+// <name> NUL <entry count> SP <subtree count> LF [<hash>]
+func parseTreeCache(p []byte) (t *TreeCache, rest []byte, err error) {
+	nul := bytes.IndexByte(p, 0)
+	if nul < 0 {
+		return nil, nil, errBadTreeCache
+	}
+	t = &TreeCache{Name: string(p[:nul])}
+	p = p[nul+1:]
+	lf := bytes.IndexByte(p, '\n')
+	if lf < 0 {
+		return nil, nil, errBadTreeCache
+	}
+	counts := strings.Fields(string(p[:lf]))
+	p = p[lf+1:]
+	if len(counts) != 2 {
+		return nil, nil, errBadTreeCache
+	}
+	entries, err1 := strconv.Atoi(counts[0])
+	subtrees, err2 := strconv.Atoi(counts[1])
+	if err1 != nil || err2 != nil || subtrees < 0 {
+		return nil, nil, errBadTreeCache
+	}
+	t.Entries = entries
+	if entries >= 0 {
+		if len(p) < 20 {
+			return nil, nil, errBadTreeCache
+		}
+		copy(t.Hash[:], p[:20])
+		p = p[20:]
+	}
+	for i := 0; i < subtrees; i++ {
+		var sub *TreeCache
+		sub, p, err = parseTreeCache(p)
+		if err != nil {
+			return nil, nil, err
+		}
+		t.Subtrees = append(t.Subtrees, sub)
+	}
+	return t, p, nil
+}
+
+func (t *TreeCache) appendTo(buf *bytes.Buffer) {
+	fmt.Fprintf(buf, "%s\x00%d %d\n", t.Name, t.Entries, len(t.Subtrees))
+	if t.Entries >= 0 {
+		buf.Write(t.Hash[:])
+	}
+	for _, sub := range t.Subtrees {
+		sub.appendTo(buf)
+	}
+}
+
+// Invalidate marks the cached trees containing path as invalid.
+func (t *TreeCache) Invalidate(path string) {
+	t.Entries = -1
+	slash := strings.IndexByte(path, '/')
+	if slash < 0 {
+		return
+	}
+	for _, sub := range t.Subtrees {
+		if sub.Name == path[:slash] {
+			sub.Invalidate(path[slash+1:])
+		}
+	}
+}
+
+// Write serializes the index, with a trailing checksum.
+// The index is written as version 3 if it is version 2 but has
+// entries with extended flags, like Git does.
+func (idx *Index) Write(w io.Writer) error {
+	version := idx.Version
+	if version < 2 || version > 4 {
+		return errUnsupportedVersion
+	}
+	for _, e := range idx.Entries {
+		if version == 2 && (e.SkipWorktree || e.IntentToAdd) {
+			version = 3
+		}
+	}
+	buf := new(bytes.Buffer)
+	buf.WriteString("DIRC")
+	binary.Write(buf, binary.BigEndian, version)
+	binary.Write(buf, binary.BigEndian, uint32(len(idx.Entries)))
+	prev := ""
+	for _, e := range idx.Entries {
+		appendEntry(buf, e, version, prev)
+		prev = e.Path
+	}
+	if idx.Tree != nil {
+		ext := new(bytes.Buffer)
+		idx.Tree.appendTo(ext)
+		writeExtension(buf, [4]byte{'T', 'R', 'E', 'E'}, ext.Bytes())
+	}
+	for _, ext := range idx.Extensions {
+		switch string(ext.Signature[:]) {
+		case "EOIE", "IEOT":
+			// These extensions record offsets in the file, which
+			// are not valid anymore. Git does not require them.
+			continue
+		}
+		writeExtension(buf, ext.Signature, ext.Data)
+	}
+	sum := sha1.Sum(buf.Bytes())
+	buf.Write(sum[:])
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func writeExtension(buf *bytes.Buffer, sig [4]byte, data []byte) {
+	buf.Write(sig[:])
+	binary.Write(buf, binary.BigEndian, uint32(len(data)))
+	buf.Write(data)
+}
+
+func appendEntry(buf *bytes.Buffer, e Entry, version uint32, prev string) {
+	start := buf.Len()
+	stat := [10]uint32{
+		uint32(e.Ctime.Unix()), uint32(e.Ctime.Nanosecond()),
+		uint32(e.Mtime.Unix()), uint32(e.Mtime.Nanosecond()),
+		e.Dev, e.Ino, e.Mode, e.UID, e.GID, e.Size,
+	}
+	binary.Write(buf, binary.BigEndian, stat[:])
+	buf.Write(e.Hash[:])
+	flags := uint16(len(e.Path))
+	if len(e.Path) > flagNameMask {
+		flags = flagNameMask
+	}
+	flags |= uint16(e.Stage<<flagStageShift) & flagStageMask
+	if e.AssumeValid {
+		flags |= flagAssumeValid
+	}
+	var ext uint16
+	if e.SkipWorktree {
+		ext |= flagSkipWorktree
+	}
+	if e.IntentToAdd {
+		ext |= flagIntentToAdd
+	}
+	if ext != 0 {
+		flags |= flagExtended
+	}
+	binary.Write(buf, binary.BigEndian, flags)
+	if ext != 0 {
+		binary.Write(buf, binary.BigEndian, ext)
+	}
+
+	if version == 4 {
+		common := 0
+		for common < len(prev) && common < len(e.Path) && prev[common] == e.Path[common] {
+			common++
+		}
+		buf.Write(appendOffset(nil, uint64(len(prev)-common)))
+		buf.WriteString(e.Path[common:])
+		buf.WriteByte(0)
+		return
+	}
+	buf.WriteString(e.Path)
+	size := (buf.Len() - start + 8) &^ 7
+	buf.Write(make([]byte, size-(buf.Len()-start)))
+}
+
+// WriteFile writes the index to path, using a lock file so that
+// readers never see a partially written index.
+func (idx *Index) WriteFile(path string) error {
+	f, err := os.OpenFile(path+".lock", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if os.IsExist(err) {
+		return errIndexLocked
+	}
+	if err != nil {
+		return err
+	}
+	err = idx.Write(f)
+	if errc := f.Close(); err == nil {
+		err = errc
+	}
+	if err == nil {
+		err = os.Rename(path+".lock", path)
+	}
+	if err != nil {
+		os.Remove(path + ".lock")
+	}
+	return err
+}
+
+// entryLess is the ordering of index entries: by path, then
+// by stage.
+func entryLess(path1 string, stage1 int, path2 string, stage2 int) bool {
+	if path1 != path2 {
+		return path1 < path2
+	}
+	return stage1 < stage2
+}
+
+// find returns the position where an entry with the given path
+// and stage is or would be inserted.
+func (idx *Index) find(path string, stage int) (int, bool) {
+	i := sort.Search(len(idx.Entries), func(i int) bool {
+		e := &idx.Entries[i]
+		return !entryLess(e.Path, e.Stage, path, stage)
+	})
+	found := i < len(idx.Entries) && idx.Entries[i].Path == path && idx.Entries[i].Stage == stage
+	return i, found
+}
+
+// Entry returns the stage 0 entry for path, if any.
+func (idx *Index) Entry(path string) (*Entry, bool) {
+	i, ok := idx.find(path, 0)
+	if !ok {
+		return nil, false
+	}
+	return &idx.Entries[i], true
+}
+
+// Add inserts or replaces an entry, keeping entries sorted. Adding
+// a stage 0 entry removes conflict entries for the same path.
+func (idx *Index) Add(e Entry) {
+	if e.Stage == 0 {
+		idx.removeStages(e.Path)
+	}
+	i, ok := idx.find(e.Path, e.Stage)
+	if ok {
+		idx.Entries[i] = e
+	} else {
+		idx.Entries = append(idx.Entries, Entry{})
+		copy(idx.Entries[i+1:], idx.Entries[i:])
+		idx.Entries[i] = e
+	}
+	if idx.Tree != nil {
+		idx.Tree.Invalidate(e.Path)
+	}
+}
+
+// Remove removes all entries for path, in any stage. It reports
+// whether an entry was removed.
+func (idx *Index) Remove(path string) bool {
+	removed := idx.removeStages(path)
+	if removed && idx.Tree != nil {
+		idx.Tree.Invalidate(path)
+	}
+	return removed
+}
+
+func (idx *Index) removeStages(path string) bool {
+	i, _ := idx.find(path, 0)
+	j := i
+	for j < len(idx.Entries) && idx.Entries[j].Path == path {
+		j++
+	}
+	idx.Entries = append(idx.Entries[:i], idx.Entries[j:]...)
+	return j > i
+}
+
+// NewEntry returns an entry for a file, filling stat data from
+// info. Only the fields available through os.FileInfo are set:
+// ctime is set to the modification time and device, inode and
+// owner are zero, so that Git will refresh them when needed.
+func NewEntry(path string, info os.FileInfo, hash objects.Hash) Entry {
+	e := Entry{
+		Ctime: info.ModTime(),
+		Mtime: info.ModTime(),
+		Size:  uint32(info.Size()),
+		Hash:  hash,
+		Path:  path,
+	}
+	switch mode := info.Mode(); {
+	case mode&os.ModeSymlink != 0:
+		e.Mode = 0120000
+	case mode&0111 != 0:
+		e.Mode = 0100755
+	default:
+		e.Mode = 0100644
+	}
+	return e
+}
+
+// readOffset decodes the variable-length integers used for path
+// compression, which is the same as offsets of delta bases in
+// packfiles.
+func readOffset(p []byte) (v uint64, n int) {
+	for i, b := range p {
+		if i > 0 {
+			v++
+		}
+		v = v<<7 | uint64(b&0x7f)
+		if b&0x80 == 0 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
+
+func appendOffset(s []byte, v uint64) []byte {
+	var buf [16]byte
+	i := len(buf) - 1
+	buf[i] = byte(v & 0x7f)
+	for v >>= 7; v > 0; v >>= 7 {
+		v--
+		i--
+		buf[i] = 0x80 | byte(v&0x7f)
+	}
+	return append(s, buf[i:]...)
+}
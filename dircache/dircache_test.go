@@ -0,0 +1,140 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dircache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+// The test indexes were created by Git in a repository holding
+// files a, dir/b and dir/sub/c:
+//
+// index-conflict: a merge conflict on a (stages 1, 2, 3).
+// index-ext: a resolved conflict, with TREE, REUC and UNTR extensions.
+// index-v3: an extra file dir/new added with git add -N.
+// index-v4: the same files, after git update-index --index-version 4.
+
+func readTestIndex(t *testing.T, name string) ([]byte, *Index) {
+	data, err := ioutil.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := Parse(data)
+	if err != nil {
+		t.Fatalf("%s: %s", name, err)
+	}
+	return data, idx
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, name := range []string{"index-conflict", "index-ext", "index-v3", "index-v4"} {
+		data, idx := readTestIndex(t, name)
+		buf := new(bytes.Buffer)
+		if err := idx.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), data) {
+			t.Errorf("%s: round trip differs", name)
+		}
+	}
+}
+
+func TestParseEntries(t *testing.T) {
+	_, idx := readTestIndex(t, "index-conflict")
+	var stages []int
+	for _, e := range idx.Entries {
+		if e.Path == "a" {
+			stages = append(stages, e.Stage)
+		}
+	}
+	if len(stages) != 3 || stages[0] != 1 || stages[1] != 2 || stages[2] != 3 {
+		t.Errorf("got stages %v for a, expected [1 2 3]", stages)
+	}
+
+	_, idx = readTestIndex(t, "index-v3")
+	e, ok := idx.Entry("dir/new")
+	if !ok || !e.IntentToAdd || idx.Version != 3 {
+		t.Errorf("dir/new is not an intent-to-add entry in a version 3 index")
+	}
+
+	_, idx = readTestIndex(t, "index-v4")
+	var paths []string
+	for _, e := range idx.Entries {
+		paths = append(paths, e.Path)
+	}
+	expect := []string{"a", "dir/b", "dir/sub/c", "link"}
+	if len(paths) != len(expect) {
+		t.Fatalf("got paths %q, expected %q", paths, expect)
+	}
+	for i := range paths {
+		if paths[i] != expect[i] {
+			t.Errorf("got paths %q, expected %q", paths, expect)
+		}
+	}
+	if e, _ := idx.Entry("dir/b"); e.Mode != 0100755 {
+		t.Errorf("got mode %o for dir/b, expected 100755", e.Mode)
+	}
+	if e, _ := idx.Entry("link"); e.Mode != 0120000 {
+		t.Errorf("got mode %o for link, expected 120000", e.Mode)
+	}
+}
+
+func TestExtensions(t *testing.T) {
+	_, idx := readTestIndex(t, "index-ext")
+	if idx.Tree == nil {
+		t.Fatal("missing cached tree")
+	}
+	if idx.Tree.Entries != 3 || len(idx.Tree.Subtrees) != 1 {
+		t.Errorf("bad root cached tree %+v", idx.Tree)
+	}
+	var sigs []string
+	for _, ext := range idx.Extensions {
+		sigs = append(sigs, string(ext.Signature[:]))
+	}
+	if len(sigs) != 2 || sigs[0] != "REUC" || sigs[1] != "UNTR" {
+		t.Errorf("got extensions %q, expected REUC and UNTR", sigs)
+	}
+
+	// Modifying an entry invalidates the cached trees above it.
+	e, _ := idx.Entry("dir/sub/c")
+	e2 := *e
+	e2.Hash[0]++
+	idx.Add(e2)
+	dir := idx.Tree.Subtrees[0]
+	if idx.Tree.Entries != -1 || dir.Entries != -1 || dir.Subtrees[0].Entries != -1 {
+		t.Errorf("cached trees were not invalidated")
+	}
+	buf := new(bytes.Buffer)
+	if err := idx.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	idx2, err := Parse(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, _ := idx2.Entry("dir/sub/c"); e.Hash != e2.Hash {
+		t.Errorf("modified entry was not written")
+	}
+}
+
+func TestAddRemove(t *testing.T) {
+	_, idx := readTestIndex(t, "index-conflict")
+	e := idx.Entries[0]
+	e.Stage = 0
+	idx.Add(e)
+	if len(idx.Entries) != 4 {
+		t.Errorf("got %d entries after resolving conflict, expected 4", len(idx.Entries))
+	}
+	e.Path = "dir/a"
+	idx.Add(e)
+	if idx.Entries[1].Path != "dir/a" {
+		t.Errorf("entry inserted at the wrong place")
+	}
+	if !idx.Remove("dir/a") || idx.Remove("dir/a") {
+		t.Errorf("bad result for Remove")
+	}
+}
@@ -15,20 +15,30 @@ var (
 	errOldVersionSizeMismatch = errors.New("gitdelta: old version size mismatch")
 	errNewVersionSizeMismatch = errors.New("gitdelta: new version size mismatch")
 	errUnexpectedNulByte      = errors.New("gitdelta: unexpected nul byte")
+	errTruncatedDelta         = errors.New("gitdelta: truncated delta")
+	errCopyOutOfRange         = errors.New("gitdelta: copy out of range of old version")
 )
 
 func Patch(old, patch []byte) ([]byte, error) {
 	// The header is two varints for old size and new size.
 	sz1, n1 := binary.Uvarint(patch)
-	if n1 >= len(patch) {
+	if n1 <= 0 || n1 >= len(patch) {
 		return nil, errCorruptedDeltaHeader
 	}
 	sz2, n2 := binary.Uvarint(patch[n1:])
+	if n2 <= 0 {
+		return nil, errCorruptedDeltaHeader
+	}
 
 	if sz1 != uint64(len(old)) {
 		return nil, errOldVersionSizeMismatch
 	}
-	newer := make([]byte, 0, sz2)
+	// The announced size is not trusted for allocation.
+	capacity := sz2
+	if max := uint64(len(old)) + uint64(len(patch)); capacity > max {
+		capacity = max
+	}
+	newer := make([]byte, 0, capacity)
 
 	p := n1 + n2
 	for p < len(patch) {
@@ -39,12 +49,18 @@ func Patch(old, patch []byte) ([]byte, error) {
 			var offset, length uint32
 			for i := uint(0); i < 4; i++ {
 				if b&(1<<i) != 0 {
+					if p >= len(patch) {
+						return nil, errTruncatedDelta
+					}
 					offset |= uint32(patch[p]) << (8 * i)
 					p++
 				}
 			}
 			for i := uint(0); i < 3; i++ {
 				if b&(0x10<<i) != 0 {
+					if p >= len(patch) {
+						return nil, errTruncatedDelta
+					}
 					length |= uint32(patch[p]) << (8 * i)
 					p++
 				}
@@ -52,10 +68,22 @@ func Patch(old, patch []byte) ([]byte, error) {
 			if length == 0 {
 				length = 1 << 16
 			}
-			// TODO: guard against index panics.
-			newer = append(newer, old[int64(offset):int64(offset)+int64(length)]...)
+			start, end := uint64(offset), uint64(offset)+uint64(length)
+			if end > uint64(len(old)) {
+				return nil, errCopyOutOfRange
+			}
+			if uint64(len(newer))+uint64(length) > sz2 {
+				return nil, errNewVersionSizeMismatch
+			}
+			newer = append(newer, old[start:end]...)
 		} else if b != 0 {
 			// copy some data from patch
+			if p+int(b) > len(patch) {
+				return nil, errTruncatedDelta
+			}
+			if uint64(len(newer))+uint64(b) > sz2 {
+				return nil, errNewVersionSizeMismatch
+			}
 			newer = append(newer, patch[p:p+int(b)]...)
 			p += int(b)
 		} else {
@@ -37,6 +37,33 @@ func TestPatch(t *testing.T) {
 	}
 }
 
+func TestPatchErrors(t *testing.T) {
+	old := []byte("0123456789")
+	for _, test := range []struct {
+		patch []byte
+		err   error
+	}{
+		{[]byte{}, errCorruptedDeltaHeader},
+		{[]byte{0x80, 0x80}, errCorruptedDeltaHeader},
+		{[]byte{10, 0x80}, errCorruptedDeltaHeader},
+		{[]byte{9, 5}, errOldVersionSizeMismatch},
+		{[]byte{10, 100, 0x90, 100}, errCopyOutOfRange},
+		{[]byte{10, 5, 0x91, 8, 5}, errCopyOutOfRange},
+		{[]byte{10, 5, 0x91, 2}, errTruncatedDelta},
+		{[]byte{10, 5, 5, 'a', 'b'}, errTruncatedDelta},
+		{[]byte{10, 2, 0x90, 5}, errNewVersionSizeMismatch},
+		{[]byte{10, 1, 2, 'a', 'b'}, errNewVersionSizeMismatch},
+		{[]byte{10, 3, 2, 'a', 'b'}, errNewVersionSizeMismatch},
+		{[]byte{10, 0, 0}, errUnexpectedNulByte},
+		// A huge announced size is not allocated.
+		{[]byte{10, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f, 1, 'a'}, errNewVersionSizeMismatch},
+	} {
+		if _, err := Patch(old, test.patch); err != test.err {
+			t.Errorf("patch %x: got error %v, expected %v", test.patch, err, test.err)
+		}
+	}
+}
+
 func TestDiff(t *testing.T) {
 	s1 := mustRead(t, "testdata/golden.old")
 	s2 := mustRead(t, "testdata/golden.new")
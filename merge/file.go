@@ -0,0 +1,237 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package merge
+
+import (
+	"bytes"
+
+	"github.com/remyoudompheng/gigot/textdiff"
+)
+
+// This file implements three-way merges of texts, in the manner of
+// git-merge-file(1).
+//
+// The changes from the base to each side are computed, and changes
+// of both sides which overlap or touch are grouped. Groups changed
+// on a single side, or identically on both sides, merge cleanly.
+// Otherwise, like Git's "zealous" merge level, the two versions are
+// compared again so that only differing lines are in conflict, and
+// conflicts separated by at most 3 lines are joined.
+
+// markerSize is the length of conflict markers.
+const markerSize = 7
+
+// A hunk is a region of the merged text: either lines taken as is,
+// or a conflict between our lines and their lines.
+type hunk struct {
+	conflict     bool
+	lines        [][]byte // lines of a clean hunk.
+	ours, theirs [][]byte
+}
+
+// MergeFile merges the changes made from base to ours and from base
+// to theirs. It returns the merged text, where conflicts are
+// delimited by markers followed by the labels of opts, and the
+// number of conflicts. Options may be nil.
+func MergeFile(base, ours, theirs []byte, opts *Options) ([]byte, int) {
+	if opts == nil {
+		opts = new(Options)
+	}
+	o, a, b := textdiff.SplitLines(base), textdiff.SplitLines(ours), textdiff.SplitLines(theirs)
+	diffOpts := &textdiff.Options{Algorithm: opts.Algorithm}
+	hunks := merge3(o, a, b, diffOpts)
+
+	ourLabel, theirLabel := opts.labels()
+	buf := new(bytes.Buffer)
+	conflicts := 0
+	for _, h := range hunks {
+		if !h.conflict {
+			writeLines(buf, h.lines)
+			continue
+		}
+		conflicts++
+		buf.WriteString(marker('<', ourLabel))
+		writeLines(buf, h.ours)
+		buf.WriteString(marker('=', ""))
+		writeLines(buf, h.theirs)
+		buf.WriteString(marker('>', theirLabel))
+	}
+	return buf.Bytes(), conflicts
+}
+
+// marker returns a conflict marker line.
+func marker(c byte, label string) string {
+	s := string(bytes.Repeat([]byte{c}, markerSize))
+	if label != "" {
+		s += " " + label
+	}
+	return s + "\n"
+}
+
+// writeLines writes the lines of a hunk.
+func writeLines(buf *bytes.Buffer, lines [][]byte) {
+	for _, l := range lines {
+		buf.Write(l)
+	}
+}
+
+// merge3 computes the hunks of the merged text.
+func merge3(o, a, b [][]byte, opts *textdiff.Options) []hunk {
+	ea := textdiff.Diff(o, a, opts)
+	eb := textdiff.Diff(o, b, opts)
+	var hunks []hunk
+	clean := func(lines [][]byte) {
+		if len(lines) == 0 {
+			return
+		}
+		// Lines are copied, since they share the arrays of the
+		// split texts.
+		if n := len(hunks); n > 0 && !hunks[n-1].conflict {
+			hunks[n-1].lines = append(hunks[n-1].lines, lines...)
+			return
+		}
+		hunks = append(hunks, hunk{lines: append([][]byte(nil), lines...)})
+	}
+
+	// deltaA and deltaB are the differences between positions in
+	// each side and in the base, after the edits already processed.
+	pos, deltaA, deltaB := 0, 0, 0
+	for len(ea) > 0 || len(eb) > 0 {
+		// Find a group of edits overlapping or touching each other.
+		var lo int
+		switch {
+		case len(eb) == 0 || len(ea) > 0 && ea[0].OldPos <= eb[0].OldPos:
+			lo = ea[0].OldPos
+		default:
+			lo = eb[0].OldPos
+		}
+		hi := lo
+		changedA, changedB := false, false
+		startA, startB := lo+deltaA, lo+deltaB
+		for {
+			if len(ea) > 0 && ea[0].OldPos <= hi {
+				e := ea[0]
+				ea = ea[1:]
+				changedA = true
+				deltaA += e.NewLines - e.OldLines
+				if end := e.OldPos + e.OldLines; end > hi {
+					hi = end
+				}
+				continue
+			}
+			if len(eb) > 0 && eb[0].OldPos <= hi {
+				e := eb[0]
+				eb = eb[1:]
+				changedB = true
+				deltaB += e.NewLines - e.OldLines
+				if end := e.OldPos + e.OldLines; end > hi {
+					hi = end
+				}
+				continue
+			}
+			break
+		}
+		clean(o[pos:lo])
+		pos = hi
+		ours, theirs := a[startA:hi+deltaA], b[startB:hi+deltaB]
+		switch {
+		case !changedB:
+			clean(ours)
+		case !changedA:
+			clean(theirs)
+		case equalLines(ours, theirs):
+			clean(ours)
+		default:
+			for _, h := range refineConflict(ours, theirs, opts) {
+				if h.conflict {
+					hunks = append(hunks, h)
+				} else {
+					clean(h.lines)
+				}
+			}
+		}
+	}
+	clean(o[pos:])
+	return joinConflicts(hunks)
+}
+
+// equalLines reports whether a and b are the same lines.
+func equalLines(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// refineConflict compares both versions of a conflict, and returns
+// hunks where only differing lines are in conflict.
+func refineConflict(ours, theirs [][]byte, opts *textdiff.Options) []hunk {
+	var hunks []hunk
+	i := 0
+	for _, e := range textdiff.Diff(ours, theirs, opts) {
+		if e.OldPos > i {
+			hunks = append(hunks, hunk{lines: ours[i:e.OldPos]})
+		}
+		hunks = append(hunks, hunk{
+			conflict: true,
+			ours:     ours[e.OldPos : e.OldPos+e.OldLines],
+			theirs:   theirs[e.NewPos : e.NewPos+e.NewLines],
+		})
+		i = e.OldPos + e.OldLines
+	}
+	if i < len(ours) {
+		hunks = append(hunks, hunk{lines: ours[i:]})
+	}
+	return hunks
+}
+
+// joinConflicts joins conflicts separated by at most 3 lines, and
+// terminates lines of conflicts with a newline.
+func joinConflicts(hunks []hunk) []hunk {
+	var out []hunk
+	for i := 0; i < len(hunks); i++ {
+		h := hunks[i]
+		n := len(out)
+		if h.conflict && n >= 2 && !out[n-1].conflict && out[n-2].conflict && len(out[n-1].lines) <= 3 {
+			prev, common := &out[n-2], out[n-1].lines
+			prev.ours = concatLines(prev.ours, common, h.ours)
+			prev.theirs = concatLines(prev.theirs, common, h.theirs)
+			out = out[:n-1]
+			continue
+		}
+		out = append(out, h)
+	}
+	for i := range out {
+		if out[i].conflict {
+			out[i].ours = terminate(out[i].ours)
+			out[i].theirs = terminate(out[i].theirs)
+		}
+	}
+	return out
+}
+
+// concatLines returns a new list of lines holding the given lines.
+func concatLines(parts ...[][]byte) [][]byte {
+	var lines [][]byte
+	for _, p := range parts {
+		lines = append(lines, p...)
+	}
+	return lines
+}
+
+// terminate adds a newline to the last line, if it has none.
+func terminate(lines [][]byte) [][]byte {
+	n := len(lines)
+	if n == 0 || bytes.HasSuffix(lines[n-1], []byte("\n")) {
+		return lines
+	}
+	lines = append(lines[:n-1:n-1], append(lines[n-1][:len(lines[n-1]):len(lines[n-1])], '\n'))
+	return lines
+}
@@ -0,0 +1,93 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package merge
+
+import (
+	"strings"
+	"testing"
+)
+
+// lines returns a text whose lines are the words of s.
+func lines(s string) string {
+	return strings.Join(strings.Fields(s), "\n") + "\n"
+}
+
+// Expected results were obtained with git merge-file -p.
+var mergeFileTests = []struct {
+	name               string
+	base, ours, theirs string
+	expect             string
+	conflicts          int
+}{
+	{
+		"clean",
+		lines("a b c d e f g h"),
+		lines("a B c d e f g h"),
+		lines("a b c d e f G h"),
+		lines("a B c d e f G h"),
+		0,
+	},
+	{
+		"same change",
+		lines("a b c"),
+		lines("a B c"),
+		lines("a B c"),
+		lines("a B c"),
+		0,
+	},
+	{
+		"joined conflicts",
+		lines("a b c d e f g h"),
+		lines("a X c d Y f g h"),
+		lines("a Z c d W f g h"),
+		lines("a <<<<<<<_ours X c d Y ======= Z c d W >>>>>>>_theirs f g h"),
+		1,
+	},
+	{
+		"separate conflicts",
+		lines("a b c d e f g h"),
+		lines("a X c d e f Y h"),
+		lines("a Z c d e f W h"),
+		lines("a <<<<<<<_ours X ======= Z >>>>>>>_theirs c d e f " +
+			"<<<<<<<_ours Y ======= W >>>>>>>_theirs h"),
+		2,
+	},
+	{
+		"missing newline",
+		lines("a b c d e f g h"),
+		lines("a b c d e f g h") + "ours",
+		lines("a b c d e f g h") + "theirs",
+		lines("a b c d e f g h <<<<<<<_ours ours ======= theirs >>>>>>>_theirs"),
+		1,
+	},
+	{
+		"refined conflict",
+		lines("a b c d e f g h"),
+		lines("a b1 same c d"),
+		lines("a b2 same c d"),
+		lines("a <<<<<<<_ours b1 ======= b2 >>>>>>>_theirs same c d"),
+		1,
+	},
+}
+
+func TestMergeFile(t *testing.T) {
+	for _, test := range mergeFileTests {
+		got, n := MergeFile([]byte(test.base), []byte(test.ours), []byte(test.theirs), nil)
+		expect := strings.Replace(test.expect, "_", " ", -1)
+		if string(got) != expect || n != test.conflicts {
+			t.Errorf("%s: got %d conflicts:\n%s\nexpected %d:\n%s",
+				test.name, n, got, test.conflicts, expect)
+		}
+	}
+}
+
+func TestMergeFileLabels(t *testing.T) {
+	opts := &Options{OursLabel: "HEAD", TheirsLabel: "topic"}
+	got, n := MergeFile([]byte(lines("a b c")), []byte(lines("a X c")), []byte(lines("a Y c")), opts)
+	expect := "a\n<<<<<<< HEAD\nX\n=======\nY\n>>>>>>> topic\nc\n"
+	if string(got) != expect || n != 1 {
+		t.Errorf("got %d conflicts:\n%s\nexpected:\n%s", n, got, expect)
+	}
+}
@@ -0,0 +1,389 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// package merge performs three-way merges of Git trees, in the
+// manner of git-merge-tree(1) with the --write-tree option.
+//
+// Files changed on a single side, or identically on both sides, are
+// resolved from their hashes and modes. Files modified on both sides
+// are merged line by line. Renames are detected on each side, so
+// that changes follow renamed files. Conflicts are reported as
+// structured data, and conflicted files are written with conflict
+// markers in the merged tree. No working directory is involved.
+package merge
+
+import (
+	"errors"
+	"os"
+	"sort"
+
+	"github.com/remyoudompheng/gigot/objects"
+	"github.com/remyoudompheng/gigot/textdiff"
+	"github.com/remyoudompheng/gigot/treediff"
+)
+
+// Options control merges.
+type Options struct {
+	// OursLabel and TheirsLabel name the sides of conflicts after
+	// conflict markers. They default to "ours" and "theirs".
+	OursLabel, TheirsLabel string
+	// Algorithm is used to compare versions of files.
+	Algorithm textdiff.Algorithm
+	// NoRenames disables rename detection in tree merges.
+	NoRenames bool
+	// RenameScore is the minimal similarity of renames, in percent.
+	// The default is 50.
+	RenameScore int
+}
+
+// labels returns the labels of both sides.
+func (opts *Options) labels() (ours, theirs string) {
+	ours, theirs = opts.OursLabel, opts.TheirsLabel
+	if ours == "" {
+		ours = "ours"
+	}
+	if theirs == "" {
+		theirs = "theirs"
+	}
+	return ours, theirs
+}
+
+// A ConflictType is the kind of a merge conflict.
+type ConflictType int
+
+const (
+	Content       ConflictType = iota + 1 // Both sides modified the file differently.
+	ModifyDelete                          // One side modified the file, the other deleted it.
+	RenameDelete                          // One side renamed the file, the other deleted it.
+	RenameRename                          // Both sides renamed the file differently.
+	AddAdd                                // Both sides added different files at the same path.
+	Mode                                  // Both sides changed the mode of the file differently.
+	DirectoryFile                         // A file was added where the other side has a directory.
+)
+
+// String returns the name used by Git for the conflict.
+func (t ConflictType) String() string {
+	switch t {
+	case Content:
+		return "content"
+	case ModifyDelete:
+		return "modify/delete"
+	case RenameDelete:
+		return "rename/delete"
+	case RenameRename:
+		return "rename/rename"
+	case AddAdd:
+		return "add/add"
+	case Mode:
+		return "mode"
+	case DirectoryFile:
+		return "directory/file"
+	}
+	return "unknown"
+}
+
+// A Stage is a version of a conflicted file. The hash of a missing
+// version is zero.
+type Stage struct {
+	Path string
+	Mode os.FileMode
+	Hash objects.Hash
+}
+
+// A Conflict describes a file that could not be merged cleanly.
+// Its versions in the base, our and their trees are given as
+// Stages, like stages 1 to 3 of the Git index.
+type Conflict struct {
+	Type   ConflictType
+	Path   string // The path of the file in the merged tree.
+	Stages [3]Stage
+}
+
+// A Result is the outcome of a merge.
+type Result struct {
+	Tree      objects.Hash // The merged tree, possibly with conflict markers.
+	Conflicts []Conflict   // Conflicts, sorted by path.
+}
+
+var (
+	errNotTree = errors.New("merge: object is not a tree")
+	errNotBlob = errors.New("merge: object is not a blob")
+)
+
+// MergeTrees merges the changes made from base to ours and from base
+// to theirs. A zero hash stands for the empty tree. New blobs and
+// trees are stored in store. Options may be nil.
+func MergeTrees(store objects.ObjectStore, base, ours, theirs objects.Hash, opts *Options) (*Result, error) {
+	m := &merger{
+		store: store,
+		edits: make(map[string]*edit),
+		added: make(map[string]*[2]*placement),
+	}
+	if opts != nil {
+		m.opts = *opts
+	}
+	// Trivial merges.
+	switch {
+	case ours == theirs, base == theirs:
+		return m.trivial(ours)
+	case base == ours:
+		return m.trivial(theirs)
+	}
+
+	diffOpts := &treediff.Options{
+		DetectRenames: !m.opts.NoRenames,
+		MinScore:      m.opts.RenameScore,
+	}
+	oursChanges, err := treediff.DiffTrees(store, base, ours, diffOpts)
+	if err != nil {
+		return nil, err
+	}
+	theirsChanges, err := treediff.DiffTrees(store, base, theirs, diffOpts)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.mergeChanges(oursChanges, theirsChanges); err != nil {
+		return nil, err
+	}
+	tree, _, err := m.writeTree(base, "", m.edits)
+	if err != nil {
+		return nil, err
+	}
+	sort.Stable(conflictsByPath(m.conflicts))
+	return &Result{Tree: tree, Conflicts: m.conflicts}, nil
+}
+
+// trivial returns the result of a merge whose result is tree, which
+// is stored if it is the empty tree.
+func (m *merger) trivial(tree objects.Hash) (*Result, error) {
+	if tree == (objects.Hash{}) {
+		var err error
+		if tree, err = m.store.Put(objects.Tree{}); err != nil {
+			return nil, err
+		}
+	}
+	return &Result{Tree: tree}, nil
+}
+
+type conflictsByPath []Conflict
+
+func (s conflictsByPath) Len() int           { return len(s) }
+func (s conflictsByPath) Less(i, j int) bool { return s[i].Path < s[j].Path }
+func (s conflictsByPath) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// A merger holds the state of a tree merge.
+type merger struct {
+	store     objects.ObjectStore
+	opts      Options
+	edits     map[string]*edit          // changes to the base tree, by path.
+	added     map[string]*[2]*placement // files new to the base tree, by path and side.
+	conflicts []Conflict
+}
+
+// An edit replaces or removes a file of the base tree.
+type edit struct {
+	deleted bool
+	entry   objects.TreeElem // Mode and Hash of the new file.
+	side    int              // The side of the file, for directory/file conflicts.
+}
+
+// A placement is a file added at a path absent from the base tree,
+// either by an addition or a rename.
+type placement struct {
+	entry objects.TreeElem
+	stage Stage
+}
+
+// Sides of a merge, indexing Stages from 1.
+const (
+	sideOurs = iota
+	sideTheirs
+)
+
+// mergeChanges computes the edits of the base tree from the changes
+// of both sides.
+func (m *merger) mergeChanges(oursChanges, theirsChanges []treediff.Change) error {
+	var changed [2]map[string]*treediff.Change // changes by path in the base tree.
+	var paths []string
+	for side, changes := range [2][]treediff.Change{oursChanges, theirsChanges} {
+		changed[side] = make(map[string]*treediff.Change)
+		for i := range changes {
+			c := &changes[i]
+			if c.Type == treediff.Added {
+				m.add(c.NewPath, side, placement{entry: newEntry(c), stage: newStage(c)})
+				continue
+			}
+			if changed[sideOurs][c.OldPath] == nil && changed[sideTheirs][c.OldPath] == nil {
+				paths = append(paths, c.OldPath)
+			}
+			changed[side][c.OldPath] = c
+		}
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		if err := m.mergePath(p, changed[sideOurs][p], changed[sideTheirs][p]); err != nil {
+			return err
+		}
+	}
+
+	added := make([]string, 0, len(m.added))
+	for p := range m.added {
+		added = append(added, p)
+	}
+	sort.Strings(added)
+	for _, p := range added {
+		if err := m.mergeAdded(p, m.added[p]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func oldStage(c *treediff.Change) Stage {
+	return Stage{Path: c.OldPath, Mode: c.OldMode, Hash: c.OldHash}
+}
+
+func newStage(c *treediff.Change) Stage {
+	return Stage{Path: c.NewPath, Mode: c.NewMode, Hash: c.NewHash}
+}
+
+func newEntry(c *treediff.Change) objects.TreeElem {
+	return objects.TreeElem{Mode: c.NewMode, Hash: c.NewHash}
+}
+
+// set replaces the file at path p in the merged tree.
+func (m *merger) set(p string, e objects.TreeElem, side int) {
+	m.edits[p] = &edit{entry: e, side: side}
+}
+
+// remove removes the file of the base tree at path p.
+func (m *merger) remove(p string) {
+	if _, ok := m.edits[p]; !ok {
+		m.edits[p] = &edit{deleted: true}
+	}
+}
+
+// add records a file added by a side at a path new to the base tree.
+func (m *merger) add(p string, side int, pl placement) {
+	sides := m.added[p]
+	if sides == nil {
+		sides = new([2]*placement)
+		m.added[p] = sides
+	}
+	sides[side] = &pl
+}
+
+func (m *merger) conflict(t ConflictType, p string, stages [3]Stage) {
+	m.conflicts = append(m.conflicts, Conflict{Type: t, Path: p, Stages: stages})
+}
+
+// mergePath merges the changes of both sides to the file at path p
+// of the base tree. A nil change means that the file is unchanged.
+func (m *merger) mergePath(p string, a, b *treediff.Change) error {
+	changes := [2]*treediff.Change{a, b}
+	for side, c := range changes {
+		if changes[1-side] != nil {
+			continue
+		}
+		// Only one side changed the file.
+		switch c.Type {
+		case treediff.Deleted:
+			m.remove(p)
+		case treediff.Renamed:
+			m.remove(p)
+			m.add(c.NewPath, side, placement{entry: newEntry(c), stage: newStage(c)})
+		default:
+			m.set(p, newEntry(c), side)
+		}
+		return nil
+	}
+
+	base := oldStage(a)
+	switch {
+	case a.Type == treediff.Deleted && b.Type == treediff.Deleted:
+		m.remove(p)
+		return nil
+	case a.Type == treediff.Deleted || b.Type == treediff.Deleted:
+		side := sideOurs
+		if a.Type == treediff.Deleted {
+			side = sideTheirs
+		}
+		c := changes[side]
+		stages := [3]Stage{base}
+		stages[1+side] = newStage(c)
+		if c.Type == treediff.Renamed {
+			m.remove(p)
+			m.add(c.NewPath, side, placement{entry: newEntry(c), stage: newStage(c)})
+			m.conflict(RenameDelete, c.NewPath, stages)
+		} else {
+			// Like Git, keep the modified file.
+			m.set(p, newEntry(c), side)
+			m.conflict(ModifyDelete, p, stages)
+		}
+		return nil
+	}
+
+	// Both sides modified or renamed the file.
+	stages := [3]Stage{base, newStage(a), newStage(b)}
+	e, content, mode, err := m.mergeEntry(base, stages[1], stages[2])
+	if err != nil {
+		return err
+	}
+	var dests []string
+	switch {
+	case a.Type != treediff.Renamed && b.Type != treediff.Renamed:
+		m.set(p, e, sideOurs)
+		dests = []string{p}
+	default:
+		m.remove(p)
+		for side, c := range changes {
+			if c.Type != treediff.Renamed {
+				continue
+			}
+			m.add(c.NewPath, side, placement{entry: e, stage: stages[1+side]})
+			if len(dests) == 0 || dests[0] != c.NewPath {
+				dests = append(dests, c.NewPath)
+			}
+		}
+		if len(dests) > 1 {
+			for _, d := range dests {
+				m.conflict(RenameRename, d, stages)
+			}
+		}
+	}
+	for _, d := range dests {
+		if content {
+			m.conflict(Content, d, stages)
+		}
+		if mode {
+			m.conflict(Mode, d, stages)
+		}
+	}
+	return nil
+}
+
+// mergeAdded merges files added by both sides at the same path.
+func (m *merger) mergeAdded(p string, sides *[2]*placement) error {
+	a, b := sides[sideOurs], sides[sideTheirs]
+	switch {
+	case b == nil:
+		m.set(p, a.entry, sideOurs)
+		return nil
+	case a == nil:
+		m.set(p, b.entry, sideTheirs)
+		return nil
+	case a.entry == b.entry:
+		m.set(p, a.entry, sideOurs)
+		return nil
+	}
+	e, _, _, err := m.mergeEntry(Stage{},
+		Stage{Path: a.stage.Path, Mode: a.entry.Mode, Hash: a.entry.Hash},
+		Stage{Path: b.stage.Path, Mode: b.entry.Mode, Hash: b.entry.Hash})
+	if err != nil {
+		return err
+	}
+	m.set(p, e, sideOurs)
+	m.conflict(AddAdd, p, [3]Stage{{}, a.stage, b.stage})
+	return nil
+}
@@ -0,0 +1,246 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package merge
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/remyoudompheng/gigot/objects"
+)
+
+// A testFile describes a file of a test tree. Symlinks and
+// executables are denoted by their mode.
+type testFile struct {
+	path string
+	mode os.FileMode
+	data string
+}
+
+func testStore(t *testing.T) (*objects.LooseStore, func()) {
+	dir, err := ioutil.TempDir("", "gigot-merge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return objects.NewLooseStore(dir), func() { os.RemoveAll(dir) }
+}
+
+// putTree stores a tree holding the given files, which must be
+// sorted by path.
+func putTree(t *testing.T, store objects.ObjectStore, files []testFile) objects.Hash {
+	var tree objects.Tree
+	for len(files) > 0 {
+		f := files[0]
+		if i := strings.IndexByte(f.path, '/'); i >= 0 {
+			// Gather the files of the subdirectory.
+			dir := f.path[:i+1]
+			var sub []testFile
+			for len(files) > 0 && strings.HasPrefix(files[0].path, dir) {
+				f := files[0]
+				f.path = f.path[len(dir):]
+				sub = append(sub, f)
+				files = files[1:]
+			}
+			tree.Entries = append(tree.Entries, objects.TreeElem{
+				Name: dir[:i], Mode: os.ModeDir, Hash: putTree(t, store, sub)})
+			continue
+		}
+		h, err := store.Put(objects.Blob{Data: []byte(f.data)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		mode := f.mode
+		if mode == 0 {
+			mode = 0644
+		}
+		tree.Entries = append(tree.Entries, objects.TreeElem{Name: f.path, Mode: mode, Hash: h})
+		files = files[1:]
+	}
+	h, err := store.Put(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// formatConflicts formats conflicts as "type path" lines.
+func formatConflicts(conflicts []Conflict) string {
+	var lines []string
+	for _, c := range conflicts {
+		lines = append(lines, fmt.Sprintf("%s %s", c.Type, c.Path))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// text is long enough for renames to be detected after a change.
+var text = lines("1 2 3 4 5 6 7 8 9 10")
+
+var mergeTreesTests = []struct {
+	name                       string
+	base, ours, theirs, expect []testFile
+	conflicts                  string
+}{
+	{
+		name:      "clean",
+		base:      []testFile{{"a", 0, "a\n"}, {"b", 0, "b\n"}, {"dir/c", 0, "c\n"}},
+		ours:      []testFile{{"a", 0, "A\n"}, {"b", 0, "b\n"}, {"dir/c", 0, "c\n"}},
+		theirs:    []testFile{{"a", 0, "a\n"}, {"d", 0, "d\n"}, {"dir/c", 0, "C\n"}},
+		expect:    []testFile{{"a", 0, "A\n"}, {"d", 0, "d\n"}, {"dir/c", 0, "C\n"}},
+		conflicts: "",
+	},
+	{
+		name:      "both sides",
+		base:      []testFile{{"a", 0, text}, {"b", 0, "b\n"}, {"dir/c", 0, "c\n"}},
+		ours:      []testFile{{"a", 0, strings.Replace(text, "2", "two", 1)}, {"e", 0, "e\n"}},
+		theirs:    []testFile{{"a", 0, strings.Replace(text, "9", "nine", 1)}, {"e", 0, "e\n"}},
+		expect:    []testFile{{"a", 0, strings.Replace(strings.Replace(text, "2", "two", 1), "9", "nine", 1)}, {"e", 0, "e\n"}},
+		conflicts: "",
+	},
+	{
+		name:      "content",
+		base:      []testFile{{"a", 0, lines("a b c")}, {"dir/b", 0, "b\n"}},
+		ours:      []testFile{{"a", 0, lines("a X c")}, {"dir/b", 0, "b\n"}},
+		theirs:    []testFile{{"a", 0, lines("a Y c")}, {"dir/b", 0, "B\n"}},
+		expect:    []testFile{{"a", 0, "a\n<<<<<<< ours\nX\n=======\nY\n>>>>>>> theirs\nc\n"}, {"dir/b", 0, "B\n"}},
+		conflicts: "content a",
+	},
+	{
+		name:      "modify/delete",
+		base:      []testFile{{"a", 0, "a\n"}, {"b", 0, "b\n"}},
+		ours:      []testFile{{"b", 0, "b\n"}},
+		theirs:    []testFile{{"a", 0, "A\n"}, {"b", 0, "b\n"}},
+		expect:    []testFile{{"a", 0, "A\n"}, {"b", 0, "b\n"}},
+		conflicts: "modify/delete a",
+	},
+	{
+		name:      "rename follows change",
+		base:      []testFile{{"a", 0, text}, {"b", 0, "b\n"}},
+		ours:      []testFile{{"b", 0, "b\n"}, {"dir/a", 0, text}},
+		theirs:    []testFile{{"a", 0, strings.Replace(text, "5", "five", 1)}, {"b", 0, "b\n"}},
+		expect:    []testFile{{"b", 0, "b\n"}, {"dir/a", 0, strings.Replace(text, "5", "five", 1)}},
+		conflicts: "",
+	},
+	{
+		name:      "rename/delete",
+		base:      []testFile{{"a", 0, text}, {"b", 0, "b\n"}},
+		ours:      []testFile{{"b", 0, "b\n"}, {"c", 0, text}},
+		theirs:    []testFile{{"b", 0, "b\n"}},
+		expect:    []testFile{{"b", 0, "b\n"}, {"c", 0, text}},
+		conflicts: "rename/delete c",
+	},
+	{
+		name:      "rename/rename",
+		base:      []testFile{{"a", 0, text}},
+		ours:      []testFile{{"b", 0, text}},
+		theirs:    []testFile{{"c", 0, text}},
+		expect:    []testFile{{"b", 0, text}, {"c", 0, text}},
+		conflicts: "rename/rename b\nrename/rename c",
+	},
+	{
+		name:      "add/add",
+		base:      []testFile{{"a", 0, "a\n"}},
+		ours:      []testFile{{"a", 0, "a\n"}, {"b", 0, "b\n"}, {"c", 0, "c\n"}},
+		theirs:    []testFile{{"a", 0, "a\n"}, {"b", 0, "B\n"}, {"c", 0, "c\n"}},
+		expect:    []testFile{{"a", 0, "a\n"}, {"b", 0, "<<<<<<< ours\nb\n=======\nB\n>>>>>>> theirs\n"}, {"c", 0, "c\n"}},
+		conflicts: "add/add b",
+	},
+	{
+		name:      "mode",
+		base:      []testFile{{"a", 0, "a\n"}, {"b", 0, "b\n"}},
+		ours:      []testFile{{"a", 0755, "a\n"}, {"b", 0755, "b\n"}},
+		theirs:    []testFile{{"a", 0, "A\n"}, {"b", os.ModeSymlink, "b\n"}},
+		expect:    []testFile{{"a", 0755, "A\n"}, {"b", 0755, "b\n"}},
+		conflicts: "mode b",
+	},
+	{
+		name:      "directory/file",
+		base:      []testFile{{"a", 0, "a\n"}},
+		ours:      []testFile{{"a", 0, "a\n"}, {"d", 0, "d\n"}},
+		theirs:    []testFile{{"a", 0, "a\n"}, {"d/x", 0, "x\n"}},
+		expect:    []testFile{{"a", 0, "a\n"}, {"d/x", 0, "x\n"}, {"d~ours", 0, "d\n"}},
+		conflicts: "directory/file d~ours",
+	},
+	{
+		name:      "delete directory",
+		base:      []testFile{{"a", 0, "a\n"}, {"dir/b", 0, "b\n"}, {"dir/c", 0, "c\n"}},
+		ours:      []testFile{{"a", 0, "A\n"}},
+		theirs:    []testFile{{"a", 0, "a\n"}, {"dir/b", 0, "b\n"}},
+		expect:    []testFile{{"a", 0, "A\n"}},
+		conflicts: "",
+	},
+	{
+		name:      "trivial",
+		base:      []testFile{{"a", 0, "a\n"}},
+		ours:      []testFile{{"a", 0, "a\n"}},
+		theirs:    nil,
+		expect:    nil,
+		conflicts: "",
+	},
+}
+
+func TestMergeTrees(t *testing.T) {
+	store, cleanup := testStore(t)
+	defer cleanup()
+	for _, test := range mergeTreesTests {
+		base := putTree(t, store, test.base)
+		ours := putTree(t, store, test.ours)
+		theirs := putTree(t, store, test.theirs)
+		res, err := MergeTrees(store, base, ours, theirs, nil)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if expect := putTree(t, store, test.expect); res.Tree != expect {
+			t.Errorf("%s: got tree %s, expected %s", test.name, res.Tree, expect)
+		}
+		if got := formatConflicts(res.Conflicts); got != test.conflicts {
+			t.Errorf("%s: got conflicts %q, expected %q", test.name, got, test.conflicts)
+		}
+	}
+}
+
+func TestMergeTreesStages(t *testing.T) {
+	store, cleanup := testStore(t)
+	defer cleanup()
+	base := putTree(t, store, []testFile{{"a", 0, text}})
+	ours := putTree(t, store, []testFile{{"b", 0, strings.Replace(text, "1", "one", 1)}})
+	theirs := putTree(t, store, []testFile{{"a", 0, strings.Replace(text, "1", "ONE", 1)}})
+	opts := &Options{OursLabel: "HEAD", TheirsLabel: "topic"}
+	res, err := MergeTrees(store, base, ours, theirs, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Conflicts) != 1 {
+		t.Fatalf("got conflicts %q", formatConflicts(res.Conflicts))
+	}
+	c := res.Conflicts[0]
+	if c.Type != Content || c.Path != "b" {
+		t.Errorf("got conflict %s %s, expected content b", c.Type, c.Path)
+	}
+	for i, p := range []string{"a", "b", "a"} {
+		if c.Stages[i].Path != p || c.Stages[i].Mode != 0644 {
+			t.Errorf("stage %d: got %s %o, expected %s", i+1, c.Stages[i].Path, c.Stages[i].Mode, p)
+		}
+	}
+
+	// Labels mention the paths of renamed files.
+	expect := putTree(t, store, []testFile{{"b", 0,
+		"<<<<<<< HEAD:b\none\n=======\nONE\n>>>>>>> topic:a\n" + text[2:]}})
+	if res.Tree != expect {
+		t.Errorf("got tree %s, expected %s", res.Tree, expect)
+	}
+
+	// Without rename detection, the rename is a deletion.
+	res, err = MergeTrees(store, base, ours, theirs, &Options{NoRenames: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := formatConflicts(res.Conflicts); got != "modify/delete a" {
+		t.Errorf("got conflicts %q, expected modify/delete a", got)
+	}
+}
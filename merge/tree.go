@@ -0,0 +1,217 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package merge
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/remyoudompheng/gigot/objects"
+	"github.com/remyoudompheng/gigot/textdiff"
+)
+
+// This file implements the merge of file versions, and the writing
+// of the merged tree.
+
+// isTree reports whether a tree entry is a subtree. Gitlinks are
+// not subtrees.
+func isTree(mode os.FileMode) bool {
+	return mode&os.ModeDir != 0 && mode&os.ModeSymlink == 0
+}
+
+// isRegular reports whether a tree entry is a regular file.
+func isRegular(mode os.FileMode) bool {
+	return mode&(os.ModeDir|os.ModeSymlink) == 0
+}
+
+func (m *merger) readBlob(h objects.Hash) ([]byte, error) {
+	if h == (objects.Hash{}) {
+		return nil, nil
+	}
+	o, err := m.store.Get(h)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := o.(objects.Blob)
+	if !ok {
+		return nil, errNotBlob
+	}
+	return b.Data, nil
+}
+
+// mergeEntry merges two versions of a file, whose base version may
+// be missing. It reports whether contents or modes conflict. Files
+// which cannot be merged line by line keep our version.
+func (m *merger) mergeEntry(base, a, b Stage) (e objects.TreeElem, content, mode bool, err error) {
+	hasBase := base.Hash != (objects.Hash{})
+	switch {
+	case a.Mode == b.Mode:
+		e.Mode = a.Mode
+	case hasBase && a.Mode == base.Mode:
+		e.Mode = b.Mode
+	case hasBase && b.Mode == base.Mode:
+		e.Mode = a.Mode
+	default:
+		e.Mode, mode = a.Mode, true
+	}
+
+	switch {
+	case a.Hash == b.Hash:
+		e.Hash = a.Hash
+		return e, false, mode, nil
+	case hasBase && a.Hash == base.Hash:
+		e.Hash = b.Hash
+		return e, false, mode, nil
+	case hasBase && b.Hash == base.Hash:
+		e.Hash = a.Hash
+		return e, false, mode, nil
+	case !isRegular(a.Mode) || !isRegular(b.Mode) || hasBase && !isRegular(base.Mode):
+		// Symlinks, gitlinks and type changes.
+		return objects.TreeElem{Mode: a.Mode, Hash: a.Hash}, true, mode, nil
+	}
+
+	var data [3][]byte
+	for i, h := range []objects.Hash{base.Hash, a.Hash, b.Hash} {
+		if data[i], err = m.readBlob(h); err != nil {
+			return e, false, false, err
+		}
+		if textdiff.IsBinary(data[i]) {
+			e.Hash = a.Hash
+			return e, true, mode, nil
+		}
+	}
+	opts := m.opts
+	opts.OursLabel, opts.TheirsLabel = m.opts.labels()
+	if a.Path != b.Path {
+		opts.OursLabel += ":" + a.Path
+		opts.TheirsLabel += ":" + b.Path
+	}
+	merged, conflicts := MergeFile(data[0], data[1], data[2], &opts)
+	if e.Hash, err = m.store.Put(objects.Blob{Data: merged}); err != nil {
+		return e, false, false, err
+	}
+	return e, conflicts > 0, mode, nil
+}
+
+// writeTree applies edits, whose paths are relative to dir, to the
+// tree base, and stores the resulting tree. A zero hash stands for
+// the empty tree. It reports whether the result is empty, in which
+// case it is only stored at the root.
+func (m *merger) writeTree(base objects.Hash, dir string, edits map[string]*edit) (objects.Hash, bool, error) {
+	entries := make(map[string]objects.TreeElem)
+	if base != (objects.Hash{}) {
+		o, err := m.store.Get(base)
+		if err != nil {
+			return base, false, err
+		}
+		t, ok := o.(objects.Tree)
+		if !ok {
+			return base, false, errNotTree
+		}
+		for _, e := range t.Entries {
+			entries[e.Name] = e
+		}
+	}
+
+	// Split edits between files of the tree and subdirectories.
+	var files, subdirs []string
+	nested := make(map[string]map[string]*edit)
+	for p := range edits {
+		i := strings.IndexByte(p, '/')
+		if i < 0 {
+			files = append(files, p)
+			continue
+		}
+		name := p[:i]
+		if nested[name] == nil {
+			nested[name] = make(map[string]*edit)
+			subdirs = append(subdirs, name)
+		}
+		nested[name][p[i+1:]] = edits[p]
+	}
+	sort.Strings(files)
+	sort.Strings(subdirs)
+
+	// Subdirectories first, so that files in their way are known.
+	dirs := make(map[string]bool)
+	for _, name := range subdirs {
+		var sub objects.Hash
+		if e, ok := entries[name]; ok && isTree(e.Mode) {
+			sub = e.Hash
+		}
+		h, empty, err := m.writeTree(sub, path.Join(dir, name), nested[name])
+		if err != nil {
+			return base, false, err
+		}
+		if empty {
+			if isTree(entries[name].Mode) {
+				delete(entries, name)
+			}
+			continue
+		}
+		dirs[name] = true
+		entries[name] = objects.TreeElem{Name: name, Mode: os.ModeDir, Hash: h}
+	}
+	for _, name := range files {
+		ed := edits[name]
+		if ed.deleted {
+			if !dirs[name] {
+				delete(entries, name)
+			}
+			continue
+		}
+		if e, ok := entries[name]; ok && isTree(e.Mode) {
+			// The file is in the way of a directory: like Git,
+			// move it aside.
+			ours, theirs := m.opts.labels()
+			label := ours
+			if ed.side == sideTheirs {
+				label = theirs
+			}
+			newName := name + "~" + label
+			for i := 0; ; i++ {
+				if _, ok := entries[newName]; !ok {
+					break
+				}
+				newName = fmt.Sprintf("%s~%s_%d", name, label, i)
+			}
+			entries[newName] = objects.TreeElem{Name: newName, Mode: ed.entry.Mode, Hash: ed.entry.Hash}
+			var stages [3]Stage
+			stages[1+ed.side] = Stage{Path: path.Join(dir, name), Mode: ed.entry.Mode, Hash: ed.entry.Hash}
+			m.conflict(DirectoryFile, path.Join(dir, newName), stages)
+			continue
+		}
+		entries[name] = objects.TreeElem{Name: name, Mode: ed.entry.Mode, Hash: ed.entry.Hash}
+	}
+
+	if len(entries) == 0 && dir != "" {
+		return objects.Hash{}, true, nil
+	}
+	var tree objects.Tree
+	for _, e := range entries {
+		tree.Entries = append(tree.Entries, e)
+	}
+	sort.Sort(entriesByName(tree.Entries))
+	h, err := m.store.Put(tree)
+	return h, len(entries) == 0, err
+}
+
+// entriesByName sorts tree entries in Git order, where subtrees
+// sort as if their name ended with a slash.
+type entriesByName []objects.TreeElem
+
+func (s entriesByName) Len() int           { return len(s) }
+func (s entriesByName) Less(i, j int) bool { return entryKey(s[i]) < entryKey(s[j]) }
+func (s entriesByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func entryKey(e objects.TreeElem) string {
+	if isTree(e.Mode) {
+		return e.Name + "/"
+	}
+	return e.Name
+}
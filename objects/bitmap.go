@@ -0,0 +1,350 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package objects
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// This file implements reachability bitmaps (.bitmap files), which
+// record for selected commits of a pack the set of objects reachable
+// from them.
+//
+// The file has a header ("BITM", 16-bit version and flags, number of
+// entries, pack checksum), four EWAH bitmaps listing commits, trees,
+// blobs and tags, then entries made of the index position of a
+// commit, a XOR offset, flags and an EWAH bitmap. A non-zero XOR
+// offset k means that the bitmap is stored XORed with the bitmap
+// of the k-th previous entry. Optional extensions (name-hash cache,
+// lookup table) follow entries, and the file ends with its checksum.
+//
+// Bits are object positions in pack order, not in index order.
+//
+// Cf. Documentation/technical/bitmap-format.txt in Git sources.
+
+const (
+	bitmapOptFullDAG   = 0x1
+	bitmapMaxXorOffset = 160
+
+	// Number of previous entries tried as XOR bases when
+	// writing bitmaps, as in Git.
+	bitmapXorSearch = 10
+)
+
+var (
+	errBadBitmapMagic           = errors.New("gigot: bad magic number in bitmap file")
+	errUnsupportedBitmapVersion = errors.New("gigot: bitmap file has unsupported format version")
+	errBitmapPackMismatch       = errors.New("gigot: bitmap file does not match pack")
+	errBitmapIncomplete         = errors.New("gigot: reachable object is missing from bitmapped pack")
+	errBitmapNotCommit          = errors.New("gigot: bitmapped object is not a commit")
+)
+
+// A PackBitmap gives access to the reachability bitmaps of a pack.
+// It is safe for concurrent use.
+type PackBitmap struct {
+	pk      *PackReader
+	objects []packEntry // objects in pack order.
+	packPos []uint32    // pack position of objects in index order.
+	types   [4]Bitmap   // commits, trees, blobs, tags.
+	commits map[Hash]Bitmap
+}
+
+// packOrder returns the objects of a pack sorted by offset, and the
+// position in that list of each object of the index.
+func (pk *PackReader) packOrder() (objects []packEntry, packPos []uint32, err error) {
+	rev, err := pk.revIndex()
+	if err != nil {
+		return nil, nil, err
+	}
+	entries, err := pk.indexEntries()
+	if err != nil {
+		return nil, nil, err
+	}
+	objects = make([]packEntry, len(rev))
+	packPos = make([]uint32, len(rev))
+	for k, i := range rev {
+		objects[k] = entries[i]
+		packPos[i] = uint32(k)
+	}
+	return objects, packPos, nil
+}
+
+// packChecksum returns the checksum at the end of the pack.
+func (pk *PackReader) packChecksum() (Hash, error) {
+	var sum Hash
+	b, err := readAt(pk.pack, pk.packData, sum[:], pk.pack.Size()-20)
+	if err != nil {
+		return sum, err
+	}
+	copy(sum[:], b)
+	return sum, nil
+}
+
+// OpenPackBitmap reads the bitmap file of a pack opened from
+// base+".pack", that is base+".bitmap".
+func OpenPackBitmap(base string, pk *PackReader) (*PackBitmap, error) {
+	f, err := os.Open(base + ".bitmap")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadPackBitmap(f, pk)
+}
+
+// ReadPackBitmap reads the bitmap file of pk from r.
+func ReadPackBitmap(r io.Reader, pk *PackReader) (*PackBitmap, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 32+20 {
+		return nil, errCorruptedBitmap
+	}
+	if NewHash(data[:len(data)-20]) != hashOf(data[len(data)-20:]) {
+		return nil, errCorruptedBitmap
+	}
+	if string(data[:4]) != "BITM" {
+		return nil, errBadBitmapMagic
+	}
+	version := binary.BigEndian.Uint16(data[4:6])
+	flags := binary.BigEndian.Uint16(data[6:8])
+	if version != 1 || flags&bitmapOptFullDAG == 0 {
+		return nil, errUnsupportedBitmapVersion
+	}
+	count := binary.BigEndian.Uint32(data[8:12])
+	packsum, err := pk.packChecksum()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(data[12:32], packsum[:]) {
+		return nil, errBitmapPackMismatch
+	}
+
+	b := &PackBitmap{pk: pk, commits: make(map[Hash]Bitmap)}
+	b.objects, b.packPos, err = pk.packOrder()
+	if err != nil {
+		return nil, err
+	}
+	data = data[32 : len(data)-20]
+	for i := range b.types {
+		bm, n, err := readEWAH(data)
+		if err != nil {
+			return nil, err
+		}
+		b.types[i], data = bm, data[n:]
+	}
+	entries := make([]Bitmap, 0, count)
+	for i := 0; i < int(count); i++ {
+		if len(data) < 6 {
+			return nil, errCorruptedBitmap
+		}
+		pos := binary.BigEndian.Uint32(data[:4])
+		xor := int(data[4])
+		bm, n, err := readEWAH(data[6:])
+		if err != nil {
+			return nil, err
+		}
+		data = data[6+n:]
+		if xor > i || xor > bitmapMaxXorOffset || pos >= uint32(len(b.packPos)) {
+			return nil, errCorruptedBitmap
+		}
+		if xor > 0 {
+			bm = bm.Xor(entries[i-xor])
+		}
+		entries = append(entries, bm)
+		b.commits[b.objects[b.packPos[pos]].Hash] = bm
+	}
+	return b, nil
+}
+
+// hashOf converts a 20-byte slice to a Hash.
+func hashOf(b []byte) (h Hash) {
+	copy(h[:], b)
+	return h
+}
+
+// Commits returns the sorted list of commits having a bitmap.
+func (b *PackBitmap) Commits() []Hash {
+	hashes := make([]Hash, 0, len(b.commits))
+	for h := range b.commits {
+		hashes = append(hashes, h)
+	}
+	sort.Sort(hashList(hashes))
+	return hashes
+}
+
+type hashList []Hash
+
+func (s hashList) Len() int           { return len(s) }
+func (s hashList) Less(i, j int) bool { return bytes.Compare(s[i][:], s[j][:]) < 0 }
+func (s hashList) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// position returns the pack position of an object.
+func (b *PackBitmap) position(h Hash) (int, error) {
+	i, err := b.pk.findIndex(h)
+	if err == errNotFoundInPack {
+		err = errBitmapIncomplete
+	}
+	if err != nil {
+		return 0, err
+	}
+	return int(b.packPos[i]), nil
+}
+
+// Reachable returns the set of objects reachable from the given
+// objects, usually commits. Stored bitmaps are used where available,
+// and objects are walked otherwise. All reachable objects must be in
+// the pack.
+func (b *PackBitmap) Reachable(from ...Hash) (Bitmap, error) {
+	result := make(Bitmap, (len(b.objects)+63)/64)
+	queue := append([]Hash(nil), from...)
+	for len(queue) > 0 {
+		h := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		pos, err := b.position(h)
+		if err != nil {
+			return nil, err
+		}
+		if result.Has(pos) {
+			continue
+		}
+		if bm, ok := b.commits[h]; ok {
+			result.Or(bm)
+			continue
+		}
+		result.Set(pos)
+		if b.types[2].Has(pos) {
+			// Blobs have no children.
+			continue
+		}
+		o, err := b.pk.extractObjectAt(b.objects[pos].Offset)
+		if err != nil {
+			return nil, err
+		}
+		switch o := o.(type) {
+		case Commit:
+			queue = append(queue, o.Tree)
+			queue = append(queue, o.Parents...)
+		case Tree:
+			for _, e := range o.Entries {
+				if !isGitlink(e.Mode) {
+					queue = append(queue, e.Hash)
+				}
+			}
+		case Tag:
+			queue = append(queue, o.Object)
+		}
+	}
+	return result, nil
+}
+
+// isGitlink reports whether a tree entry mode is a submodule commit,
+// which is not part of the repository objects.
+func isGitlink(mode os.FileMode) bool {
+	return mode&os.ModeDir != 0 && mode&os.ModeSymlink != 0
+}
+
+// Objects returns the hashes of the objects of a bitmap, in pack
+// order.
+func (b *PackBitmap) Objects(bm Bitmap) []Hash {
+	hashes := make([]Hash, 0, bm.Count())
+	for i, e := range b.objects {
+		if bm.Has(i) {
+			hashes = append(hashes, e.Hash)
+		}
+	}
+	return hashes
+}
+
+// Count returns the number of objects of type t in a bitmap.
+func (b *PackBitmap) Count(bm Bitmap, t ObjType) int {
+	i := packType(t) - pkCommit
+	if i < 0 || i >= len(b.types) {
+		return 0
+	}
+	return bm.And(b.types[i]).Count()
+}
+
+// WritePackBitmap computes the reachability bitmaps of the given
+// commits of pk, and writes them to w as a .bitmap file. All objects
+// reachable from commits must be in the pack. Commits are processed
+// in the given order, and bitmaps of earlier commits are reused for
+// later ones: listing ancestors first is more efficient.
+func WritePackBitmap(w io.Writer, pk *PackReader, commits []Hash) error {
+	b := &PackBitmap{pk: pk, commits: make(map[Hash]Bitmap)}
+	var err error
+	b.objects, b.packPos, err = pk.packOrder()
+	if err != nil {
+		return err
+	}
+	nbits := len(b.objects)
+	for pos, e := range b.objects {
+		t, _, err := pk.infoAt(e.Offset)
+		if err != nil {
+			return err
+		}
+		i := packType(t) - pkCommit
+		if i < 0 || i >= len(b.types) {
+			return errInvalidPackEntryType
+		}
+		b.types[i].Set(pos)
+	}
+	packsum, err := pk.packChecksum()
+	if err != nil {
+		return err
+	}
+
+	buf := []byte("BITM")
+	buf = append(buf, 0, 1, 0, bitmapOptFullDAG, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(buf[8:], uint32(len(commits)))
+	buf = append(buf, packsum[:]...)
+	for _, t := range b.types {
+		buf = appendEWAH(buf, t, nbits)
+	}
+
+	var entries []Bitmap
+	for i, h := range commits {
+		idx, err := pk.findIndex(h)
+		if err == errNotFoundInPack {
+			err = errBitmapIncomplete
+		}
+		if err != nil {
+			return err
+		}
+		if !b.types[0].Has(int(b.packPos[idx])) {
+			return errBitmapNotCommit
+		}
+		bm, err := b.Reachable(h)
+		if err != nil {
+			return err
+		}
+		b.commits[h] = bm
+		entries = append(entries, bm)
+
+		// Select the XOR base giving the smallest encoding.
+		enc, xor := appendEWAH(nil, bm, nbits), 0
+		for k := 1; k <= bitmapXorSearch && k <= i; k++ {
+			e := appendEWAH(nil, bm.Xor(entries[i-k]), nbits)
+			if len(e) < len(enc) {
+				enc, xor = e, k
+			}
+		}
+		var hdr [6]byte
+		binary.BigEndian.PutUint32(hdr[:4], uint32(idx))
+		hdr[4] = byte(xor)
+		buf = append(buf, hdr[:]...)
+		buf = append(buf, enc...)
+	}
+	sum := NewHash(buf)
+	buf = append(buf, sum[:]...)
+	_, err = w.Write(buf)
+	return err
+}
@@ -0,0 +1,163 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package objects
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEWAH(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, nbits := range []int{0, 1, 63, 64, 65, 1000, 20000} {
+		for iter := 0; iter < 20; iter++ {
+			var b Bitmap
+			for i := 0; i < nbits; {
+				// Alternate runs of zeros, ones and random bits.
+				n := rnd.Intn(300) + 1
+				mode := rnd.Intn(3)
+				for ; n > 0 && i < nbits; n-- {
+					if mode == 1 || mode == 2 && rnd.Intn(2) == 0 {
+						b.Set(i)
+					}
+					i++
+				}
+			}
+			enc := appendEWAH(nil, b, nbits)
+			dec, n, err := readEWAH(append(enc, "trailing"...))
+			if err != nil || n != len(enc) {
+				t.Fatalf("%d bits: decoding failed: %d bytes read, err=%v", nbits, n, err)
+			}
+			if dec.Xor(b).Count() != 0 || dec.Count() != b.Count() {
+				t.Errorf("%d bits: decoded bitmap differs", nbits)
+			}
+		}
+	}
+	if _, _, err := readEWAH([]byte{0, 0, 0, 64, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 4}); err != errCorruptedBitmap {
+		t.Errorf("got error %v for truncated bitmap, expected %v", err, errCorruptedBitmap)
+	}
+}
+
+// openBitmapPack opens the pack and bitmap of testdata/bitmap,
+// written by git repack -adb.
+func openBitmapPack(t *testing.T) (*PackReader, *PackBitmap) {
+	packs, err := filepath.Glob("testdata/bitmap/pack-*.pack")
+	if err != nil || len(packs) != 1 {
+		t.Fatalf("found %d packs in testdata/bitmap (err=%v)", len(packs), err)
+	}
+	base := strings.TrimSuffix(packs[0], ".pack")
+	pk, err := OpenPack(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := OpenPackBitmap(base, pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pk, b
+}
+
+// walkOnly returns a copy of b without commit bitmaps, so that
+// Reachable walks objects.
+func walkOnly(b *PackBitmap) *PackBitmap {
+	w := *b
+	w.commits = nil
+	return &w
+}
+
+func TestReadPackBitmap(t *testing.T) {
+	pk, b := openBitmapPack(t)
+	defer pk.Close()
+	commits := b.Commits()
+	if len(commits) != 9 {
+		t.Errorf("found %d bitmaps, expected 9", len(commits))
+	}
+	walk := walkOnly(b)
+	for _, h := range commits {
+		bm, err := walk.Reachable(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bm.Xor(b.commits[h]).Count() != 0 {
+			t.Errorf("%s: stored bitmap differs from reachable objects", h)
+		}
+	}
+
+	var master, tag Hash
+	hex.Decode(master[:], []byte("00c8118426f09cd6230625eb434df1d95c388723"))
+	hex.Decode(tag[:], []byte("1e2a96ccc423a13bb6671d7ffeb3f26795c41b62"))
+	bm, err := b.Reachable(master, tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bm.Count() != 37 || b.Count(bm, TAG) != 1 || b.Count(bm, COMMIT) != 9 {
+		t.Errorf("got %d objects (%d tags, %d commits), expected 37 (1, 9)",
+			bm.Count(), b.Count(bm, TAG), b.Count(bm, COMMIT))
+	}
+	total := 0
+	for _, typ := range []ObjType{COMMIT, TREE, BLOB, TAG} {
+		total += b.Count(bm, typ)
+	}
+	if total != bm.Count() || len(b.Objects(bm)) != bm.Count() {
+		t.Errorf("inconsistent counts: %d by type, %d objects, %d bits",
+			total, len(b.Objects(bm)), bm.Count())
+	}
+}
+
+func TestWritePackBitmap(t *testing.T) {
+	objs := testObjects()
+	pack, idx := writeTestPack(t, objs, OfsDelta)
+	pk := openTestPack(t, pack, idx)
+	var commits []Hash
+	for _, o := range objs {
+		if o.Type() == COMMIT {
+			commits = append(commits, o.ID())
+		}
+	}
+	buf := new(bytes.Buffer)
+	if err := WritePackBitmap(buf, pk, commits); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ReadPackBitmap(buf, pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, h := range commits {
+		// Each commit adds a blob, a tree and itself.
+		bm := b.commits[h]
+		if bm.Count() != 3*(i+1) || b.Count(bm, BLOB) != i+1 {
+			t.Errorf("commit %d: %d reachable objects, expected %d", i, bm.Count(), 3*(i+1))
+		}
+	}
+
+	// Bitmaps of the git pack.
+	pk, ref := openBitmapPack(t)
+	defer pk.Close()
+	buf.Reset()
+	if err := WritePackBitmap(buf, pk, ref.Commits()); err != nil {
+		t.Fatal(err)
+	}
+	b, err = ReadPackBitmap(buf, pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range ref.Commits() {
+		if b.commits[h].Xor(ref.commits[h]).Count() != 0 {
+			t.Errorf("%s: bitmap differs from git", h)
+		}
+	}
+	for i := range b.types {
+		if b.types[i].Xor(ref.types[i]).Count() != 0 {
+			t.Errorf("type bitmap %d differs from git", i)
+		}
+	}
+	if err := WritePackBitmap(buf, pk, []Hash{{}}); err != errBitmapIncomplete {
+		t.Errorf("got error %v for missing commit, expected %v", err, errBitmapIncomplete)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package objects
+
+import (
+	"container/list"
+	"sync"
+)
+
+// This file implements a cache of delta bases, similar to the
+// delta base cache of Git (core.deltaBaseCacheLimit).
+//
+// Without it, extracting each object of a delta chain requires
+// reconstructing the whole chain again, which makes walking
+// through history quadratic in the length of chains.
+
+// DefaultDeltaCacheSize is the size of the delta base cache of
+// new PackReaders, as in Git.
+const DefaultDeltaCacheSize = 96 << 20
+
+// A DeltaCache is a least-recently-used cache of reconstructed delta
+// bases of a pack, keyed by their offset in the pack. Its size is
+// bounded by the total length of cached objects. It is safe for
+// concurrent use.
+//
+// A nil *DeltaCache caches nothing.
+type DeltaCache struct {
+	mu      sync.Mutex
+	limit   int64
+	size    int64
+	lru     list.List // of *cacheEntry, most recently used first.
+	entries map[int64]*list.Element
+	stats   CacheStats
+}
+
+type cacheEntry struct {
+	off  int64
+	typ  int
+	data []byte
+}
+
+// CacheStats reports the usage of a DeltaCache.
+type CacheStats struct {
+	Hits, Misses uint64 // Number of lookups of delta bases.
+	Evictions    uint64 // Number of objects evicted to make room.
+	Objects      int    // Number of cached objects.
+	Size         int64  // Total length of cached objects.
+}
+
+// NewDeltaCache returns a cache holding at most limit bytes of
+// objects.
+func NewDeltaCache(limit int64) *DeltaCache {
+	return &DeltaCache{limit: limit, entries: make(map[int64]*list.Element)}
+}
+
+// get returns the cached object at offset off.
+func (c *DeltaCache) get(off int64) (typ int, data []byte, ok bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[off]
+	if !ok {
+		c.stats.Misses++
+		return
+	}
+	c.stats.Hits++
+	c.lru.MoveToFront(elem)
+	e := elem.Value.(*cacheEntry)
+	return e.typ, e.data, true
+}
+
+// add caches the object at offset off. The data must not be
+// modified afterwards.
+func (c *DeltaCache) add(off int64, typ int, data []byte) {
+	if c == nil || int64(len(data)) > c.limit {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[off]; ok {
+		// Added concurrently by another reader.
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[off] = c.lru.PushFront(&cacheEntry{off: off, typ: typ, data: data})
+	c.size += int64(len(data))
+	c.shrink()
+}
+
+// shrink evicts least recently used objects until the cache
+// size is within its limit.
+func (c *DeltaCache) shrink() {
+	for c.size > c.limit {
+		elem := c.lru.Back()
+		e := elem.Value.(*cacheEntry)
+		c.lru.Remove(elem)
+		delete(c.entries, e.off)
+		c.size -= int64(len(e.data))
+		c.stats.Evictions++
+	}
+}
+
+// SetLimit changes the maximal size of the cache, evicting objects
+// if needed.
+func (c *DeltaCache) SetLimit(limit int64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.limit = limit
+	c.shrink()
+}
+
+// Stats returns usage statistics of the cache.
+func (c *DeltaCache) Stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats
+	s.Objects = c.lru.Len()
+	s.Size = c.size
+	return s
+}
@@ -0,0 +1,115 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package objects
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestDeltaCacheEviction(t *testing.T) {
+	c := NewDeltaCache(10)
+	c.add(1, pkBlob, []byte("aaaa"))
+	c.add(2, pkBlob, []byte("bbbb"))
+	if _, _, ok := c.get(1); !ok {
+		t.Fatalf("object 1 missing from cache")
+	}
+	// Object 2 is now the least recently used.
+	c.add(3, pkBlob, []byte("cccc"))
+	if _, _, ok := c.get(2); ok {
+		t.Errorf("object 2 was not evicted")
+	}
+	for _, off := range []int64{1, 3} {
+		if _, data, ok := c.get(off); !ok || len(data) != 4 {
+			t.Errorf("object %d missing from cache", off)
+		}
+	}
+	// Objects larger than the cache are not stored.
+	c.add(4, pkBlob, make([]byte, 11))
+	if _, _, ok := c.get(4); ok {
+		t.Errorf("object larger than cache was stored")
+	}
+
+	s := c.Stats()
+	exp := CacheStats{Hits: 3, Misses: 2, Evictions: 1, Objects: 2, Size: 8}
+	if s != exp {
+		t.Errorf("got stats %+v, expected %+v", s, exp)
+	}
+	c.SetLimit(5)
+	if s := c.Stats(); s.Objects != 1 || s.Size != 4 {
+		t.Errorf("got %d objects of size %d after SetLimit, expected 1 of size 4",
+			s.Objects, s.Size)
+	}
+
+	var nilCache *DeltaCache
+	nilCache.add(1, pkBlob, []byte("a"))
+	if _, _, ok := nilCache.get(1); ok {
+		t.Errorf("nil cache returned an object")
+	}
+	nilCache.SetLimit(1 << 20)
+	if s := nilCache.Stats(); s != (CacheStats{}) {
+		t.Errorf("nil cache has statistics %+v", s)
+	}
+}
+
+func TestPackDeltaCache(t *testing.T) {
+	objs := testObjects()
+	pack, idx := writeTestPack(t, objs, OfsDelta)
+	for _, cache := range []*DeltaCache{NewDeltaCache(DefaultDeltaCacheSize), nil} {
+		pk := openTestPack(t, pack, idx)
+		pk.Cache = cache
+		for i := 0; i < 2; i++ {
+			for _, o := range objs {
+				o2, err := pk.Extract(o.ID())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if o2.ID() != o.ID() {
+					t.Errorf("got %s, expected %s", o2.ID(), o.ID())
+				}
+			}
+		}
+		if cache != nil && cache.Stats().Hits == 0 {
+			t.Errorf("delta cache was never hit: %+v", cache.Stats())
+		}
+	}
+}
+
+func TestPackDeltaCacheConcurrent(t *testing.T) {
+	objs := testObjects()
+	pack, idx := writeTestPack(t, objs, OfsDelta)
+	pk := openTestPack(t, pack, idx)
+	pk.Cache = NewDeltaCache(512)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := range objs {
+				o := objs[(i+g*7)%len(objs)]
+				o2, err := pk.Extract(o.ID())
+				if err != nil {
+					errs <- err
+					return
+				}
+				if o2.ID() != o.ID() {
+					errs <- fmt.Errorf("got %s, expected %s", o2.ID(), o.ID())
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if s := pk.Cache.Stats(); s.Size > 512 {
+		t.Errorf("cache holds %d bytes, above its limit", s.Size)
+	}
+}
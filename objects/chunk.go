@@ -0,0 +1,87 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package objects
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// This file implements the chunk-based file format shared by the
+// multi-pack-index and the commit-graph.
+//
+// After a format-specific header, a table of contents lists chunks
+// as a 4-byte identifier and an 8-byte offset. It is terminated by
+// a zero identifier, whose offset is the end of the last chunk.
+// The file ends with the SHA-1 checksum of its contents.
+//
+// Cf. Documentation/technical/chunk-format.txt in Git sources.
+
+var (
+	errCorruptedChunks = errors.New("gigot: corrupted chunk table")
+	errMissingChunk    = errors.New("gigot: missing required chunk")
+)
+
+// A chunk locates a chunk in a file.
+type chunk struct {
+	off, size int64
+}
+
+// readChunkTable reads the table of contents of n chunks at offset
+// off of r, whose contents are data if not nil.
+func readChunkTable(r *io.SectionReader, data []byte, off int64, n int) (map[string]chunk, error) {
+	buf, err := readAt(r, data, make([]byte, 12*(n+1)), off)
+	if err != nil {
+		if err == io.EOF {
+			err = errCorruptedChunks
+		}
+		return nil, err
+	}
+	chunks := make(map[string]chunk, n)
+	end := r.Size() - 20
+	for i := 0; i < n; i++ {
+		id := string(buf[12*i : 12*i+4])
+		start := int64(binary.BigEndian.Uint64(buf[12*i+4:]))
+		next := int64(binary.BigEndian.Uint64(buf[12*i+16:]))
+		if start < off+int64(len(buf)) || next < start || next > end {
+			return nil, errCorruptedChunks
+		}
+		chunks[id] = chunk{off: start, size: next - start}
+	}
+	if !bytes.Equal(buf[12*n:12*n+4], []byte{0, 0, 0, 0}) {
+		return nil, errCorruptedChunks
+	}
+	return chunks, nil
+}
+
+// A chunkData is the contents of a chunk to be written.
+type chunkData struct {
+	id   string
+	data []byte
+}
+
+// writeChunkFile writes a file made of header, the table of contents
+// of chunks, their contents and a checksum.
+func writeChunkFile(w io.Writer, header []byte, chunks []chunkData) error {
+	buf := new(bytes.Buffer)
+	buf.Write(header)
+	off := uint64(len(header) + 12*(len(chunks)+1))
+	for _, c := range chunks {
+		buf.WriteString(c.id)
+		binary.Write(buf, binary.BigEndian, off)
+		off += uint64(len(c.data))
+	}
+	buf.Write([]byte{0, 0, 0, 0})
+	binary.Write(buf, binary.BigEndian, off)
+	for _, c := range chunks {
+		buf.Write(c.data)
+	}
+	sum := NewHash(buf.Bytes())
+	buf.Write(sum[:])
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,513 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package objects
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// This file implements commit-graph files, which store the parents,
+// root tree, commit time and generation number of commits, so that
+// history can be walked without decoding commit objects.
+//
+// The file has an 8-byte header ("CGPH", version, hash version,
+// number of chunks, number of base graphs) and the following chunks:
+//   OIDF: fanout table of commit hashes.
+//   OIDL: sorted commit hashes.
+//   CDAT: for each commit, the root tree hash, the positions of
+//         the first two parents, and a 64-bit word holding the
+//         generation number (30 bits) and the commit time (34 bits).
+//   EDGE: positions of the extra parents of octopus merges.
+//   BASE: hashes of base graphs, for split commit-graphs.
+// Other chunks (corrected dates, Bloom filters) are ignored.
+//
+// Commits are identified by their position in the graph. A split
+// commit-graph is a chain of files listed in
+// info/commit-graphs/commit-graph-chain, each adding commits on top
+// of the previous ones: positions in a file follow the positions of
+// commits in its base graphs.
+//
+// Cf. Documentation/technical/commit-graph-format.txt in Git sources.
+
+const (
+	graphHeaderSize = 8
+	graphDataSize   = 36 // size of CDAT entries.
+
+	graphParentNone = 0x70000000
+	graphExtraEdges = 0x80000000 // the second parent is an index in EDGE.
+	graphLastEdge   = 0x80000000 // marks the last parent in EDGE.
+
+	maxGeneration = 1<<30 - 1
+)
+
+var (
+	errBadGraphMagic           = errors.New("gigot: bad magic number in commit-graph")
+	errUnsupportedGraphVersion = errors.New("gigot: commit-graph has unsupported format version")
+	errCorruptedGraph          = errors.New("gigot: corrupted commit-graph")
+	errGraphChainMismatch      = errors.New("gigot: commit-graph chain does not match its files")
+	errGraphPosition           = errors.New("gigot: commit-graph position out of range")
+	errGraphNotCommit          = errors.New("gigot: commit-graph tip is not a commit")
+)
+
+// A CommitGraph reads a commit-graph file or a chain of split
+// commit-graph files. It is safe for concurrent use.
+type CommitGraph struct {
+	layers []*graphLayer // base graphs first.
+}
+
+// A graphLayer is a single commit-graph file.
+type graphLayer struct {
+	data    []byte
+	release func() error
+
+	fanout [256]uint32
+	oidl   []byte
+	cdat   []byte
+	edge   []byte
+	bases  []byte // hashes of base graphs.
+	first  int    // position of the first commit of the file.
+}
+
+// A GraphCommit holds the data of a commit stored in a commit-graph.
+type GraphCommit struct {
+	Hash    Hash
+	Tree    Hash
+	Parents []int // positions of parents in the commit-graph.
+	Time    int64 // commit time, in seconds since the Unix epoch.
+
+	// Generation is the topological level of the commit: 1 for
+	// root commits, and one more than the maximum generation of
+	// its parents otherwise, capped at 2^30-1. It is zero in
+	// graphs written by old versions of Git.
+	Generation uint32
+}
+
+// ReadCommitGraph reads a commit-graph file from r.
+func ReadCommitGraph(r io.Reader) (*CommitGraph, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	l, err := parseGraphLayer(data, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &CommitGraph{layers: []*graphLayer{l}}, nil
+}
+
+// OpenCommitGraph opens the commit-graph of the object database
+// stored in dir: the file info/commit-graph if it exists, and the
+// chain listed in info/commit-graphs/commit-graph-chain otherwise.
+// Files are memory-mapped where the platform supports it. The
+// CommitGraph must be closed after use.
+func OpenCommitGraph(dir string) (*CommitGraph, error) {
+	g, err := openGraphFiles([]string{filepath.Join(dir, "info", "commit-graph")}, nil)
+	if !os.IsNotExist(err) {
+		return g, err
+	}
+	return openGraphChain(filepath.Join(dir, "info", "commit-graphs"))
+}
+
+// openGraphChain opens the split commit-graph in dir, listed in
+// dir/commit-graph-chain.
+func openGraphChain(dir string) (*CommitGraph, error) {
+	chain, err := ioutil.ReadFile(filepath.Join(dir, "commit-graph-chain"))
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	var sums []Hash
+	for _, name := range strings.Fields(string(chain)) {
+		var h Hash
+		n, err := hex.Decode(h[:], []byte(name))
+		if err != nil || n != len(h) || len(name) != 2*len(h) {
+			return nil, errGraphChainMismatch
+		}
+		paths = append(paths, filepath.Join(dir, "graph-"+name+".graph"))
+		sums = append(sums, h)
+	}
+	if len(paths) == 0 {
+		return nil, errGraphChainMismatch
+	}
+	return openGraphFiles(paths, sums)
+}
+
+// openGraphFiles opens a chain of commit-graph files, whose
+// checksums are given by sums, if not nil.
+func openGraphFiles(paths []string, sums []Hash) (*CommitGraph, error) {
+	g := new(CommitGraph)
+	for i, path := range paths {
+		data, release, err := mapFile(path)
+		if err != nil {
+			g.Close()
+			return nil, err
+		}
+		l, err := parseGraphLayer(data, i)
+		if err == nil && sums != nil {
+			err = checkGraphChain(l, sums[:i+1])
+		}
+		if err != nil {
+			release()
+			g.Close()
+			return nil, err
+		}
+		l.release = release
+		if i > 0 {
+			prev := g.layers[i-1]
+			l.first = prev.first + prev.count()
+		}
+		g.layers = append(g.layers, l)
+	}
+	return g, nil
+}
+
+// checkGraphChain checks that a file of a chain has the expected
+// checksum sums[len(sums)-1] and lists the previous ones as bases.
+func checkGraphChain(l *graphLayer, sums []Hash) error {
+	n := len(sums) - 1
+	if hashOf(l.data[len(l.data)-20:]) != sums[n] {
+		return errGraphChainMismatch
+	}
+	for i, h := range sums[:n] {
+		if !bytes.Equal(l.bases[20*i:20*i+20], h[:]) {
+			return errGraphChainMismatch
+		}
+	}
+	return nil
+}
+
+// mapFile returns the contents of a file, memory-mapped where the
+// platform supports it, and a function releasing them.
+func mapFile(path string) (data []byte, release func() error, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	// Files that cannot be mapped are read into memory.
+	if data, _ = mmapFile(f, st.Size()); data != nil {
+		return data, func() error { return munmap(data) }, nil
+	}
+	data, err = ioutil.ReadAll(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() error { return nil }, nil
+}
+
+// Close releases the memory mappings held by a CommitGraph returned
+// by OpenCommitGraph. It must not be used afterwards.
+func (g *CommitGraph) Close() error {
+	var err error
+	for _, l := range g.layers {
+		if l.release != nil {
+			if errc := l.release(); err == nil {
+				err = errc
+			}
+		}
+	}
+	g.layers = nil
+	return err
+}
+
+// parseGraphLayer parses a commit-graph file, expected to have
+// nbase base graphs.
+func parseGraphLayer(data []byte, nbase int) (*graphLayer, error) {
+	if len(data) < graphHeaderSize+20 {
+		return nil, errCorruptedGraph
+	}
+	if string(data[:4]) != "CGPH" {
+		return nil, errBadGraphMagic
+	}
+	// Version 1, SHA-1 hashes.
+	if data[4] != 1 || data[5] != 1 {
+		return nil, errUnsupportedGraphVersion
+	}
+	if int(data[7]) != nbase {
+		return nil, errGraphChainMismatch
+	}
+	r := io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data)))
+	chunks, err := readChunkTable(r, data, graphHeaderSize, int(data[6]))
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range []string{"OIDF", "OIDL", "CDAT"} {
+		if _, ok := chunks[id]; !ok {
+			return nil, errMissingChunk
+		}
+	}
+	contents := func(id string) []byte {
+		c := chunks[id]
+		return data[c.off : c.off+c.size]
+	}
+
+	l := &graphLayer{data: data}
+	oidf := contents("OIDF")
+	if len(oidf) != 256*4 {
+		return nil, errCorruptedGraph
+	}
+	for i := range l.fanout {
+		l.fanout[i] = binary.BigEndian.Uint32(oidf[4*i:])
+		if i > 0 && l.fanout[i] < l.fanout[i-1] {
+			return nil, errCorruptedGraph
+		}
+	}
+	count := l.count()
+	l.oidl, l.cdat = contents("OIDL"), contents("CDAT")
+	l.edge, l.bases = contents("EDGE"), contents("BASE")
+	if len(l.oidl) != 20*count || len(l.cdat) != graphDataSize*count {
+		return nil, errCorruptedGraph
+	}
+	if len(l.edge)%4 != 0 || len(l.bases) != 20*nbase {
+		return nil, errCorruptedGraph
+	}
+	return l, nil
+}
+
+// count returns the number of commits in a file.
+func (l *graphLayer) count() int {
+	return int(l.fanout[0xff])
+}
+
+// find returns the index of a commit in the file.
+func (l *graphLayer) find(h Hash) (int, bool) {
+	min, max := 0, int(l.fanout[h[0]])
+	if h[0] > 0 {
+		min = int(l.fanout[h[0]-1])
+	}
+	for min < max {
+		med := (min + max) / 2
+		switch cmp := bytes.Compare(l.oidl[20*med:20*med+20], h[:]); true {
+		case cmp < 0:
+			min = med + 1
+		case cmp > 0:
+			max = med
+		case cmp == 0:
+			return med, true
+		}
+	}
+	return 0, false
+}
+
+// Len returns the number of commits in the commit-graph.
+func (g *CommitGraph) Len() int {
+	if len(g.layers) == 0 {
+		return 0
+	}
+	l := g.layers[len(g.layers)-1]
+	return l.first + l.count()
+}
+
+// Find returns the position of a commit in the commit-graph.
+// It returns ErrNotFound if the commit is not in the graph.
+func (g *CommitGraph) Find(h Hash) (int, error) {
+	for _, l := range g.layers {
+		if i, ok := l.find(h); ok {
+			return l.first + i, nil
+		}
+	}
+	return 0, ErrNotFound
+}
+
+// layerOf returns the file holding the commit at position pos, and
+// its index in that file.
+func (g *CommitGraph) layerOf(pos int) (*graphLayer, int, error) {
+	for _, l := range g.layers {
+		if pos >= l.first && pos < l.first+l.count() {
+			return l, pos - l.first, nil
+		}
+	}
+	return nil, 0, errGraphPosition
+}
+
+// HashAt returns the hash of the commit at position pos.
+func (g *CommitGraph) HashAt(pos int) (Hash, error) {
+	l, i, err := g.layerOf(pos)
+	if err != nil {
+		return Hash{}, err
+	}
+	return hashOf(l.oidl[20*i:]), nil
+}
+
+// Commit returns the data of the commit at position pos.
+func (g *CommitGraph) Commit(pos int) (GraphCommit, error) {
+	l, i, err := g.layerOf(pos)
+	if err != nil {
+		return GraphCommit{}, err
+	}
+	e := l.cdat[graphDataSize*i : graphDataSize*(i+1)]
+	c := GraphCommit{Hash: hashOf(l.oidl[20*i:]), Tree: hashOf(e[:20])}
+	p1 := binary.BigEndian.Uint32(e[20:24])
+	p2 := binary.BigEndian.Uint32(e[24:28])
+	if p1 != graphParentNone {
+		c.Parents = append(c.Parents, int(p1))
+	}
+	switch {
+	case p2 == graphParentNone:
+	case p2&graphExtraEdges != 0:
+		for k := int(p2 &^ graphExtraEdges); ; k++ {
+			if 4*k+4 > len(l.edge) {
+				return GraphCommit{}, errCorruptedGraph
+			}
+			p := binary.BigEndian.Uint32(l.edge[4*k:])
+			c.Parents = append(c.Parents, int(p&^graphLastEdge))
+			if p&graphLastEdge != 0 {
+				break
+			}
+		}
+	default:
+		c.Parents = append(c.Parents, int(p2))
+	}
+	// Parents are in the same file or in its bases.
+	for _, p := range c.Parents {
+		if p >= l.first+l.count() {
+			return GraphCommit{}, errCorruptedGraph
+		}
+	}
+	hi := binary.BigEndian.Uint32(e[28:32])
+	c.Generation = hi >> 2
+	c.Time = int64(hi&3)<<32 | int64(binary.BigEndian.Uint32(e[32:36]))
+	return c, nil
+}
+
+// A graphEntry is a commit to be written in a commit-graph.
+type graphEntry struct {
+	hash       Hash
+	tree       Hash
+	parents    []Hash
+	time       int64
+	generation uint32
+}
+
+// WriteCommitGraph writes to w a commit-graph file holding the
+// commits of store reachable from the given commits.
+func WriteCommitGraph(w io.Writer, store ObjectStore, tips []Hash) error {
+	commits := make(map[Hash]*graphEntry)
+	var order []*graphEntry // parents before children.
+	type frame struct {
+		e    *graphEntry
+		next int // index of the next parent to visit.
+	}
+	var stack []frame
+	visit := func(h Hash) error {
+		if _, ok := commits[h]; ok {
+			return nil
+		}
+		o, err := store.Get(h)
+		if err != nil {
+			return err
+		}
+		c, ok := o.(Commit)
+		if !ok {
+			return errGraphNotCommit
+		}
+		e := &graphEntry{hash: h, tree: c.Tree, parents: c.Parents, time: c.CommitterTime.Unix()}
+		commits[h] = e
+		stack = append(stack, frame{e: e})
+		return nil
+	}
+	for _, h := range tips {
+		if err := visit(h); err != nil {
+			return err
+		}
+		for len(stack) > 0 {
+			f := &stack[len(stack)-1]
+			if f.next < len(f.e.parents) {
+				p := f.e.parents[f.next]
+				f.next++
+				if err := visit(p); err != nil {
+					return err
+				}
+				continue
+			}
+			stack = stack[:len(stack)-1]
+			order = append(order, f.e)
+		}
+	}
+	for _, e := range order {
+		e.generation = 1
+		for _, p := range e.parents {
+			if g := commits[p].generation; g >= e.generation {
+				e.generation = g + 1
+			}
+		}
+		if e.generation > maxGeneration {
+			e.generation = maxGeneration
+		}
+	}
+
+	hashes := make([]Hash, 0, len(commits))
+	for h := range commits {
+		hashes = append(hashes, h)
+	}
+	sort.Sort(hashList(hashes))
+	pos := make(map[Hash]uint32, len(hashes))
+	for i, h := range hashes {
+		pos[h] = uint32(i)
+	}
+
+	var fanout [256]uint32
+	for _, h := range hashes {
+		fanout[h[0]]++
+	}
+	for i := 1; i < 256; i++ {
+		fanout[i] += fanout[i-1]
+	}
+	oidf := new(bytes.Buffer)
+	binary.Write(oidf, binary.BigEndian, fanout[:])
+	oidl := new(bytes.Buffer)
+	cdat := new(bytes.Buffer)
+	edge := new(bytes.Buffer)
+	for _, h := range hashes {
+		e := commits[h]
+		oidl.Write(h[:])
+		cdat.Write(e.tree[:])
+		parents := [2]uint32{graphParentNone, graphParentNone}
+		switch len(e.parents) {
+		case 0:
+		case 1:
+			parents[0] = pos[e.parents[0]]
+		case 2:
+			parents[0], parents[1] = pos[e.parents[0]], pos[e.parents[1]]
+		default:
+			parents[0] = pos[e.parents[0]]
+			parents[1] = graphExtraEdges | uint32(edge.Len()/4)
+			for i, p := range e.parents[1:] {
+				v := pos[p]
+				if i == len(e.parents)-2 {
+					v |= graphLastEdge
+				}
+				binary.Write(edge, binary.BigEndian, v)
+			}
+		}
+		t := uint64(e.time) & (1<<34 - 1)
+		binary.Write(cdat, binary.BigEndian, parents)
+		binary.Write(cdat, binary.BigEndian, uint64(e.generation)<<34|t)
+	}
+
+	chunks := []chunkData{
+		{"OIDF", oidf.Bytes()},
+		{"OIDL", oidl.Bytes()},
+		{"CDAT", cdat.Bytes()},
+	}
+	if edge.Len() > 0 {
+		chunks = append(chunks, chunkData{"EDGE", edge.Bytes()})
+	}
+	header := []byte{'C', 'G', 'P', 'H', 1, 1, byte(len(chunks)), 0}
+	return writeChunkFile(w, header, chunks)
+}
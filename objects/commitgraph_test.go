@@ -0,0 +1,235 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package objects
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The history in testdata/graph has 10 commits, with a merge and an
+// octopus merge. Its commit-graph was written by git commit-graph
+// write --reachable, as a single file in info/commit-graph and as a
+// chain of two files in info/commit-graphs.
+var graphTips = []string{
+	"857c2b65b61b4ea760011d6ba95eab59632f255a", // master
+	"c20d1b4b3cd066b1a090ae4a1a083cee110d93aa", // side
+	"5a7d41f1d1b82a4d3f5accbf5a035ba7be9b6684", // x
+	"70f2c0e9eb1b86baa37e250d04d08d622734f3e4", // y
+	"7b3804bd1562953858954ed69eabe597a26437fc", // z
+}
+
+var graphGenerations = map[string]uint32{
+	"71594f3452e82d5d939d1a524411ce39ee3e5eaf": 1, // main 1
+	"0ac313ddcf512d3629701c5c15c48621987c6cab": 2, // main 2
+	"5dadde24b1b9d6cf94e3db59d5cca3b1efac2eb3": 3, // main 3
+	"c20d1b4b3cd066b1a090ae4a1a083cee110d93aa": 3, // side 1
+	"488585cf387fc2e421b802175f845d939235c2e7": 4, // merge side
+	"5a7d41f1d1b82a4d3f5accbf5a035ba7be9b6684": 5, // branch x
+	"70f2c0e9eb1b86baa37e250d04d08d622734f3e4": 5, // branch y
+	"7b3804bd1562953858954ed69eabe597a26437fc": 5, // branch z
+	"36dbc0a9d026d9be2e12b111abdaa71a8bd89f23": 6, // merge x y z
+	"857c2b65b61b4ea760011d6ba95eab59632f255a": 7, // main 4
+}
+
+func parseTestHash(t *testing.T, s string) (h Hash) {
+	if _, err := hex.Decode(h[:], []byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// checkCommitGraph compares the contents of g with the commits of
+// testdata/graph.
+func checkCommitGraph(t *testing.T, g *CommitGraph) {
+	db, err := OpenDatabase("testdata/graph")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if g.Len() != len(graphGenerations) {
+		t.Errorf("got %d commits, expected %d", g.Len(), len(graphGenerations))
+	}
+	for s, gen := range graphGenerations {
+		h := parseTestHash(t, s)
+		pos, err := g.Find(h)
+		if err != nil {
+			t.Errorf("Find(%s): %s", s, err)
+			continue
+		}
+		gc, err := g.Commit(pos)
+		if err != nil {
+			t.Errorf("Commit(%d): %s", pos, err)
+			continue
+		}
+		o, err := db.Get(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := o.(Commit)
+		if gc.Hash != h || gc.Tree != c.Tree || gc.Time != c.CommitterTime.Unix() {
+			t.Errorf("commit %s: got hash %s, tree %s, time %d, expected tree %s, time %d",
+				s, gc.Hash, gc.Tree, gc.Time, c.Tree, c.CommitterTime.Unix())
+		}
+		if gc.Generation != gen {
+			t.Errorf("commit %s: got generation %d, expected %d", s, gc.Generation, gen)
+		}
+		if len(gc.Parents) != len(c.Parents) {
+			t.Errorf("commit %s: got %d parents, expected %d", s, len(gc.Parents), len(c.Parents))
+			continue
+		}
+		for i, p := range gc.Parents {
+			ph, err := g.HashAt(p)
+			if err != nil || ph != c.Parents[i] {
+				t.Errorf("commit %s: parent %d is %s (err=%v), expected %s", s, i, ph, err, c.Parents[i])
+			}
+		}
+	}
+	if _, err := g.Find(Hash{}); err != ErrNotFound {
+		t.Errorf("Find(zero hash): got %v, expected ErrNotFound", err)
+	}
+	if _, err := g.Commit(g.Len()); err != errGraphPosition {
+		t.Errorf("Commit(%d): got %v, expected errGraphPosition", g.Len(), err)
+	}
+}
+
+func TestReadCommitGraph(t *testing.T) {
+	g, err := OpenCommitGraph("testdata/graph")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	if len(g.layers) != 1 {
+		t.Errorf("got %d files, expected 1", len(g.layers))
+	}
+	checkCommitGraph(t, g)
+}
+
+func TestCommitGraphReadAll(t *testing.T) {
+	defer func() { mmapFile = mmap }()
+	mmapFile = func(f *os.File, size int64) ([]byte, error) {
+		return nil, errors.New("cannot map file")
+	}
+	g, err := OpenCommitGraph("testdata/graph")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	checkCommitGraph(t, g)
+}
+
+func TestCommitGraphChain(t *testing.T) {
+	g, err := openGraphChain("testdata/graph/info/commit-graphs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	if len(g.layers) != 2 {
+		t.Errorf("got %d files, expected 2", len(g.layers))
+	}
+	checkCommitGraph(t, g)
+
+	// A chain listing files in the wrong order is rejected.
+	dir, err := ioutil.TempDir("", "gigot-graph")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files, _ := filepath.Glob("testdata/graph/info/commit-graphs/graph-*.graph")
+	var chain []byte
+	for i := len(files) - 1; i >= 0; i-- {
+		data, err := ioutil.ReadFile(files[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := filepath.Base(files[i])
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		chain = append(chain, name[len("graph-"):len(name)-len(".graph")]+"\n"...)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "commit-graph-chain"), chain, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openGraphChain(dir); err != errGraphChainMismatch {
+		t.Errorf("got %v, expected errGraphChainMismatch", err)
+	}
+}
+
+func TestDatabaseCommitGraph(t *testing.T) {
+	db, err := OpenDatabase("testdata/graph")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.CommitGraph == nil || db.CommitGraph.Len() != len(graphGenerations) {
+		t.Fatalf("commit-graph was not opened")
+	}
+}
+
+func TestWriteCommitGraph(t *testing.T) {
+	db, err := OpenDatabase("testdata/graph")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var tips []Hash
+	for _, s := range graphTips {
+		tips = append(tips, parseTestHash(t, s))
+	}
+	buf := new(bytes.Buffer)
+	if err := WriteCommitGraph(buf, db, tips); err != nil {
+		t.Fatal(err)
+	}
+	// Git wrote the file with commitGraph.generationVersion=1,
+	// without corrected commit dates.
+	ref, err := ioutil.ReadFile("testdata/graph/info/commit-graph")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), ref) {
+		t.Errorf("written commit-graph differs from Git's")
+	}
+	g, err := ReadCommitGraph(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCommitGraph(t, g)
+
+	// Trees are not commits.
+	o, _ := db.Get(tips[0])
+	err = WriteCommitGraph(new(bytes.Buffer), db, []Hash{o.(Commit).Tree})
+	if err != errGraphNotCommit {
+		t.Errorf("got %v, expected errGraphNotCommit", err)
+	}
+}
+
+func TestCommitGraphErrors(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/graph/info/commit-graph")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		off  int
+		b    byte
+		want error
+	}{
+		{0, 'X', errBadGraphMagic},
+		{4, 2, errUnsupportedGraphVersion},
+		{7, 1, errGraphChainMismatch},
+		{6, 9, errCorruptedChunks},
+	} {
+		bad := append([]byte(nil), data...)
+		bad[test.off] = test.b
+		if _, err := ReadCommitGraph(bytes.NewReader(bad)); err != test.want {
+			t.Errorf("byte %d set to %d: got %v, expected %v", test.off, test.b, err, test.want)
+		}
+	}
+}
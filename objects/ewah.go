@@ -0,0 +1,174 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package objects
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+// This file implements bitmaps of pack objects and their EWAH
+// compressed form, as used by Git reachability bitmaps.
+//
+// An EWAH bitmap is serialized as its number of bits (32 bits),
+// a number of 64-bit words, the words, and the position of the last
+// marker word (32 bits). Words are groups of a marker word followed
+// by literal words. A marker word has the following bits:
+//   bit 0: the value of bits in the run of clean words.
+//   bits 1-32: the number of clean words.
+//   bits 33-63: the number of literal words following the marker.
+
+var errCorruptedBitmap = errors.New("gigot: corrupted bitmap")
+
+// A Bitmap is a set of objects of a pack, identified by their
+// position in the pack (the rank of their offset). Words are
+// little-endian: object i is the bit i%64 of word i/64.
+type Bitmap []uint64
+
+// Has reports whether the bitmap contains the i-th object.
+func (b Bitmap) Has(i int) bool {
+	return i/64 < len(b) && b[i/64]&(1<<uint(i%64)) != 0
+}
+
+// Set adds the i-th object to the bitmap.
+func (b *Bitmap) Set(i int) {
+	for i/64 >= len(*b) {
+		*b = append(*b, 0)
+	}
+	(*b)[i/64] |= 1 << uint(i%64)
+}
+
+// Or adds the objects of c to b.
+func (b *Bitmap) Or(c Bitmap) {
+	for len(*b) < len(c) {
+		*b = append(*b, 0)
+	}
+	for i, w := range c {
+		(*b)[i] |= w
+	}
+}
+
+// And returns the intersection of b and c.
+func (b Bitmap) And(c Bitmap) Bitmap {
+	if len(c) < len(b) {
+		b, c = c, b
+	}
+	r := make(Bitmap, len(b))
+	for i, w := range b {
+		r[i] = w & c[i]
+	}
+	return r
+}
+
+// Xor returns the symmetric difference of b and c.
+func (b Bitmap) Xor(c Bitmap) Bitmap {
+	if len(c) > len(b) {
+		b, c = c, b
+	}
+	r := make(Bitmap, len(b))
+	copy(r, b)
+	for i, w := range c {
+		r[i] ^= w
+	}
+	return r
+}
+
+// Count returns the number of objects in the bitmap.
+func (b Bitmap) Count() int {
+	n := 0
+	for _, w := range b {
+		n += bits.OnesCount64(w)
+	}
+	return n
+}
+
+const (
+	ewahMaxRun     = 1<<32 - 1
+	ewahMaxLiteral = 1<<31 - 1
+)
+
+// readEWAH decodes an EWAH bitmap at the start of data, and returns
+// it with the length of its encoding.
+func readEWAH(data []byte) (Bitmap, int, error) {
+	if len(data) < 8 {
+		return nil, 0, errCorruptedBitmap
+	}
+	nbits := uint64(binary.BigEndian.Uint32(data[0:4]))
+	nwords := uint64(binary.BigEndian.Uint32(data[4:8]))
+	size := 8 + 8*nwords + 4
+	if uint64(len(data)) < size {
+		return nil, 0, errCorruptedBitmap
+	}
+	words := data[8 : 8+8*nwords]
+	maxWords := (nbits + 63) / 64
+	b := make(Bitmap, 0, maxWords)
+	for i := uint64(0); i < nwords; {
+		marker := binary.BigEndian.Uint64(words[8*i:])
+		i++
+		run, lit := (marker>>1)&ewahMaxRun, marker>>33
+		if uint64(len(b))+run+lit > maxWords || i+lit > nwords {
+			return nil, 0, errCorruptedBitmap
+		}
+		fill := uint64(0)
+		if marker&1 != 0 {
+			fill = ^uint64(0)
+		}
+		for ; run > 0; run-- {
+			b = append(b, fill)
+		}
+		for ; lit > 0; lit-- {
+			b = append(b, binary.BigEndian.Uint64(words[8*i:]))
+			i++
+		}
+	}
+	return b, int(size), nil
+}
+
+// appendEWAH appends the EWAH encoding of the first nbits bits of b
+// to s.
+func appendEWAH(s []byte, b Bitmap, nbits int) []byte {
+	n := (nbits + 63) / 64
+	word := func(i int) uint64 {
+		if i < len(b) {
+			return b[i]
+		}
+		return 0
+	}
+	clean := func(w uint64) bool { return w == 0 || w == ^uint64(0) }
+
+	var words []uint64
+	marker := 0
+	for i := 0; i < n || len(words) == 0; {
+		marker = len(words)
+		words = append(words, 0)
+		var run, lit uint64
+		var fill uint64
+		if i < n && clean(word(i)) {
+			fill = word(i)
+			for i < n && word(i) == fill && run < ewahMaxRun {
+				run++
+				i++
+			}
+		}
+		for i < n && !clean(word(i)) && lit < ewahMaxLiteral {
+			words = append(words, word(i))
+			lit++
+			i++
+		}
+		words[marker] = fill&1 | run<<1 | lit<<33
+	}
+
+	var buf [8]byte
+	binary.BigEndian.PutUint32(buf[:4], uint32(nbits))
+	binary.BigEndian.PutUint32(buf[4:], uint32(len(words)))
+	s = append(s, buf[:]...)
+	for _, w := range words {
+		binary.BigEndian.PutUint64(buf[:], w)
+		s = append(s, buf[:]...)
+	}
+	binary.BigEndian.PutUint32(buf[:4], uint32(marker))
+	return append(s, buf[:4]...)
+}
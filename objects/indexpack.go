@@ -0,0 +1,360 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package objects
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/remyoudompheng/gigot/gitdelta"
+)
+
+// This file implements indexing of a bare packfile, as done by
+// git index-pack.
+//
+// The pack is read once, computing the CRC32 of each entry and the
+// checksum of the whole pack, and spooled to a temporary file.
+// Hashes of undeltified objects are computed while reading; deltas
+// are then resolved by walking from each base to the entries
+// depending on it, reading them again from the spooled pack, so that
+// only the objects along a delta chain are held in memory at a given
+// time.
+
+var (
+	errPackChecksumMismatch = errors.New("gigot: pack checksum mismatch")
+	errTrailingPackData     = errors.New("gigot: garbage at end of pack")
+	errUnresolvedDelta      = errors.New("gigot: unresolved delta in pack")
+)
+
+// IndexPack reads a packfile from r and returns its version 2 index.
+// The pack is copied to a temporary file while deltas are resolved.
+func IndexPack(r io.Reader) (idx []byte, err error) {
+	return IndexThinPack(r, nil)
+}
+
+// IndexThinPack is like IndexPack, but bases of REF deltas missing from
+// the pack are looked up in store, if not nil. Such bases are not added
+// to the pack: the index only lists the objects of the pack.
+func IndexThinPack(r io.Reader, store ObjectStore) (idx []byte, err error) {
+	spool, err := ioutil.TempFile("", "gigot-pack")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	ix := &packIndexer{
+		r: packCounter{
+			r:   bufio.NewReader(r),
+			w:   bufio.NewWriter(spool),
+			sum: sha1.New(),
+			crc: crc32.NewIEEE(),
+		},
+		spool:       spool,
+		ofsChildren: make(map[int64][]int),
+		refChildren: make(map[Hash][]int),
+	}
+	if err := ix.readPack(); err != nil {
+		return nil, err
+	}
+	if err := ix.r.w.Flush(); err != nil {
+		return nil, err
+	}
+	if err := ix.resolveDeltas(store); err != nil {
+		return nil, err
+	}
+	packed := make([]packEntry, len(ix.entries))
+	for i, e := range ix.entries {
+		packed[i] = e.packEntry
+	}
+	buf := new(bytes.Buffer)
+	if err := writeIdx(buf, packed, ix.checksum); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// A packIndexer holds the state of IndexPack.
+type packIndexer struct {
+	r        packCounter
+	spool    *os.File // a copy of the pack.
+	entries  []indexEntry
+	checksum Hash
+
+	// Delta entries by base offset or hash.
+	ofsChildren map[int64][]int
+	refChildren map[Hash][]int
+}
+
+// An indexEntry describes an entry of an indexed pack.
+type indexEntry struct {
+	packEntry
+	typ      int   // pack entry type.
+	size     int64 // uncompressed size of entry data.
+	dataOff  int64 // offset of compressed data.
+	resolved bool
+}
+
+// A packCounter reads from a pack, updating the pack checksum and
+// the CRC32 of the current entry, and copying the data to w. Write
+// errors are reported when w is flushed. It implements io.ByteReader
+// so that zlib readers do not read beyond the end of compressed data.
+type packCounter struct {
+	r   *bufio.Reader
+	w   *bufio.Writer
+	sum hash.Hash
+	crc hash.Hash32
+	n   int64 // bytes read so far.
+}
+
+func (c *packCounter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.sum.Write(p[:n])
+	c.crc.Write(p[:n])
+	c.w.Write(p[:n])
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *packCounter) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		p := [1]byte{b}
+		c.sum.Write(p[:])
+		c.crc.Write(p[:])
+		c.w.WriteByte(b)
+		c.n++
+	}
+	return b, err
+}
+
+// offset returns the number of bytes read so far.
+func (c *packCounter) offset() int64 { return c.n }
+
+// readPack reads all entries and the trailer of the pack.
+func (ix *packIndexer) readPack() error {
+	var hdr [12]byte
+	if _, err := io.ReadFull(&ix.r, hdr[:]); err != nil {
+		return err
+	}
+	if string(hdr[:4]) != "PACK" {
+		return errBadPackMagic
+	}
+	if binary.BigEndian.Uint32(hdr[4:8]) != 2 {
+		return errUnsupportedPackVersion
+	}
+	count := binary.BigEndian.Uint32(hdr[8:12])
+	if count < 1<<16 {
+		ix.entries = make([]indexEntry, 0, count)
+	}
+	for i := uint32(0); i < count; i++ {
+		if err := ix.readEntry(); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+
+	ix.r.sum.Sum(ix.checksum[:0])
+	var trailer Hash
+	if _, err := io.ReadFull(&ix.r, trailer[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if trailer != ix.checksum {
+		return errPackChecksumMismatch
+	}
+	if _, err := ix.r.ReadByte(); err != io.EOF {
+		if err == nil {
+			err = errTrailingPackData
+		}
+		return err
+	}
+	return nil
+}
+
+// readEntry reads the next entry of the pack. Undeltified objects
+// are hashed; the contents of deltas are only checked for their
+// size.
+func (ix *packIndexer) readEntry() error {
+	r := &ix.r
+	r.crc.Reset()
+	e := indexEntry{packEntry: packEntry{Offset: r.offset()}}
+	varint, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+	e.size = int64((varint>>7)<<4 | (varint & 0xf))
+	e.typ = int(varint>>4) & 0x7
+	index := len(ix.entries)
+
+	var h hash.Hash
+	switch e.typ {
+	case pkCommit, pkTree, pkBlob, pkTag:
+		t, _ := objType(e.typ)
+		h = sha1.New()
+		fmt.Fprintf(h, "%s %d\x00", t, e.size)
+		e.resolved = true
+	case pkOfsDelta:
+		var buf [16]byte
+		n := 0
+		for n < len(buf) {
+			b, err := r.ReadByte()
+			if err != nil {
+				return err
+			}
+			buf[n] = b
+			n++
+			if b&0x80 == 0 {
+				break
+			}
+		}
+		dist, _, err := readVaroffset(buf[:n])
+		if err != nil {
+			return err
+		}
+		if dist <= 0 || dist > e.Offset {
+			return errInvalidDeltaBase
+		}
+		base := e.Offset - dist
+		ix.ofsChildren[base] = append(ix.ofsChildren[base], index)
+	case pkRefDelta:
+		var base Hash
+		if _, err := io.ReadFull(r, base[:]); err != nil {
+			return err
+		}
+		ix.refChildren[base] = append(ix.refChildren[base], index)
+	default:
+		return errInvalidPackEntryType
+	}
+
+	e.dataOff = r.offset()
+	zr, err := zlib.NewReader(r)
+	if err != nil {
+		return err
+	}
+	var w io.Writer = ioutil.Discard
+	if h != nil {
+		w = h
+	}
+	n, err := io.Copy(w, zr)
+	if err != nil {
+		return err
+	}
+	if n != e.size {
+		return errObjectSizeMismatch
+	}
+	if h != nil {
+		h.Sum(e.Hash[:0])
+	}
+	e.CRC = r.crc.Sum32()
+	ix.entries = append(ix.entries, e)
+	return nil
+}
+
+// entryData decompresses the data of the i-th entry from the
+// spooled pack.
+func (ix *packIndexer) entryData(i int) ([]byte, error) {
+	e := &ix.entries[i]
+	data := make([]byte, e.size)
+	sr := io.NewSectionReader(ix.spool, e.dataOff, ix.r.n-e.dataOff)
+	zr, err := zlib.NewReader(bufio.NewReader(sr))
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.ReadFull(zr, data)
+	return data, err
+}
+
+// resolveDeltas computes the hashes of deltified entries, looking
+// up bases missing from the pack in store.
+func (ix *packIndexer) resolveDeltas(store ObjectStore) error {
+	for i := range ix.entries {
+		e := &ix.entries[i]
+		if e.typ >= pkOfsDelta || !ix.hasChildren(e.Offset, e.Hash) {
+			continue
+		}
+		data, err := ix.entryData(i)
+		if err != nil {
+			return err
+		}
+		if err := ix.resolveChildren(e.typ, data, e.Offset, e.Hash); err != nil {
+			return err
+		}
+	}
+	if store != nil {
+		for base := range ix.refChildren {
+			o, err := store.Get(base)
+			if err == ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			data, _, err := objectData(o)
+			if err != nil {
+				return err
+			}
+			if err := ix.resolveChildren(packType(o.Type()), data, -1, base); err != nil {
+				return err
+			}
+		}
+	}
+	for _, e := range ix.entries {
+		if !e.resolved {
+			return errUnresolvedDelta
+		}
+	}
+	return nil
+}
+
+func (ix *packIndexer) hasChildren(off int64, h Hash) bool {
+	return len(ix.ofsChildren[off]) > 0 || len(ix.refChildren[h]) > 0
+}
+
+// resolveChildren resolves the deltas whose base is the object with
+// the given type and data, at offset off (or -1 if it is not in the
+// pack) with hash h.
+func (ix *packIndexer) resolveChildren(typ int, data []byte, off int64, h Hash) error {
+	children := append(ix.ofsChildren[off], ix.refChildren[h]...)
+	delete(ix.ofsChildren, off)
+	delete(ix.refChildren, h)
+	for _, c := range children {
+		delta, err := ix.entryData(c)
+		if err != nil {
+			return err
+		}
+		result, err := gitdelta.Patch(data, delta)
+		if err != nil {
+			return err
+		}
+		t, _ := objType(typ)
+		sum := sha1.New()
+		fmt.Fprintf(sum, "%s %d\x00", t, len(result))
+		sum.Write(result)
+
+		e := &ix.entries[c]
+		sum.Sum(e.Hash[:0])
+		e.resolved = true
+		if ix.hasChildren(e.Offset, e.Hash) {
+			if err := ix.resolveChildren(typ, result, e.Offset, e.Hash); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package objects
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/remyoudompheng/gigot/gitdelta"
+)
+
+func TestIndexPack(t *testing.T) {
+	// The index must be identical to the one written by git index-pack.
+	pack, err := ioutil.ReadFile("testdata/pack-small.pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := ioutil.ReadFile("testdata/pack-small.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := IndexPack(bytes.NewReader(pack))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(idx, ref) {
+		t.Errorf("index differs from git index-pack output")
+	}
+
+	// A pack of our own repository, with longer delta chains.
+	packs, _ := filepath.Glob("../.git/objects/pack/pack-*.pack")
+	for _, name := range packs {
+		pack, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref, err := ioutil.ReadFile(strings.TrimSuffix(name, ".pack") + ".idx")
+		if err != nil {
+			t.Fatal(err)
+		}
+		idx, err := IndexPack(bytes.NewReader(pack))
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+		} else if !bytes.Equal(idx, ref) {
+			t.Errorf("%s: index differs from git index-pack output", name)
+		}
+	}
+
+	// Packs written by PackWriter.
+	objs := testObjects()
+	for _, delta := range []DeltaKind{NoDelta, OfsDelta, RefDelta} {
+		pack, ref := writeTestPack(t, objs, delta)
+		idx, err := IndexPack(bytes.NewReader(pack))
+		if err != nil {
+			t.Errorf("delta=%d: %s", delta, err)
+			continue
+		}
+		if !bytes.Equal(idx, ref) {
+			t.Errorf("delta=%d: index differs from PackWriter index", delta)
+		}
+	}
+}
+
+func TestIndexPackErrors(t *testing.T) {
+	pack, err := ioutil.ReadFile("testdata/pack-small.pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := append([]byte(nil), pack...)
+	corrupt[len(corrupt)-1] ^= 1
+	for _, test := range []struct {
+		name string
+		pack []byte
+		err  error
+	}{
+		{"bad checksum", corrupt, errPackChecksumMismatch},
+		{"trailing data", append(pack[:len(pack):len(pack)], 0), errTrailingPackData},
+		{"truncated", pack[:len(pack)-30], io.ErrUnexpectedEOF},
+		{"bad magic", append([]byte("KCAP"), pack[4:]...), errBadPackMagic},
+	} {
+		_, err := IndexPack(bytes.NewReader(test.pack))
+		if err != test.err {
+			t.Errorf("%s: got error %v, expected %v", test.name, err, test.err)
+		}
+	}
+}
+
+// thinPack returns a pack holding a single REF delta against base.
+func thinPack(base, target Blob) []byte {
+	return refDeltaPack(base, gitdelta.Diff(base.Data, target.Data), false)
+}
+
+// refDeltaPack returns a pack holding a REF delta against base, and
+// base itself if withBase is true.
+func refDeltaPack(base Blob, delta []byte, withBase bool) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("PACK")
+	count := uint32(1)
+	if withBase {
+		count++
+	}
+	binary.Write(buf, binary.BigEndian, [2]uint32{2, count})
+	writeEntry := func(typ int, hdr, data []byte) {
+		buf.Write(appendEntryHeader(nil, typ, len(data)))
+		buf.Write(hdr)
+		zw := zlib.NewWriter(buf)
+		zw.Write(data)
+		zw.Close()
+	}
+	if withBase {
+		writeEntry(pkBlob, nil, base.Data)
+	}
+	writeEntry(pkRefDelta, base.Hash[:], delta)
+	sum := sha1.Sum(buf.Bytes())
+	buf.Write(sum[:])
+	return buf.Bytes()
+}
+
+func TestIndexPackCorruptDelta(t *testing.T) {
+	base := Blob{Data: []byte("0123456789")}
+	base.Hash = rehash(base)
+	for _, delta := range [][]byte{
+		{10, 100, 0x90, 100}, // copy beyond the base.
+		{10, 5, 0x91, 2},     // truncated copy.
+		{10, 5, 5, 'a', 'b'}, // truncated insert.
+		{10, 1, 2, 'a', 'b'}, // result larger than announced.
+	} {
+		pack := refDeltaPack(base, delta, true)
+		if _, err := IndexPack(bytes.NewReader(pack)); err == nil {
+			t.Errorf("delta %x: no error", delta)
+		}
+	}
+}
+
+func TestIndexThinPack(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gigot-objects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	base := largeBlob(4096)
+	target := Blob{Data: append(append([]byte(nil), base.Data...), "appended"...)}
+	target.Hash = rehash(target)
+	store := NewLooseStore(dir)
+	if _, err := store.Put(base); err != nil {
+		t.Fatal(err)
+	}
+
+	pack := thinPack(base, target)
+	if _, err := IndexPack(bytes.NewReader(pack)); err != errUnresolvedDelta {
+		t.Errorf("got error %v for thin pack, expected %v", err, errUnresolvedDelta)
+	}
+	idx, err := IndexThinPack(bytes.NewReader(pack), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := openTestPack(t, pack, idx)
+	hashes, err := pk.Objects()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != 1 || hashes[0] != target.Hash {
+		t.Errorf("index lists %v, expected [%s]", hashes, target.Hash)
+	}
+}
@@ -0,0 +1,368 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package objects
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// This file implements the multi-pack-index, which lists the objects
+// of several packs in a single sorted table, so that an object can
+// be found with a single binary search.
+//
+// The file has a 12-byte header ("MIDX", version, hash version,
+// number of chunks, number of base files, number of packs) and the
+// following chunks:
+//   PNAM: NUL-terminated names of pack indexes, in sorted order.
+//   OIDF: fanout table of object hashes.
+//   OIDL: sorted object hashes.
+//   OOFF: pack number and 32-bit offset of each object.
+//   LOFF: 64-bit offsets, for offsets with the high bit set.
+//
+// Cf. Documentation/technical/multi-pack-index.txt in Git sources.
+
+const midxHeaderSize = 12
+
+var (
+	errBadMidxMagic           = errors.New("gigot: bad magic number in multi-pack-index")
+	errUnsupportedMidxVersion = errors.New("gigot: multi-pack-index has unsupported format version")
+	errCorruptedMidx          = errors.New("gigot: corrupted multi-pack-index")
+	errMidxPackCount          = errors.New("gigot: wrong number of packs for multi-pack-index")
+)
+
+// A MultiPackIndex reads a multi-pack-index file. It is safe for
+// concurrent use.
+type MultiPackIndex struct {
+	r     *io.SectionReader
+	data  []byte
+	close func() error
+
+	names  []string
+	fanout [256]uint32
+	oidl   int64 // offsets of chunks.
+	ooff   int64
+	loff   chunk
+}
+
+// NewMultiPackIndex reads a multi-pack-index from r.
+func NewMultiPackIndex(r *io.SectionReader) (*MultiPackIndex, error) {
+	m := &MultiPackIndex{r: r}
+	if err := m.init(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// OpenMultiPackIndex opens a multi-pack-index file, usually
+// objects/pack/multi-pack-index. The file is memory-mapped where
+// the platform supports it. The MultiPackIndex must be closed after
+// use.
+func OpenMultiPackIndex(path string) (*MultiPackIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	// Files that cannot be mapped are read using ReadAt.
+	data, _ := mmapFile(f, st.Size())
+	m := &MultiPackIndex{data: data}
+	if data != nil {
+		m.r = io.NewSectionReader(bytes.NewReader(data), 0, st.Size())
+	} else {
+		m.r = io.NewSectionReader(f, 0, st.Size())
+	}
+	m.close = func() error {
+		var err error
+		if data != nil {
+			err = munmap(data)
+		}
+		if errc := f.Close(); err == nil {
+			err = errc
+		}
+		return err
+	}
+	if err := m.init(); err != nil {
+		m.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// Close releases the file and memory mapping held by a MultiPackIndex
+// returned by OpenMultiPackIndex. It must not be used afterwards.
+func (m *MultiPackIndex) Close() error {
+	if m.close == nil {
+		return nil
+	}
+	err := m.close()
+	m.close, m.data = nil, nil
+	return err
+}
+
+// init parses the header and chunk table.
+func (m *MultiPackIndex) init() error {
+	var buf [midxHeaderSize]byte
+	hdr, err := readAt(m.r, m.data, buf[:], 0)
+	if err == io.EOF {
+		return errCorruptedMidx
+	}
+	if err != nil {
+		return err
+	}
+	if string(hdr[:4]) != "MIDX" {
+		return errBadMidxMagic
+	}
+	// Version 1, SHA-1 hashes, no base files.
+	if hdr[4] != 1 || hdr[5] != 1 || hdr[7] != 0 {
+		return errUnsupportedMidxVersion
+	}
+	npacks := int(binary.BigEndian.Uint32(hdr[8:12]))
+	chunks, err := readChunkTable(m.r, m.data, midxHeaderSize, int(hdr[6]))
+	if err != nil {
+		return err
+	}
+	for _, id := range []string{"PNAM", "OIDF", "OIDL", "OOFF"} {
+		if _, ok := chunks[id]; !ok {
+			return errMissingChunk
+		}
+	}
+
+	pnam := chunks["PNAM"]
+	names, err := readAt(m.r, m.data, make([]byte, pnam.size), pnam.off)
+	if err != nil {
+		return err
+	}
+	for _, name := range strings.Split(string(names), "\x00") {
+		if name != "" {
+			m.names = append(m.names, name)
+		}
+	}
+	if len(m.names) != npacks {
+		return errCorruptedMidx
+	}
+
+	oidf := chunks["OIDF"]
+	if oidf.size != 256*4 {
+		return errCorruptedMidx
+	}
+	fanout, err := readAt(m.r, m.data, make([]byte, oidf.size), oidf.off)
+	if err != nil {
+		return err
+	}
+	for i := range m.fanout {
+		m.fanout[i] = binary.BigEndian.Uint32(fanout[4*i:])
+		if i > 0 && m.fanout[i] < m.fanout[i-1] {
+			return errCorruptedMidx
+		}
+	}
+	count := int64(m.fanout[0xff])
+	if chunks["OIDL"].size != 20*count || chunks["OOFF"].size != 8*count {
+		return errCorruptedMidx
+	}
+	m.oidl, m.ooff = chunks["OIDL"].off, chunks["OOFF"].off
+	m.loff = chunks["LOFF"]
+	return nil
+}
+
+// PackNames returns the names of the pack indexes covered by the
+// multi-pack-index, such as "pack-<hash>.idx". Pack numbers returned
+// by Find are positions in this list.
+func (m *MultiPackIndex) PackNames() []string {
+	return m.names
+}
+
+// Len returns the number of objects in the multi-pack-index.
+func (m *MultiPackIndex) Len() int {
+	return int(m.fanout[0xff])
+}
+
+// Find returns the pack number and offset of an object.
+// It returns ErrNotFound if the object is not indexed.
+func (m *MultiPackIndex) Find(h Hash) (pack int, offset int64, err error) {
+	min, max := int64(0), int64(m.fanout[h[0]])
+	if h[0] > 0 {
+		min = int64(m.fanout[h[0]-1])
+	}
+	for min < max {
+		var buf [20]byte
+		med := (min + max) / 2
+		hmed, err := readAt(m.r, m.data, buf[:], m.oidl+20*med)
+		if err != nil {
+			return 0, 0, err
+		}
+		switch cmp := bytes.Compare(hmed, h[:]); true {
+		case cmp < 0:
+			min = med + 1
+		case cmp > 0:
+			max = med
+		case cmp == 0:
+			return m.objectAt(med)
+		}
+	}
+	return 0, 0, ErrNotFound
+}
+
+// objectAt returns the pack number and offset of the i-th object.
+func (m *MultiPackIndex) objectAt(i int64) (pack int, offset int64, err error) {
+	var buf [8]byte
+	b, err := readAt(m.r, m.data, buf[:], m.ooff+8*i)
+	if err != nil {
+		return 0, 0, err
+	}
+	pack = int(binary.BigEndian.Uint32(b[:4]))
+	off32 := binary.BigEndian.Uint32(b[4:8])
+	if pack >= len(m.names) {
+		return 0, 0, errCorruptedMidx
+	}
+	if off32&(1<<31) == 0 || m.loff.size == 0 {
+		return pack, int64(off32), nil
+	}
+	large := int64(off32 &^ (1 << 31))
+	if 8*large+8 > m.loff.size {
+		return 0, 0, errCorruptedMidx
+	}
+	b, err = readAt(m.r, m.data, buf[:], m.loff.off+8*large)
+	if err != nil {
+		return 0, 0, err
+	}
+	return pack, int64(binary.BigEndian.Uint64(b)), nil
+}
+
+// Objects returns the sorted list of hashes of indexed objects.
+func (m *MultiPackIndex) Objects() ([]Hash, error) {
+	count := int64(m.fanout[0xff])
+	buf, err := readAt(m.r, m.data, make([]byte, 20*count), m.oidl)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]Hash, count)
+	for i := range hashes {
+		copy(hashes[i][:], buf[20*i:])
+	}
+	return hashes, nil
+}
+
+// A midxEntry is an object to be written in a multi-pack-index.
+type midxEntry struct {
+	Hash   Hash
+	Pack   uint32 // number of the pack, in name order.
+	Rank   int    // position of the pack in arguments.
+	Offset int64
+}
+
+type midxEntries []midxEntry
+
+func (s midxEntries) Len() int      { return len(s) }
+func (s midxEntries) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s midxEntries) Less(i, j int) bool {
+	if cmp := bytes.Compare(s[i].Hash[:], s[j].Hash[:]); cmp != 0 {
+		return cmp < 0
+	}
+	return s[i].Rank < s[j].Rank
+}
+
+// WriteMultiPackIndex writes to w a multi-pack-index for packs,
+// whose index file names (such as "pack-<hash>.idx") are given by
+// names. Objects present in several packs are attributed to the
+// first one in the list.
+func WriteMultiPackIndex(w io.Writer, names []string, packs []*PackReader) error {
+	if len(names) != len(packs) {
+		return errMidxPackCount
+	}
+	sorted := append([]string(nil), names...)
+	sort.Strings(sorted)
+	packNum := make(map[string]uint32, len(sorted))
+	for i, name := range sorted {
+		packNum[name] = uint32(i)
+	}
+	if len(packNum) != len(names) {
+		// Duplicate names.
+		return errMidxPackCount
+	}
+
+	var entries midxEntries
+	for rank, pk := range packs {
+		objs, err := pk.indexEntries()
+		if err != nil {
+			return err
+		}
+		for _, e := range objs {
+			entries = append(entries, midxEntry{
+				Hash: e.Hash, Pack: packNum[names[rank]],
+				Rank: rank, Offset: e.Offset,
+			})
+		}
+	}
+	sort.Sort(entries)
+	uniq := entries[:0]
+	for i, e := range entries {
+		if i == 0 || e.Hash != entries[i-1].Hash {
+			uniq = append(uniq, e)
+		}
+	}
+	entries = uniq
+
+	// Like Git, only use large offsets when some offset does
+	// not fit in 32 bits.
+	large := false
+	for _, e := range entries {
+		if e.Offset>>32 != 0 {
+			large = true
+		}
+	}
+
+	pnam := new(bytes.Buffer)
+	for _, name := range sorted {
+		pnam.WriteString(name)
+		pnam.WriteByte(0)
+	}
+	for pnam.Len()%4 != 0 {
+		pnam.WriteByte(0)
+	}
+	var fanout [256]uint32
+	for _, e := range entries {
+		fanout[e.Hash[0]]++
+	}
+	for i := 1; i < 256; i++ {
+		fanout[i] += fanout[i-1]
+	}
+	oidf := new(bytes.Buffer)
+	binary.Write(oidf, binary.BigEndian, fanout[:])
+	oidl := new(bytes.Buffer)
+	ooff := new(bytes.Buffer)
+	loff := new(bytes.Buffer)
+	for _, e := range entries {
+		oidl.Write(e.Hash[:])
+		off32 := uint32(e.Offset)
+		if large && e.Offset>>31 != 0 {
+			off32 = 1<<31 | uint32(loff.Len()/8)
+			binary.Write(loff, binary.BigEndian, uint64(e.Offset))
+		}
+		binary.Write(ooff, binary.BigEndian, [2]uint32{e.Pack, off32})
+	}
+
+	chunks := []chunkData{
+		{"PNAM", pnam.Bytes()},
+		{"OIDF", oidf.Bytes()},
+		{"OIDL", oidl.Bytes()},
+		{"OOFF", ooff.Bytes()},
+	}
+	if large {
+		chunks = append(chunks, chunkData{"LOFF", loff.Bytes()})
+	}
+	header := []byte{'M', 'I', 'D', 'X', 1, 1, byte(len(chunks)), 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(header[8:], uint32(len(names)))
+	return writeChunkFile(w, header, chunks)
+}
@@ -0,0 +1,195 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package objects
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// openMidxPacks opens the packs of testdata/midx, which were indexed
+// by git multi-pack-index write.
+func openMidxPacks(t *testing.T) (names []string, packs []*PackReader) {
+	idxs, err := filepath.Glob("testdata/midx/pack/pack-*.idx")
+	if err != nil || len(idxs) != 3 {
+		t.Fatalf("found %d packs in testdata/midx (err=%v)", len(idxs), err)
+	}
+	for _, idx := range idxs {
+		pk, err := OpenPack(strings.TrimSuffix(idx, ".idx"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, filepath.Base(idx))
+		packs = append(packs, pk)
+	}
+	return names, packs
+}
+
+func TestReadMultiPackIndex(t *testing.T) {
+	m, err := OpenMultiPackIndex("testdata/midx/pack/multi-pack-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	names, packs := openMidxPacks(t)
+	if strings.Join(m.PackNames(), " ") != strings.Join(names, " ") {
+		t.Errorf("got packs %v, expected %v", m.PackNames(), names)
+	}
+	total := 0
+	for i, pk := range packs {
+		defer pk.Close()
+		hashes, err := pk.Objects()
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += len(hashes)
+		for _, h := range hashes {
+			off, _ := pk.findObject(h)
+			pack, off2, err := m.Find(h)
+			if err != nil || pack != i || off2 != off {
+				t.Errorf("Find(%s) = %d, %d, %v, expected %d, %d", h, pack, off2, err, i, off)
+			}
+		}
+	}
+	if m.Len() != total {
+		t.Errorf("got %d objects, expected %d", m.Len(), total)
+	}
+	if hashes, err := m.Objects(); err != nil || len(hashes) != total {
+		t.Errorf("Objects returned %d hashes (err=%v), expected %d", len(hashes), err, total)
+	}
+	if _, _, err := m.Find(Hash{}); err != ErrNotFound {
+		t.Errorf("got error %v for missing object, expected ErrNotFound", err)
+	}
+}
+
+func TestMultiPackIndexReadAt(t *testing.T) {
+	defer func() { mmapFile = mmap }()
+	mmapFile = func(f *os.File, size int64) ([]byte, error) {
+		return nil, errors.New("cannot map file")
+	}
+	m, err := OpenMultiPackIndex("testdata/midx/pack/multi-pack-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if m.data != nil {
+		t.Errorf("multi-pack-index is mapped in ReadAt mode")
+	}
+	hashes, err := m.Objects()
+	if err != nil || len(hashes) == 0 {
+		t.Fatalf("Objects returned %d hashes (err=%v)", len(hashes), err)
+	}
+	if _, _, err := m.Find(hashes[0]); err != nil {
+		t.Errorf("Find(%s): %s", hashes[0], err)
+	}
+}
+
+func TestWriteMultiPackIndex(t *testing.T) {
+	ref, err := ioutil.ReadFile("testdata/midx/pack/multi-pack-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, packs := openMidxPacks(t)
+	for _, pk := range packs {
+		defer pk.Close()
+	}
+	// Argument order does not matter without duplicates.
+	names[0], names[2] = names[2], names[0]
+	packs[0], packs[2] = packs[2], packs[0]
+	buf := new(bytes.Buffer)
+	if err := WriteMultiPackIndex(buf, names, packs); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), ref) {
+		t.Errorf("multi-pack-index differs from git output")
+	}
+
+	// Objects present in both packs are attributed to the first one.
+	objs := testObjects()
+	pack1, idx1 := writeTestPack(t, objs, OfsDelta)
+	pack2, idx2 := writeTestPack(t, objs[:30], NoDelta)
+	pk1, pk2 := openTestPack(t, pack1, idx1), openTestPack(t, pack2, idx2)
+	buf.Reset()
+	if err := WriteMultiPackIndex(buf, []string{"pack-b.idx", "pack-a.idx"}, []*PackReader{pk1, pk2}); err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewMultiPackIndex(io.NewSectionReader(bytes.NewReader(buf.Bytes()), 0, int64(buf.Len())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Len() != len(objs) {
+		t.Errorf("got %d objects, expected %d", m.Len(), len(objs))
+	}
+	for _, o := range objs {
+		off, _ := pk1.findObject(o.ID())
+		pack, off2, err := m.Find(o.ID())
+		if err != nil || pack != 1 || off2 != off {
+			t.Errorf("Find(%s) = %d, %d, %v, expected 1, %d", o.ID(), pack, off2, err, off)
+		}
+	}
+}
+
+func TestDatabaseMultiPackIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gigot-objects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "pack"), 0755)
+	files, _ := filepath.Glob("testdata/midx/pack/*")
+	for _, name := range files {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "pack", filepath.Base(name)), data, 0444); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A pack which is not covered by the multi-pack-index.
+	objs := testObjects()
+	pack, idx := writeTestPack(t, objs, OfsDelta)
+	base := filepath.Join(dir, "pack", "pack-extra")
+	ioutil.WriteFile(base+".pack", pack, 0444)
+	ioutil.WriteFile(base+".idx", idx, 0444)
+
+	db, err := OpenDatabase(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.MultiIndex == nil || len(db.unindexed) != 1 {
+		t.Fatalf("multi-pack-index not used")
+	}
+	hashes, err := db.MultiIndex.Objects()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, o := range objs {
+		hashes = append(hashes, o.ID())
+	}
+	for _, h := range hashes {
+		o, err := db.Get(h)
+		if err != nil {
+			t.Errorf("Get(%s): %s", h, err)
+			continue
+		}
+		if o.ID() != h {
+			t.Errorf("got %s, expected %s", o.ID(), h)
+		}
+		if ok, err := db.Has(h); !ok || err != nil {
+			t.Errorf("Has(%s) = %v, %v", h, ok, err)
+		}
+	}
+	if _, err := db.Get(Hash{1}); err != ErrNotFound {
+		t.Errorf("got error %v for missing object, expected ErrNotFound", err)
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package objects
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// This file implements opening packs from the filesystem. Where
+// the platform supports it, pack and index files are memory-mapped,
+// so that index lookups and entry headers are read directly from
+// memory instead of issuing a system call for each access.
+// Elsewhere, or if mapping fails, they are read using ReadAt.
+
+// mmapFile maps files in memory. It is replaced by tests to
+// simulate mapping failures.
+var mmapFile = mmap
+
+// OpenPack opens the pack file base+".pack" and its index
+// base+".idx". The returned PackReader must be closed after use.
+func OpenPack(base string) (*PackReader, error) {
+	return openPack(base, true)
+}
+
+// openPack opens a pack, memory-mapping files if mapped is true
+// and the platform supports it.
+func openPack(base string, mapped bool) (*PackReader, error) {
+	var files [2]*os.File
+	var data [2][]byte
+	closeAll := func() error {
+		var err error
+		for i := range files {
+			if data[i] != nil {
+				if errc := munmap(data[i]); err == nil {
+					err = errc
+				}
+			}
+			if files[i] != nil {
+				if errc := files[i].Close(); err == nil {
+					err = errc
+				}
+			}
+		}
+		return err
+	}
+
+	var sections [2]*io.SectionReader
+	for i, ext := range []string{".pack", ".idx"} {
+		f, err := os.Open(base + ext)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		files[i] = f
+		st, err := f.Stat()
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		size := st.Size()
+		if mapped {
+			// Files that cannot be mapped, for example on some
+			// network filesystems, are read using ReadAt.
+			data[i], _ = mmapFile(f, size)
+		}
+		if data[i] != nil {
+			sections[i] = io.NewSectionReader(bytes.NewReader(data[i]), 0, size)
+		} else {
+			sections[i] = io.NewSectionReader(f, 0, size)
+		}
+	}
+	pk, err := NewPackReader(sections[0], sections[1])
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	pk.packData, pk.idxData = data[0], data[1]
+	pk.close = closeAll
+	pk.loadRevFile(base + ".rev")
+	return pk, nil
+}
+
+// Close releases the files and memory mappings held by a PackReader
+// returned by OpenPack. The reader must not be used afterwards.
+// It does nothing for readers created by NewPackReader.
+func (pk *PackReader) Close() error {
+	if pk.close == nil {
+		return nil
+	}
+	err := pk.close()
+	pk.close = nil
+	pk.packData, pk.idxData = nil, nil
+	return err
+}
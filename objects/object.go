@@ -6,11 +6,12 @@
 //
 // It implements low-level accessors to read and parse
 // loose objects and packfiles in Git repositories, and
-// defines appropriate data types representing the three
-// basic object types of Git: blobs, trees and commits.
+// defines appropriate data types representing the four
+// basic object types of Git: blobs, trees, commits and tags.
 package objects
 
 import (
+	"bufio"
 	"bytes"
 	"compress/zlib"
 	"crypto/sha1"
@@ -24,25 +25,29 @@ import (
 	"time"
 )
 
-// ObjType enumerates the three possible object types: blob, tree, commit.
+// ObjType enumerates the four possible object types: blob, tree, commit, tag.
 type ObjType uint8
 
 const (
 	BLOB ObjType = iota
 	TREE
 	COMMIT
+	TAG
 )
 
-func matchType(t ObjType, s []byte) bool {
-	switch t {
-	case BLOB:
-		return bytes.Equal(s, []byte("blob"))
-	case TREE:
-		return bytes.Equal(s, []byte("tree"))
-	case COMMIT:
-		return bytes.Equal(s, []byte("commit"))
+// parseType returns the object type named by s.
+func parseType(s []byte) (t ObjType, ok bool) {
+	switch string(s) {
+	case "blob":
+		return BLOB, true
+	case "tree":
+		return TREE, true
+	case "commit":
+		return COMMIT, true
+	case "tag":
+		return TAG, true
 	}
-	return false
+	return 0, false
 }
 
 func (t ObjType) String() string {
@@ -53,6 +58,8 @@ func (t ObjType) String() string {
 		return "tree"
 	case COMMIT:
 		return "commit"
+	case TAG:
+		return "tag"
 	}
 	return fmt.Sprintf("BAD TYPE %d", int(t))
 }
@@ -72,53 +79,66 @@ func (err errInvalidType) Error() string {
 //
 // A loose object consists of
 // <type> <size>\x00
-// where type is "blob", "tree" or "commit"
+// where type is "blob", "tree", "commit" or "tag".
 func readLoose(r io.ReadCloser) (t ObjType, s []byte, err error) {
-	// read compressed data.
+	t, _, sr, err := openLoose(r)
+	if err != nil {
+		return
+	}
+	defer sr.Close()
+	// The size in the header is not trusted for allocation: a
+	// corrupted object fails when its data ends early.
+	if s, err = ioutil.ReadAll(sr); err != nil {
+		return
+	}
+	// Trailing data is also a size mismatch.
+	var extra [1]byte
+	if n, _ := sr.r.Read(extra[:]); n > 0 {
+		err = errObjectSizeMismatch
+	}
+	return t, s, err
+}
+
+// openLoose reads the header of a loose object and returns a
+// reader for its contents.
+func openLoose(r io.ReadCloser) (t ObjType, size int64, sr *streamReader, err error) {
 	zr, err := zlib.NewReader(r)
 	if err != nil {
 		r.Close()
 		return
 	}
-	s, err = ioutil.ReadAll(zr)
-	r.Close()
-
-	hdr := s
-	if len(hdr) > 32 {
-		hdr = hdr[:32] // 32 bytes are enough for a 20-digit size.
+	br := bufio.NewReader(zr)
+	// 32 bytes are enough for a 20-digit size.
+	hdr, err := br.Peek(32)
+	if err == io.EOF {
+		err = nil
 	}
-	if len(hdr) < 4 {
-		err = errCorruptedObjectHeader
+	if err != nil {
+		r.Close()
 		return
 	}
 	sp := bytes.IndexByte(hdr, ' ')
 	nul := bytes.IndexByte(hdr, 0)
-	switch s[0] {
-	case 'b':
-		t = BLOB
-	case 'c':
-		t = COMMIT
-	case 't':
-		t = TREE
-	}
-	if sp < 0 || !matchType(t, hdr[:sp]) {
-		err = errInvalidType(string(hdr[:sp]))
-		return
+	if len(hdr) < 4 || sp < 0 {
+		r.Close()
+		return t, 0, nil, errCorruptedObjectHeader
 	}
-	if nul < 0 {
-		err = errCorruptedObjectHeader
-		return
+	t, ok := parseType(hdr[:sp])
+	if !ok {
+		r.Close()
+		return t, 0, nil, errInvalidType(string(hdr[:sp]))
 	}
-	sz, err := strconv.ParseUint(string(hdr[sp+1:nul]), 10, 64)
-	if err != nil {
-		err = errCorruptedObjectHeader
-		return
+	if nul < sp {
+		r.Close()
+		return t, 0, nil, errCorruptedObjectHeader
 	}
-	s = s[nul+1:]
-	if uint64(len(s)) != sz {
-		err = errObjectSizeMismatch
+	sz, err := strconv.ParseInt(string(hdr[sp+1:nul]), 10, 64)
+	if err != nil || sz < 0 {
+		r.Close()
+		return t, 0, nil, errCorruptedObjectHeader
 	}
-	return t, s, err
+	br.Discard(nul + 1)
+	return t, sz, &streamReader{r: br, remain: sz, close: r.Close}, nil
 }
 
 func readObject(t ObjType, data []byte) (Object, error) {
@@ -135,6 +155,10 @@ func readObject(t ObjType, data []byte) (Object, error) {
 		o, err := parseCommit(data)
 		o.Hash = rehash(o)
 		return o, err
+	case TAG:
+		o, err := parseTag(data)
+		o.Hash = rehash(o)
+		return o, err
 	}
 	panic(errInvalidType(t.String()))
 }
@@ -152,7 +176,7 @@ func ParseLoose(r io.ReadCloser) (Object, error) {
 type Object interface {
 	// ID return the hash of the object.
 	ID() Hash
-	// Type returns the object type (BLOB, TREE, COMMIT).
+	// Type returns the object type (BLOB, TREE, COMMIT, TAG).
 	Type() ObjType
 	// WriteTo serializes the object: if the Writer is a sha1 Hash
 	// this will produce the hash for this object, if the Writer is
@@ -235,36 +259,41 @@ type Mode uint16
 const (
 	ModeRegular Mode = 8 << 12
 	ModeDir     Mode = 4 << 12
-	ModeSymlink Mode = 2 << 12
+	ModeSymlink Mode = 10 << 12
 
+	// A gitlink is a commit of another repository (a submodule).
 	ModeGitlink = ModeDir | ModeSymlink
 )
 
 // gitMode computes the file mode bits as expected by Git.
 func gitMode(mode os.FileMode) Mode {
 	m := Mode(mode & os.ModePerm)
-	if mode&os.ModeDir != 0 {
+	switch {
+	case mode&os.ModeDir != 0 && mode&os.ModeSymlink != 0:
+		m |= ModeGitlink
+	case mode&os.ModeDir != 0:
 		m |= ModeDir
-	}
-	if mode&os.ModeSymlink != 0 {
+	case mode&os.ModeSymlink != 0:
 		m |= ModeSymlink
-	}
-	if mode&os.ModeType == 0 {
+	case mode&os.ModeType == 0:
 		m |= ModeRegular
 	}
 	return m
 }
 
+// GitMode returns the mode of a tree entry as written by Git,
+// such as 0100644 or 0120000.
+func GitMode(mode os.FileMode) Mode { return gitMode(mode) }
+
 func osMode(mode Mode) os.FileMode {
 	m := os.FileMode(mode & 0777)
-	if mode&ModeRegular != 0 {
-		return m
-	}
-	if mode&ModeDir != 0 {
+	switch mode &^ 0777 {
+	case ModeDir:
 		m |= os.ModeDir
-	}
-	if mode&ModeSymlink != 0 {
+	case ModeSymlink:
 		m |= os.ModeSymlink
+	case ModeGitlink:
+		m |= os.ModeDir | os.ModeSymlink
 	}
 	return m
 }
@@ -305,21 +334,110 @@ type Commit struct {
 	AuthorTime    time.Time
 	Committer     string // The email address of the committer.
 	CommitterTime time.Time
-	Message       []byte // The commit description.
+	// ExtraHeaders lists, in order, the headers not otherwise
+	// represented, such as encoding, mergetag or gpgsig. Headers
+	// of parsed commits are written back at their original
+	// position, others after the committer line.
+	ExtraHeaders []ExtraHeader
+	Message      []byte // The commit description.
+
+	noSeparator bool // the headers end the object, without a blank line.
+}
+
+// An ExtraHeader is a commit or tag header not otherwise
+// represented in Commit or Tag. Multi-line values are stored with their continuation
+// lines joined by '\n', without the leading space.
+type ExtraHeader struct {
+	Key   string
+	Value []byte
+
+	before int // the number of standard header lines following it.
+}
+
+// writeHeaders writes the standard header lines of an object,
+// with extra headers inserted at their original position.
+func writeHeaders(buf *bytes.Buffer, lines []string, extra []ExtraHeader) {
+	i := 0
+	for _, h := range extra {
+		for ; i < len(lines)-h.before; i++ {
+			buf.WriteString(lines[i])
+		}
+		value := bytes.Replace(h.Value, []byte("\n"), []byte("\n "), -1)
+		fmt.Fprintf(buf, "%s %s\n", h.Key, value)
+	}
+	for ; i < len(lines); i++ {
+		buf.WriteString(lines[i])
+	}
+}
+
+// placeHeaders records the position of extra headers, given the
+// number of standard header lines preceding each of them, and
+// their total number.
+func placeHeaders(extra []ExtraHeader, after []int, total int) {
+	for i := range extra {
+		extra[i].before = total - after[i]
+	}
+}
+
+// Header returns the value of the first extra header with the
+// given key, or nil if it is absent.
+func (c Commit) Header(key string) []byte {
+	for _, h := range c.ExtraHeaders {
+		if h.Key == key {
+			return h.Value
+		}
+	}
+	return nil
+}
+
+// Encoding returns the character encoding of the commit message.
+// An empty string means UTF-8.
+func (c Commit) Encoding() string {
+	return string(c.Header("encoding"))
+}
+
+// Signature returns the signature stored in the gpgsig header,
+// or nil if the commit is not signed.
+func (c Commit) Signature() []byte {
+	return c.Header("gpgsig")
+}
+
+// MergeTags parses the tags embedded in mergetag headers, which
+// are recorded when merging signed tags.
+func (c Commit) MergeTags() ([]Tag, error) {
+	var tags []Tag
+	for _, h := range c.ExtraHeaders {
+		if h.Key != "mergetag" {
+			continue
+		}
+		// The header holds the tag body, without its final newline.
+		data := append(append([]byte(nil), h.Value...), '\n')
+		t, err := parseTag(data)
+		if err != nil {
+			return nil, err
+		}
+		t.Hash = rehash(t)
+		tags = append(tags, t)
+	}
+	return tags, nil
 }
 
 func (c Commit) ID() Hash      { return c.Hash }
 func (c Commit) Type() ObjType { return COMMIT }
 
 func (c Commit) WriteTo(w io.Writer) error {
-	buf := new(bytes.Buffer)
-	fmt.Fprintf(buf, "tree %s\n", c.Tree)
+	lines := []string{fmt.Sprintf("tree %s\n", c.Tree)}
 	for _, p := range c.Parents {
-		fmt.Fprintf(buf, "parent %s\n", p)
+		lines = append(lines, fmt.Sprintf("parent %s\n", p))
+	}
+	lines = append(lines,
+		fmt.Sprintf("author %s\n", formatAuthor(c.Author, c.AuthorTime)),
+		fmt.Sprintf("committer %s\n", formatAuthor(c.Committer, c.CommitterTime)))
+	buf := new(bytes.Buffer)
+	writeHeaders(buf, lines, c.ExtraHeaders)
+	if !c.noSeparator || len(c.Message) > 0 {
+		fmt.Fprintf(buf, "\n%s", c.Message)
 	}
-	fmt.Fprintf(buf, "author %s %d %s\n", c.Author, c.AuthorTime.Unix(), c.AuthorTime.Format("-0700"))
-	fmt.Fprintf(buf, "committer %s %d %s\n", c.Committer, c.CommitterTime.Unix(), c.CommitterTime.Format("-0700"))
-	fmt.Fprintf(buf, "\n%s", c.Message)
 
 	fmt.Fprintf(w, "commit %d\x00", buf.Len())
 	_, err := w.Write(buf.Bytes())
@@ -330,6 +448,9 @@ func parseCommit(s []byte) (c Commit, err error) {
 	// Reference: git/Documentation/user-manual.txt, Commit object.
 
 	// Header lines until an empty line.
+	var after []int // standard lines preceding each extra header.
+	nstd := 0
+	c.noSeparator = true
 	for len(s) > 0 {
 		i := bytes.IndexByte(s, '\n')
 		if i < 0 {
@@ -338,14 +459,36 @@ func parseCommit(s []byte) (c Commit, err error) {
 		line := s[:i]
 		s = s[i+1:]
 		if len(line) == 0 {
+			c.noSeparator = false
 			break
 		}
+		if line[0] == ' ' {
+			// continuation of a multi-line extra header.
+			n := len(c.ExtraHeaders)
+			if n == 0 {
+				return c, errMalformedCommitLine
+			}
+			h := &c.ExtraHeaders[n-1]
+			h.Value = append(h.Value, '\n')
+			h.Value = append(h.Value, line[1:]...)
+			continue
+		}
 		// read the first word.
 		sp := bytes.IndexByte(line, ' ')
 		if sp < 0 {
 			return c, errMalformedCommitLine
 		}
-		switch word := string(line[:sp]); word {
+		word := string(line[:sp])
+		if word != "tree" && word != "parent" && word != "author" && word != "committer" {
+			c.ExtraHeaders = append(c.ExtraHeaders, ExtraHeader{
+				Key:   word,
+				Value: append([]byte(nil), line[sp+1:]...),
+			})
+			after = append(after, nstd)
+			continue
+		}
+		nstd++
+		switch word {
 		case "tree":
 			n, err := hex.Decode(c.Tree[:], line[sp+1:])
 			if err != nil || n != len(c.Hash) {
@@ -362,16 +505,176 @@ func parseCommit(s []byte) (c Commit, err error) {
 			c.Author, c.AuthorTime, err = parseAuthor(line[sp+1:])
 		case "committer":
 			c.Committer, c.CommitterTime, err = parseAuthor(line[sp+1:])
-		default:
-			panic("unrecognized commit header " + word)
+		}
+		if err != nil {
+			return c, err
 		}
 	}
+	placeHeaders(c.ExtraHeaders, after, nstd)
 	c.Message = append(c.Message, s...)
 	return c, nil
 }
 
 var errMalformedCommitLine = errors.New("gigot: malformed commit line")
 
+// A Tag represents an annotated tag object.
+type Tag struct {
+	Hash       Hash
+	Object     Hash    // The tagged object.
+	ObjectType ObjType // The type of the tagged object.
+	Name       string  // The name of the tag.
+	Tagger     string  // The email address of the tagger, if any.
+	TaggerTime time.Time
+	// ExtraHeaders lists, in order, the headers not otherwise
+	// represented, like in commits.
+	ExtraHeaders []ExtraHeader
+	Message      []byte // The tag description.
+	Signature    []byte // An optional signature following the description.
+
+	order       []string // the standard headers of a parsed tag, in order.
+	noSeparator bool     // the headers end the object, without a blank line.
+}
+
+// tagHeaders are the standard tag headers, in their usual order.
+var tagHeaders = []string{"object", "type", "tag", "tagger"}
+
+func (t Tag) ID() Hash      { return t.Hash }
+func (t Tag) Type() ObjType { return TAG }
+
+func (t Tag) WriteTo(w io.Writer) error {
+	std := map[string]string{
+		"object": fmt.Sprintf("object %s\n", t.Object),
+		"type":   fmt.Sprintf("type %s\n", t.ObjectType),
+		"tag":    fmt.Sprintf("tag %s\n", t.Name),
+	}
+	if t.Tagger != "" {
+		std["tagger"] = fmt.Sprintf("tagger %s\n", formatAuthor(t.Tagger, t.TaggerTime))
+	}
+	// Headers of parsed tags keep their original order.
+	var lines []string
+	for _, order := range [][]string{t.order, tagHeaders} {
+		for _, key := range order {
+			if line, ok := std[key]; ok {
+				lines = append(lines, line)
+				delete(std, key)
+			}
+		}
+	}
+	buf := new(bytes.Buffer)
+	writeHeaders(buf, lines, t.ExtraHeaders)
+	if !t.noSeparator || len(t.Message) > 0 || len(t.Signature) > 0 {
+		fmt.Fprintf(buf, "\n%s%s", t.Message, t.Signature)
+	}
+
+	fmt.Fprintf(w, "tag %d\x00", buf.Len())
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+var errMalformedTagLine = errors.New("gigot: malformed tag line")
+
+// signatureMarkers are the lines starting a signature appended
+// to a tag description.
+var signatureMarkers = [][]byte{
+	[]byte("-----BEGIN PGP SIGNATURE-----"),
+	[]byte("-----BEGIN PGP MESSAGE-----"),
+	[]byte("-----BEGIN SSH SIGNATURE-----"),
+	[]byte("-----BEGIN SIGNED MESSAGE-----"),
+}
+
+func parseTag(s []byte) (t Tag, err error) {
+	// Reference: git/Documentation/user-manual.txt, Tag object.
+	var seen [3]bool // object, type, tag
+	var after []int  // standard lines preceding each extra header.
+	nstd := 0
+	t.noSeparator = true
+	for len(s) > 0 {
+		i := bytes.IndexByte(s, '\n')
+		if i < 0 {
+			return t, errMalformedTagLine
+		}
+		line := s[:i]
+		s = s[i+1:]
+		if len(line) == 0 {
+			t.noSeparator = false
+			break
+		}
+		if line[0] == ' ' {
+			// continuation of a multi-line extra header.
+			n := len(t.ExtraHeaders)
+			if n == 0 {
+				return t, errMalformedTagLine
+			}
+			h := &t.ExtraHeaders[n-1]
+			h.Value = append(h.Value, '\n')
+			h.Value = append(h.Value, line[1:]...)
+			continue
+		}
+		sp := bytes.IndexByte(line, ' ')
+		if sp < 0 {
+			return t, errMalformedTagLine
+		}
+		word := string(line[:sp])
+		if word != "object" && word != "type" && word != "tag" && word != "tagger" {
+			t.ExtraHeaders = append(t.ExtraHeaders, ExtraHeader{
+				Key:   word,
+				Value: append([]byte(nil), line[sp+1:]...),
+			})
+			after = append(after, nstd)
+			continue
+		}
+		t.order = append(t.order, word)
+		nstd++
+		switch word {
+		case "object":
+			n, err := hex.Decode(t.Object[:], line[sp+1:])
+			if err != nil || n != len(t.Object) || seen[0] {
+				return t, errMalformedTagLine
+			}
+			seen[0] = true
+		case "type":
+			typ, ok := parseType(line[sp+1:])
+			if !ok || seen[1] {
+				return t, errMalformedTagLine
+			}
+			t.ObjectType, seen[1] = typ, true
+		case "tag":
+			if seen[2] {
+				return t, errMalformedTagLine
+			}
+			t.Name, seen[2] = string(line[sp+1:]), true
+		case "tagger":
+			t.Tagger, t.TaggerTime, err = parseAuthor(line[sp+1:])
+			if err != nil {
+				return t, err
+			}
+		}
+	}
+	if seen != [3]bool{true, true, true} {
+		return t, errMalformedTagLine
+	}
+	placeHeaders(t.ExtraHeaders, after, nstd)
+	// The signature starts at the last line beginning with a marker.
+	sig := len(s)
+	for i := 0; i < len(s); {
+		for _, m := range signatureMarkers {
+			if bytes.HasPrefix(s[i:], m) {
+				sig = i
+			}
+		}
+		eol := bytes.IndexByte(s[i:], '\n')
+		if eol < 0 {
+			break
+		}
+		i += eol + 1
+	}
+	t.Message = append(t.Message, s[:sig]...)
+	if sig < len(s) {
+		t.Signature = append(t.Signature, s[sig:]...)
+	}
+	return t, nil
+}
+
 // parseAuthor parses a commit author description.
 func parseAuthor(line []byte) (name string, when time.Time, err error) {
 	// John Doe <john.doe@example.com> UNIXTIME ±0700
@@ -395,7 +698,7 @@ func parseAuthor(line []byte) (name string, when time.Time, err error) {
 		return
 	}
 	z = z[sp1-sp2:]
-	zhour, err := strconv.Atoi(z[1:4])
+	zhour, err := strconv.Atoi(z[2:4])
 	if err != nil {
 		return
 	}
@@ -403,5 +706,38 @@ func parseAuthor(line []byte) (name string, when time.Time, err error) {
 	if err != nil {
 		return
 	}
-	return string(line[:sp2]), time.Unix(unix, 0).In(time.FixedZone(z[1:], zhour*3600+zmin*60)), nil
+	offset := zhour*3600 + zmin*60
+	switch z[1] {
+	case '+':
+	case '-':
+		offset = -offset
+	default:
+		err = errMalformedCommitLine
+		return
+	}
+	return string(line[:sp2]), time.Unix(unix, 0).In(time.FixedZone(z[1:], offset)), nil
+}
+
+// ParseIdent parses an identity followed by a timestamp, as found
+// in commit, tag and reflog lines, such as
+// "John Doe <john.doe@example.com> UNIXTIME ±0700".
+func ParseIdent(line []byte) (name string, when time.Time, err error) {
+	return parseAuthor(line)
+}
+
+// FormatIdent is the inverse of ParseIdent.
+func FormatIdent(name string, when time.Time) string {
+	return formatAuthor(name, when)
+}
+
+// formatAuthor is the inverse of parseAuthor.
+func formatAuthor(name string, when time.Time) string {
+	// Reuse the zone name set by parseAuthor, so that unusual
+	// zones like "-0000" are preserved.
+	zone := when.Format("-0700")
+	loc := when.Location().String()
+	if len(loc) == 5 && (loc[0] == '+' || loc[0] == '-') && loc[1:] == zone[1:] {
+		zone = loc
+	}
+	return fmt.Sprintf("%s %d %s", name, when.Unix(), zone)
 }
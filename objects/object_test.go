@@ -7,8 +7,10 @@ package objects
 import (
 	"bytes"
 	"encoding/hex"
+	"fmt"
 	"os"
 	"testing"
+	"time"
 )
 
 // The three test objects were created by committing a single file
@@ -87,6 +89,263 @@ Hello!
 	}
 }
 
+func TestReadLooseTag(t *testing.T) {
+	f, err := os.Open("testdata/loose-tag-0364b7eeea34fd14ffd473837b0c9b034136889f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := ParseLoose(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag, ok := obj.(Tag)
+	if !ok {
+		t.Fatalf("got %T, expected Tag", obj)
+	}
+	switch {
+	case tag.Object.String() != "cff5570614ef7eb3620e0e98f9938e8ade423e1a":
+		t.Errorf("bad tagged object %s", tag.Object)
+	case tag.ObjectType != COMMIT:
+		t.Errorf("bad tagged type %v, expected %v", tag.ObjectType, COMMIT)
+	case tag.Name != "v1.0":
+		t.Errorf("bad tag name %q", tag.Name)
+	case tag.Tagger != "Rémy Oudompheng <remy@archlinux.org>":
+		t.Errorf("bad tagger %q", tag.Tagger)
+	case string(tag.Message) != "Version 1.0\n":
+		t.Errorf("bad message %q", tag.Message)
+	}
+	// -0330 exercises negative zones with minutes.
+	if _, off := tag.TaggerTime.Zone(); off != -(3*3600 + 30*60) {
+		t.Errorf("bad zone offset %d", off)
+	}
+	if tag.Hash.String() != "0364b7eeea34fd14ffd473837b0c9b034136889f" {
+		t.Errorf("got hash %s, expected %s", tag.Hash,
+			"0364b7eeea34fd14ffd473837b0c9b034136889f")
+	}
+}
+
+func TestTagSignature(t *testing.T) {
+	const data = "object cff5570614ef7eb3620e0e98f9938e8ade423e1a\n" +
+		"type commit\n" +
+		"tag v1.0\n" +
+		"tagger A U Thor <author@example.com> 1112911993 -0000\n" +
+		"\n" +
+		"Version 1.0\n" +
+		"-----BEGIN PGP SIGNATURE-----\n" +
+		"\n" +
+		"iQEcBAABAgAGBQJQ2KqgAAoJEA\n" +
+		"-----END PGP SIGNATURE-----\n"
+	tag, err := parseTag([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(tag.Message) != "Version 1.0\n" {
+		t.Errorf("bad message %q", tag.Message)
+	}
+	if !bytes.HasPrefix(tag.Signature, []byte("-----BEGIN PGP SIGNATURE-----\n")) {
+		t.Errorf("bad signature %q", tag.Signature)
+	}
+	buf := new(bytes.Buffer)
+	tag.WriteTo(buf)
+	expect := fmt.Sprintf("tag %d\x00%s", len(data), data)
+	if buf.String() != expect {
+		t.Errorf("got %q, expected %q", buf, expect)
+	}
+}
+
+func TestTagExtraHeaders(t *testing.T) {
+	const (
+		header = "object cff5570614ef7eb3620e0e98f9938e8ade423e1a\n" +
+			"type commit\n" +
+			"tag v1.0\n"
+		tagger = "tagger A U Thor <author@example.com> 1112911993 -0000\n"
+	)
+	for _, data := range []string{
+		header + tagger + "gpgsig-sha256 a\n b\n\nVersion 1.0\n",
+		header + "x-vendor a\n" + tagger + "\nVersion 1.0\n",
+		// No blank line after the headers.
+		header + tagger,
+		header + tagger + "x-vendor a\n",
+		// A blank line, without a message.
+		header + "\n",
+	} {
+		tag, err := parseTag([]byte(data))
+		if err != nil {
+			t.Errorf("%q: %s", data, err)
+			continue
+		}
+		buf := new(bytes.Buffer)
+		tag.WriteTo(buf)
+		expect := fmt.Sprintf("tag %d\x00%s", len(data), data)
+		if buf.String() != expect {
+			t.Errorf("got %q, expected %q", buf, expect)
+		}
+	}
+
+	tag, err := parseTag([]byte(header + tagger + "gpgsig-sha256 a\n b\n\nVersion 1.0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tag.ExtraHeaders) != 1 || tag.ExtraHeaders[0].Key != "gpgsig-sha256" ||
+		string(tag.ExtraHeaders[0].Value) != "a\nb" || string(tag.Message) != "Version 1.0\n" {
+		t.Errorf("bad tag %+v", tag)
+	}
+}
+
+func TestTagHeaderOrder(t *testing.T) {
+	const (
+		object = "object cff5570614ef7eb3620e0e98f9938e8ade423e1a\n"
+		typ    = "type commit\n"
+		name   = "tag v1.0\n"
+		tagger = "tagger A U Thor <author@example.com> 1112911993 -0000\n"
+	)
+	for _, data := range []string{
+		typ + name + object + tagger + "\nVersion 1.0\n",
+		tagger + object + "x-vendor a\n" + typ + name + "\nVersion 1.0\n",
+		name + typ + object,
+	} {
+		tag, err := parseTag([]byte(data))
+		if err != nil {
+			t.Errorf("%q: %s", data, err)
+			continue
+		}
+		if tag.Name != "v1.0" || tag.ObjectType != COMMIT {
+			t.Errorf("%q: bad tag %+v", data, tag)
+		}
+		buf := new(bytes.Buffer)
+		tag.WriteTo(buf)
+		expect := fmt.Sprintf("tag %d\x00%s", len(data), data)
+		if buf.String() != expect {
+			t.Errorf("got %q, expected %q", buf, expect)
+		}
+	}
+
+	// A tagger added to a parsed tag follows the other headers.
+	tag, _ := parseTag([]byte(name + object + typ + "\nVersion 1.0\n"))
+	tag.Tagger, tag.TaggerTime = "A U Thor <author@example.com>", time.Unix(1112911993, 0).UTC()
+	buf := new(bytes.Buffer)
+	tag.WriteTo(buf)
+	data := name + object + typ +
+		"tagger A U Thor <author@example.com> 1112911993 +0000\n\nVersion 1.0\n"
+	if expect := fmt.Sprintf("tag %d\x00%s", len(data), data); buf.String() != expect {
+		t.Errorf("got %q, expected %q", buf, expect)
+	}
+}
+
+func TestCommitRoundTrip(t *testing.T) {
+	// These commits were created with a signed merge of a signed
+	// tag and with i18n.commitEncoding set to ISO-8859-1.
+	for _, hash := range []string{
+		"cff5570614ef7eb3620e0e98f9938e8ade423e1a",
+		"a8c8db71333f78cdb8cfdaaf1a5b940cda84fc85",
+		"12f5f8ffb189eb51473191ff4c4339bd4fcbc305",
+	} {
+		f, err := os.Open("testdata/loose-commit-" + hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		obj, err := ParseLoose(f)
+		if err != nil {
+			t.Errorf("%s: %s", hash, err)
+			continue
+		}
+		if obj.ID().String() != hash {
+			t.Errorf("got hash %s, expected %s", obj.ID(), hash)
+		}
+	}
+}
+
+func TestCommitExtraHeaders(t *testing.T) {
+	f, err := os.Open("testdata/loose-commit-a8c8db71333f78cdb8cfdaaf1a5b940cda84fc85")
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := ParseLoose(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := obj.(Commit)
+	if len(c.ExtraHeaders) != 2 {
+		t.Fatalf("got %d extra headers, expected 2", len(c.ExtraHeaders))
+	}
+	if c.ExtraHeaders[0].Key != "mergetag" || c.ExtraHeaders[1].Key != "gpgsig" {
+		t.Errorf("bad header order %q, %q", c.ExtraHeaders[0].Key, c.ExtraHeaders[1].Key)
+	}
+	sig := c.Signature()
+	if !bytes.HasPrefix(sig, []byte("-----BEGIN PGP SIGNATURE-----\n\n")) ||
+		!bytes.HasSuffix(sig, []byte("\n-----END PGP SIGNATURE-----")) {
+		t.Errorf("bad signature %q", sig)
+	}
+	tags, err := c.MergeTags()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 1 {
+		t.Fatalf("got %d merge tags, expected 1", len(tags))
+	}
+	if tags[0].Name != "v3" || tags[0].Signature == nil {
+		t.Errorf("bad merge tag %+v", tags[0])
+	}
+	if tags[0].Hash.String() != "ea9e053fa30daaa59c2bcbd5527031e4b592f090" {
+		t.Errorf("got merge tag hash %s, expected %s", tags[0].Hash,
+			"ea9e053fa30daaa59c2bcbd5527031e4b592f090")
+	}
+
+	f, err = os.Open("testdata/loose-commit-12f5f8ffb189eb51473191ff4c4339bd4fcbc305")
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err = ParseLoose(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enc := obj.(Commit).Encoding(); enc != "ISO-8859-1" {
+		t.Errorf("got encoding %q, expected %q", enc, "ISO-8859-1")
+	}
+}
+
+func TestCommitHeaderOrder(t *testing.T) {
+	const (
+		tree   = "tree 58b4ddb9fdc2b2c2b7bc4aa4b3b5e3b8ae4d4bc4\n"
+		parent = "parent cff5570614ef7eb3620e0e98f9938e8ade423e1a\n"
+		author = "author A U Thor <author@example.com> 1112911993 +0200\n" +
+			"committer A U Thor <author@example.com> 1112911993 +0200\n"
+	)
+	for _, data := range []string{
+		// Headers before the author, written by other tools.
+		tree + "encoding ISO-8859-1\n" + parent + "x-vendor a\n b\n" + author +
+			"gpgsig c\n\nMessage\n",
+		// No blank line after the headers.
+		tree + parent + author,
+		tree + author + "encoding ISO-8859-1\n",
+		// A blank line, without a message.
+		tree + author + "\n",
+	} {
+		c, err := parseCommit([]byte(data))
+		if err != nil {
+			t.Errorf("%q: %s", data, err)
+			continue
+		}
+		buf := new(bytes.Buffer)
+		c.WriteTo(buf)
+		expect := fmt.Sprintf("commit %d\x00%s", len(data), data)
+		if buf.String() != expect {
+			t.Errorf("got %q, expected %q", buf, expect)
+		}
+	}
+
+	// Headers of new commits follow the committer line.
+	c, _ := parseCommit([]byte(tree + author))
+	c.ExtraHeaders = append(c.ExtraHeaders, ExtraHeader{Key: "encoding", Value: []byte("UTF-8")})
+	c.Message = []byte("Message\n")
+	buf := new(bytes.Buffer)
+	c.WriteTo(buf)
+	data := tree + author + "encoding UTF-8\n\nMessage\n"
+	if expect := fmt.Sprintf("commit %d\x00%s", len(data), data); buf.String() != expect {
+		t.Errorf("got %q, expected %q", buf, expect)
+	}
+}
+
 func TestWriteTree(t *testing.T) {
 	expect := "tree 58\x00" +
 		"100644 a\x00" + binaryHash("e965047ad7c57865823c7d992b1d046ea66edf78") +
@@ -108,6 +367,36 @@ func TestWriteTree(t *testing.T) {
 	}
 }
 
+func TestWriteTreeModes(t *testing.T) {
+	// A tree with an executable, a symlink, a subtree and a gitlink.
+	expect := "tree 144\x00" +
+		"100644 a\x00" + binaryHash("e965047ad7c57865823c7d992b1d046ea66edf78") +
+		"100755 b\x00" + binaryHash("216e97ce08229b8776d3feb731c6d23a2f669ac8") +
+		"120000 c\x00" + binaryHash("e965047ad7c57865823c7d992b1d046ea66edf78") +
+		"40000 d\x00" + binaryHash("8860cd0334e8b582ec8fe85a99dcc58ad6ee9387") +
+		"160000 e\x00" + binaryHash("cff5570614ef7eb3620e0e98f9938e8ade423e1a")
+	tree, err := parseTree([]byte(expect[9:]))
+	if err != nil {
+		t.Fatal("parse tree:", err)
+	}
+	modes := []os.FileMode{0644, 0755, os.ModeSymlink, os.ModeDir, os.ModeDir | os.ModeSymlink}
+	for i, e := range tree.Entries {
+		if e.Mode != modes[i] {
+			t.Errorf("%s: got mode %v, expected %v", e.Name, e.Mode, modes[i])
+		}
+	}
+	buf := new(bytes.Buffer)
+	tree.WriteTo(buf)
+	if buf.String() != expect {
+		t.Errorf("got %q, expected %q", buf, expect)
+	}
+	h := NewHash([]byte(expect))
+	if h.String() != "12d834050d4783bc67211bd4388847abaabff938" {
+		t.Errorf("got hash %s, expected %s", h,
+			"12d834050d4783bc67211bd4388847abaabff938")
+	}
+}
+
 func TestParseAuthor(t *testing.T) {
 	const exampleLine = "Junio C Hamano <gitster@pobox.com> 1187591163 -0700"
 	name, when, err := parseAuthor([]byte(exampleLine))
@@ -141,5 +430,7 @@ func ExampleParseLoose() {
 		// object is a blob.
 	case Tree:
 		// object is a tree.
+	case Tag:
+		// object is an annotated tag.
 	}
 }
@@ -10,6 +10,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
+	"sync"
 
 	"github.com/remyoudompheng/gigot/gitdelta"
 )
@@ -20,13 +21,36 @@ import (
 // reference.
 
 // A PackReader implements access to Git pack files and indexes.
+//
+// A PackReader is safe for concurrent use by multiple goroutines:
+// the pack and index are only accessed through ReadAt, and the delta
+// cache has its own locking. The Cache field itself must not be
+// changed while the reader is in use.
 type PackReader struct {
-	version   int
-	pack, idx *io.SectionReader
+	version    int
+	idxVersion int
+	pack, idx  *io.SectionReader
 
 	// idxFanout[i] is the number of objects whose first byte
 	// is <= i.
 	idxFanout [256]uint32
+
+	// packData and idxData hold the contents of memory-mapped
+	// pack and index files, or are nil if files are accessed
+	// through ReadAt.
+	packData, idxData []byte
+	close             func() error
+
+	// rev lists the index positions of objects in pack order.
+	// It is read from a .rev file or computed on first use.
+	revOnce sync.Once
+	rev     []uint32
+	revErr  error
+
+	// Cache holds reconstructed delta bases. It is set to a cache of
+	// DefaultDeltaCacheSize bytes by NewPackReader, and may be
+	// replaced or set to nil before the reader is used.
+	Cache *DeltaCache
 }
 
 var (
@@ -34,6 +58,10 @@ var (
 	errBadIdxMagic            = errors.New("gigot: bad magic number in index file")
 	errUnsupportedPackVersion = errors.New("gigot: packfile has unsupported format version")
 	errInvalidPackEntryType   = errors.New("gigot: invalid type for packfile entry")
+	errInvalidDeltaBase       = errors.New("gigot: invalid delta base in packfile")
+	errCorruptedDeltaHeader   = errors.New("gigot: corrupted delta header")
+	errUnsupportedIdxVersion  = errors.New("gigot: index file has unsupported format version")
+	errCorruptedIdx           = errors.New("gigot: corrupted index file")
 )
 
 // NewPackReader creates a PackReader from files pointing to a packfile
@@ -43,7 +71,8 @@ func NewPackReader(pack, idx *io.SectionReader) (*PackReader, error) {
 	if err != nil {
 		return nil, err
 	}
-	pk := &PackReader{version: int(version), pack: pack, idx: idx}
+	pk := &PackReader{version: int(version), pack: pack, idx: idx,
+		Cache: NewDeltaCache(DefaultDeltaCacheSize)}
 	err = pk.checkIdxMagic(idx)
 	if err != nil {
 		return nil, err
@@ -65,85 +94,172 @@ func checkPackMagic(pack *io.SectionReader) (version, count uint32, err error) {
 	if version != 2 {
 		err = errUnsupportedPackVersion
 	}
-	count = binary.BigEndian.Uint32(buf[4:8])
+	count = binary.BigEndian.Uint32(buf[8:12])
 	return
 }
 
-const idxHeaderSize = 4 + 4 + 256*4
+// Index files exist in two versions. Version 1 has no magic number:
+// a fanout table is followed by 24-byte entries made of a 32-bit
+// offset and a hash. Version 2 starts with a magic number and version,
+// followed by the fanout table, the sorted hashes, their CRC32 sums,
+// 31-bit offsets and a table of 64-bit offsets.
+const (
+	idxHeaderSize   = 4 + 4 + 256*4
+	idxV1HeaderSize = 256 * 4
+)
 
 func (pk *PackReader) checkIdxMagic(idx *io.SectionReader) (err error) {
 	var buf [idxHeaderSize]byte
 	_, err = idx.ReadAt(buf[:], 0)
+	if err == io.EOF && idx.Size() >= idxV1HeaderSize {
+		err = nil
+	}
 	if err != nil {
 		return
 	}
+	fanout := buf[8:]
 	magic := [4]byte{buf[0], buf[1], buf[2], buf[3]}
-	if magic != ([4]byte{'\xff', 't', 'O', 'c'}) {
-		return errBadIdxMagic
+	switch {
+	case magic != ([4]byte{'\xff', 't', 'O', 'c'}):
+		pk.idxVersion = 1
+		fanout = buf[:idxV1HeaderSize]
+	case binary.BigEndian.Uint32(buf[4:8]) == 2:
+		pk.idxVersion = 2
+	default:
+		return errUnsupportedIdxVersion
 	}
 	for i := range pk.idxFanout {
-		pk.idxFanout[i] = binary.BigEndian.Uint32(buf[8+4*i:])
+		pk.idxFanout[i] = binary.BigEndian.Uint32(fanout[4*i:])
+		if i > 0 && pk.idxFanout[i] < pk.idxFanout[i-1] {
+			if pk.idxVersion == 1 {
+				// Probably not an index file at all.
+				return errBadIdxMagic
+			}
+			return errCorruptedIdx
+		}
+	}
+	// Entries are followed by the checksums of pack and index.
+	count := int64(pk.idxFanout[0xff])
+	minSize := idxV1HeaderSize + 24*count + 40
+	if pk.idxVersion == 2 {
+		minSize = idxHeaderSize + 28*count + 40
+	}
+	if idx.Size() < minSize {
+		return errCorruptedIdx
 	}
 	return nil
 }
 
-var errNotFoundInPack = errors.New("object does not exist in pack")
+// hashOffset returns the position in the index of the i-th hash.
+func (pk *PackReader) hashOffset(i int64) int64 {
+	if pk.idxVersion == 1 {
+		return idxV1HeaderSize + 24*i + 4
+	}
+	return idxHeaderSize + 20*i
+}
 
-func (pk *PackReader) findObject(hash Hash) (offset int64, err error) {
-	min, max := int64(0), int64(pk.idxFanout[hash[0]])
-	if hash[0] > 0 {
-		min = int64(pk.idxFanout[hash[0]-1])
+// readHashes returns the hashes at positions [min, max) of the index.
+func (pk *PackReader) readHashes(min, max int64) ([]Hash, error) {
+	if max <= min {
+		return nil, nil
+	}
+	stride := int64(20)
+	if pk.idxVersion == 1 {
+		stride = 24
 	}
-	var hmin, hmax [20]byte
-	_, err = pk.idx.ReadAt(hmin[:], idxHeaderSize+min*20)
+	buf := make([]byte, stride*(max-min-1)+20)
+	buf, err := readAt(pk.idx, pk.idxData, buf, pk.hashOffset(min))
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	_, err = pk.idx.ReadAt(hmax[:], idxHeaderSize+max*20)
+	hashes := make([]Hash, max-min)
+	for i := range hashes {
+		copy(hashes[i][:], buf[int64(i)*stride:])
+	}
+	return hashes, nil
+}
+
+var errNotFoundInPack = errors.New("object does not exist in pack")
+
+func (pk *PackReader) findObject(hash Hash) (offset int64, err error) {
+	i, err := pk.findIndex(hash)
 	if err != nil {
 		return 0, err
 	}
-BinarySearch:
+	return pk.offsetAt(i)
+}
+
+// findIndex returns the position of an object in the sorted
+// list of hashes of the index.
+func (pk *PackReader) findIndex(hash Hash) (int64, error) {
+	min, max := int64(0), int64(pk.idxFanout[hash[0]])
+	if hash[0] > 0 {
+		min = int64(pk.idxFanout[hash[0]-1])
+	}
+	// Invariant: if present, hash is at a position in [min, max).
 	for min < max {
-		var hmed [20]byte
+		var buf [20]byte
 		med := (min + max) / 2
-		_, err = pk.idx.ReadAt(hmed[:], idxHeaderSize+med*20)
+		hmed, err := readAt(pk.idx, pk.idxData, buf[:], pk.hashOffset(med))
 		if err != nil {
 			return 0, err
 		}
-		switch cmp := bytes.Compare(hmed[:], hash[:]); true {
+		switch cmp := bytes.Compare(hmed, hash[:]); true {
 		case cmp < 0:
 			min = med + 1
 		case cmp > 0:
-			max = med - 1
+			max = med
 		case cmp == 0:
-			// Found.
-			min, max = med, med
-			break BinarySearch
+			return med, nil
 		}
 	}
-	if min > max {
-		return 0, errNotFoundInPack
-	}
+	return 0, errNotFoundInPack
+}
 
+// offsetAt returns the pack offset of the i-th object in the index.
+func (pk *PackReader) offsetAt(i int64) (offset int64, err error) {
+	var buf [8]byte
+	if pk.idxVersion == 1 {
+		// Offsets are stored before hashes, as 32-bit integers.
+		offb, err := readAt(pk.idx, pk.idxData, buf[:4], idxV1HeaderSize+24*i)
+		if err != nil {
+			return 0, err
+		}
+		return int64(binary.BigEndian.Uint32(offb)), nil
+	}
 	// Read from 32-bit offset table.
 	// The index contains objcount 20-byte hashes, and objcount
 	// 32-bit CRC32 sums.
 	objcount := int64(pk.idxFanout[0xff])
-	var offb [8]byte
-	_, err = pk.idx.ReadAt(offb[:4], idxHeaderSize+24*objcount+4*min)
+	offb, err := readAt(pk.idx, pk.idxData, buf[:4], idxHeaderSize+24*objcount+4*i)
 	if err != nil {
 		return 0, err
 	}
-	off32 := int32(binary.BigEndian.Uint32(offb[:4]))
+	off32 := int32(binary.BigEndian.Uint32(offb))
 	if off32 >= 0 {
 		return int64(off32), nil
 	}
 
-	// Read from 64-bit offset table.
-	_, err = pk.idx.ReadAt(offb[:8], idxHeaderSize+28*objcount+8*min)
-	off64 := int64(binary.BigEndian.Uint64(offb[:]))
-	return off64, err
+	// Read from 64-bit offset table: the low 31 bits are an index
+	// in that table.
+	large := int64(off32 & 0x7fffffff)
+	offb, err = readAt(pk.idx, pk.idxData, buf[:8], idxHeaderSize+28*objcount+8*large)
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(offb)), nil
+}
+
+// Has reports whether the pack contains the object with the given hash.
+func (pk *PackReader) Has(h Hash) (bool, error) {
+	_, err := pk.findIndex(h)
+	switch err {
+	case nil:
+		return true, nil
+	case errNotFoundInPack:
+		return false, nil
+	}
+	return false, err
 }
 
 const (
@@ -162,20 +278,26 @@ const (
 
 // Extract finds and parses an object from a pack.
 func (pk *PackReader) Extract(h Hash) (Object, error) {
-	typ, data, err := pk.extract(h)
+	off, err := pk.findObject(h)
 	if err != nil {
 		return nil, err
 	}
+	return pk.extractObjectAt(off)
+}
+
+// objType returns the object type of a non-delta pack entry type.
+func objType(typ int) (ObjType, error) {
 	switch typ {
 	case pkCommit:
-		return readObject(COMMIT, data)
+		return COMMIT, nil
 	case pkTree:
-		return readObject(TREE, data)
+		return TREE, nil
 	case pkBlob:
-		return readObject(BLOB, data)
+		return BLOB, nil
+	case pkTag:
+		return TAG, nil
 	}
-	println(typ)
-	panic("invalid pack object type")
+	return 0, errInvalidPackEntryType
 }
 
 // extract extracts the raw contents of an object.
@@ -195,36 +317,62 @@ func (pk *PackReader) extract(h Hash) (typ int, data []byte, err error) {
 	return pk.extractAt(off)
 }
 
-func (pk *PackReader) extractAt(off int64) (typ int, data []byte, err error) {
+// readEntryHeader reads the header of the pack entry at offset off,
+// and returns the entry type, its uncompressed size and the length
+// of the header.
+func (pk *PackReader) readEntryHeader(off int64) (typ int, size int64, n int, err error) {
 	var buf [16]byte // 109-bit sizes should be enough for everybody.
-	_, err = pk.pack.ReadAt(buf[:], off)
+	b, err := readAt(pk.pack, pk.packData, buf[:], off)
 	if err == io.EOF || err == io.ErrUnexpectedEOF {
 		err = nil
 	}
 	if err != nil {
 		return
 	}
-	varint, n := binary.Uvarint(buf[:])
-	objsize := int64((varint>>7)<<4 | (varint & 0xf))
-	objtype := int(varint>>4) & 0x7 // 3 bits.
+	varint, n := binary.Uvarint(b)
+	if n <= 0 {
+		return pkBad, 0, 0, errInvalidPackEntryType
+	}
+	size = int64((varint>>7)<<4 | (varint & 0xf))
+	typ = int(varint>>4) & 0x7 // 3 bits.
+	return typ, size, n, nil
+}
+
+// maxDeltaChain bounds the length of delta chains followed when
+// extracting objects, so that corrupt packs with cyclic REF deltas
+// are rejected. Git does not write chains longer than 4095.
+const maxDeltaChain = 10000
 
+func (pk *PackReader) extractAt(off int64) (typ int, data []byte, err error) {
+	return pk.extractChain(off, 0)
+}
+
+// extractChain extracts the entry at offset off, which is at the
+// given depth in a delta chain.
+func (pk *PackReader) extractChain(off int64, depth int) (typ int, data []byte, err error) {
+	objtype, objsize, n, err := pk.readEntryHeader(off)
+	if err != nil {
+		return
+	}
 	switch objtype {
 	case pkCommit, pkTree, pkBlob, pkTag:
 		// objsize is the *uncompressed* size.
 		data = make([]byte, objsize)
 		n, err := readCompressed(pk.pack, off+int64(n), data)
 		return objtype, data[:n], err
-	case pkRefDelta:
-		// Ref delta: parent hash (20 bytes) + deflated delta (objsize bytes)
-		var parent Hash
-		_, err := pk.pack.ReadAt(parent[:], off+int64(n))
+	case pkRefDelta, pkOfsDelta:
+		if depth >= maxDeltaChain {
+			return objtype, data, errInvalidDeltaBase
+		}
+		base, dataOff, err := pk.deltaBase(off, objtype, n)
 		if err != nil {
-			return typ, data, err
+			return objtype, data, err
 		}
 		patch := make([]byte, objsize)
-		_, err = readCompressed(pk.pack, off+int64(n)+20, patch)
-		// FIXME: check that parent object is always in the same pack.
-		typ, data, err = pk.extract(parent)
+		if _, err = readCompressed(pk.pack, dataOff, patch); err != nil {
+			return objtype, data, err
+		}
+		typ, data, err = pk.baseAt(base, depth+1)
 		if err != nil {
 			return typ, patch, err
 		}
@@ -233,44 +381,156 @@ func (pk *PackReader) extractAt(off int64) (typ int, data []byte, err error) {
 			return typ, patch, err
 		}
 		return typ, data, err
+	}
+	return typ, data, errInvalidPackEntryType
+}
+
+// baseAt returns the object at offset off, at the given depth in a
+// delta chain, to be used as a delta base. The result may be shared
+// with the delta cache and must not be modified.
+func (pk *PackReader) baseAt(off int64, depth int) (typ int, data []byte, err error) {
+	if typ, data, ok := pk.Cache.get(off); ok {
+		return typ, data, nil
+	}
+	typ, data, err = pk.extractChain(off, depth)
+	if err == nil {
+		pk.Cache.add(off, typ, data)
+	}
+	return typ, data, err
+}
+
+// deltaBase returns the offset of the base of the delta entry at
+// offset off, whose header has length n, and the offset of the
+// compressed delta data.
+func (pk *PackReader) deltaBase(off int64, typ int, n int) (base, dataOff int64, err error) {
+	switch typ {
+	case pkRefDelta:
+		// Ref delta: parent hash (20 bytes) + deflated delta.
+		// The parent must be in the same pack.
+		var parent Hash
+		b, err := readAt(pk.pack, pk.packData, parent[:], off+int64(n))
+		if err != nil {
+			return 0, 0, err
+		}
+		copy(parent[:], b)
+		base, err = pk.findObject(parent)
+		return base, off + int64(n) + 20, err
 	case pkOfsDelta:
-		// Offset delta: distance to parent (varint bytes) + deflated delta (objsize bytes)
-		parentOff, n2, err := readVaroffset(pk.pack, off+int64(n))
+		// Offset delta: distance to parent (varint bytes) + deflated delta.
+		var buf [16]byte // 109 bits should be enough for everybody.
+		b, err := readAt(pk.pack, pk.packData, buf[:], off+int64(n))
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+		}
 		if err != nil {
-			return objtype, data, err
+			return 0, 0, err
 		}
-		patch := make([]byte, objsize)
-		_, err = readCompressed(pk.pack, off+int64(n+n2), patch)
-		typ, data, err = pk.extractAt(off - parentOff)
+		parentOff, n2, err := readVaroffset(b)
 		if err != nil {
-			return typ, patch, err
+			return 0, 0, err
 		}
-		data, err = gitdelta.Patch(data, patch)
+		if parentOff <= 0 || parentOff > off {
+			return 0, 0, errInvalidDeltaBase
+		}
+		return off - parentOff, off + int64(n+n2), nil
+	}
+	return 0, 0, errInvalidPackEntryType
+}
+
+// Info returns the type and size of an object of the pack. Only
+// headers are read: the size of a deltified object is read from
+// the header of the delta, and its type from the header of the
+// base object at the end of its delta chain.
+func (pk *PackReader) Info(h Hash) (ObjType, int64, error) {
+	off, err := pk.findObject(h)
+	if err == errNotFoundInPack {
+		err = ErrNotFound
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return pk.infoAt(off)
+}
+
+func (pk *PackReader) infoAt(off int64) (ObjType, int64, error) {
+	size := int64(-1)
+	// Delta chains cannot be longer than the number of objects.
+	for i := uint32(0); i <= pk.idxFanout[0xff]; i++ {
+		typ, sz, n, err := pk.readEntryHeader(off)
 		if err != nil {
-			return typ, patch, err
+			return 0, 0, err
 		}
-		return typ, data, err
+		if typ != pkOfsDelta && typ != pkRefDelta {
+			if size < 0 {
+				size = sz
+			}
+			t, err := objType(typ)
+			return t, size, err
+		}
+		base, dataOff, err := pk.deltaBase(off, typ, n)
+		if err != nil {
+			return 0, 0, err
+		}
+		if size < 0 {
+			if size, err = deltaResultSize(pk.pack, dataOff); err != nil {
+				return 0, 0, err
+			}
+		}
+		off = base
 	}
-	return typ, data, errInvalidPackEntryType
+	return 0, 0, errInvalidDeltaBase
 }
 
-// Objects returns the list of hashes of objects stored in this pack.
-func (pk *PackReader) Objects() ([]Hash, error) {
-	count := pk.idxFanout[0xff]
-	buf := make([]byte, 20*count)
-	_, err := pk.idx.ReadAt(buf, idxHeaderSize)
+// deltaResultSize reads the size of the result of a delta from
+// its header, which holds the sizes of the base and result as
+// varints.
+func deltaResultSize(r *io.SectionReader, offset int64) (int64, error) {
+	zr, err := zlib.NewReader(io.NewSectionReader(r, offset, r.Size()-offset))
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-	hashes := make([]Hash, count)
-	for i := range hashes {
-		copy(hashes[i][:], buf[20*i:20*(i+1)])
+	var buf [20]byte
+	n, err := io.ReadFull(zr, buf[:])
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
 	}
-	return hashes, nil
+	if err != nil {
+		return 0, err
+	}
+	_, n1 := binary.Uvarint(buf[:n])
+	if n1 <= 0 {
+		return 0, errCorruptedDeltaHeader
+	}
+	size, n2 := binary.Uvarint(buf[n1:n])
+	if n2 <= 0 {
+		return 0, errCorruptedDeltaHeader
+	}
+	return int64(size), nil
+}
+
+// Objects returns the list of hashes of objects stored in this pack.
+func (pk *PackReader) Objects() ([]Hash, error) {
+	return pk.readHashes(0, int64(pk.idxFanout[0xff]))
 }
 
 // Utility functions.
 
+// readAt reads len(buf) bytes of r at the given offset. If data holds
+// the contents of r, it returns a slice of data instead of copying.
+func readAt(r *io.SectionReader, data, buf []byte, offset int64) ([]byte, error) {
+	if data == nil {
+		n, err := r.ReadAt(buf, offset)
+		return buf[:n], err
+	}
+	if offset < 0 || offset >= int64(len(data)) {
+		return nil, io.EOF
+	}
+	if end := offset + int64(len(buf)); end <= int64(len(data)) {
+		return data[offset:end], nil
+	}
+	return data[offset:], io.EOF
+}
+
 func readVarint(r *io.SectionReader, offset int64) (v int64, n int, err error) {
 	var buf [16]byte // 109 bits should be enough for everybody.
 	_, err = r.ReadAt(buf[:], offset)
@@ -289,17 +549,9 @@ func readVarint(r *io.SectionReader, offset int64) (v int64, n int, err error) {
 // It is a big-endian form: 1|a0, ..., 1|a_{n-1}, 0|a_n.
 // representing:
 //  (a0+1)<<7*n + ... + (a_{n-1}+1)<<7 + a_n
-func readVaroffset(r *io.SectionReader, offset int64) (v int64, n int, err error) {
-	var buf [16]byte // 109 bits should be enough for everybody.
-	n, err = r.ReadAt(buf[:], offset)
-	if err == io.EOF || err == io.ErrUnexpectedEOF {
-		err = nil
-	}
-	if err != nil {
-		return
-	}
+func readVaroffset(buf []byte) (v int64, n int, err error) {
 	u := uint64(0)
-	for i, b := range buf[:n] {
+	for i, b := range buf {
 		if i > 0 {
 			u++
 		}
@@ -7,12 +7,14 @@ package objects
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"testing"
 )
@@ -125,6 +127,33 @@ func TestDisplayPack(t *testing.T) {
 	}
 }
 
+func TestPackInfo(t *testing.T) {
+	pk := getPack(t)
+	hashes, err := pk.Objects()
+	if err != nil {
+		t.Fatal("list pack", err)
+	}
+	deltas := 0
+	for _, h := range hashes {
+		typ, size, err := pk.Info(h)
+		if err != nil {
+			t.Fatal("Info", h, err)
+		}
+		off, _ := pk.findObject(h)
+		if ptyp, _, _, _ := pk.readEntryHeader(off); ptyp == pkOfsDelta || ptyp == pkRefDelta {
+			deltas++
+		}
+		ptyp, data, err := pk.extract(h)
+		if err != nil {
+			t.Fatal("extract", h, err)
+		}
+		if otyp, _ := objType(ptyp); typ != otyp || size != int64(len(data)) {
+			t.Errorf("%s: Info returned %s %d, expected %s %d", h, typ, size, otyp, len(data))
+		}
+	}
+	t.Logf("checked %d objects, %d deltas", len(hashes), deltas)
+}
+
 func prettyPrint(o Object) string {
 	switch o := o.(type) {
 	case Blob:
@@ -139,7 +168,7 @@ func prettyPrint(o Object) string {
 				gitMode(e.Mode), e.Hash, e.Name)
 		}
 		return buf.String()
-	case Commit:
+	case Commit, Tag:
 		buf := new(bytes.Buffer)
 		o.WriteTo(buf)
 		buf.ReadBytes(0)
@@ -180,3 +209,146 @@ func ExamplePackReader_Extract() {
 	}
 	log.Printf("%+v", obj)
 }
+
+func TestOpenPack(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gigot-objects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	objs := testObjects()
+	pack, idx := writeTestPack(t, objs, OfsDelta)
+	base := filepath.Join(dir, "pack-test")
+	if err := ioutil.WriteFile(base+".pack", pack, 0444); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(base+".idx", idx, 0444); err != nil {
+		t.Fatal(err)
+	}
+
+	errMmap := errors.New("cannot map file")
+	defer func() { mmapFile = mmap }()
+	for _, test := range []struct {
+		mapped, mmapFails bool
+	}{{true, false}, {false, false}, {true, true}} {
+		mapped := test.mapped
+		mmapFile = mmap
+		if test.mmapFails {
+			// Packs which cannot be mapped are read using ReadAt.
+			mmapFile = func(f *os.File, size int64) ([]byte, error) { return nil, errMmap }
+		}
+		pk, err := openPack(base, mapped)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mapped && !test.mmapFails && runtime.GOOS == "linux" && (pk.packData == nil || pk.idxData == nil) {
+			t.Errorf("pack is not memory-mapped")
+		}
+		if (!mapped || test.mmapFails) && (pk.packData != nil || pk.idxData != nil) {
+			t.Errorf("pack is mapped in ReadAt mode")
+		}
+		for _, o := range objs {
+			o2, err := pk.Extract(o.ID())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if o2.ID() != o.ID() {
+				t.Errorf("mapped=%v: got %s, expected %s", mapped, o2.ID(), o.ID())
+			}
+		}
+		hashes, err := pk.Objects()
+		if err != nil || len(hashes) != len(objs) {
+			t.Errorf("mapped=%v: Objects returned %d hashes (err=%v), expected %d",
+				mapped, len(hashes), err, len(objs))
+		}
+		if ok, err := pk.Has(Hash{}); ok || err != nil {
+			t.Errorf("mapped=%v: Has reports a missing object (err=%v)", mapped, err)
+		}
+		if err := pk.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := OpenPack(filepath.Join(dir, "pack-missing")); !os.IsNotExist(err) {
+		t.Errorf("got error %v for missing pack, expected not found", err)
+	}
+}
+
+func openTestdataPack(t *testing.T, pname, iname string) *PackReader {
+	pack, err := ioutil.ReadFile(filepath.Join("testdata", pname))
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := ioutil.ReadFile(filepath.Join("testdata", iname))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return openTestPack(t, pack, idx)
+}
+
+func TestIdxV1(t *testing.T) {
+	// Both indexes were produced by git index-pack.
+	pk1 := openTestdataPack(t, "pack-small.pack", "pack-small-v1.idx")
+	pk2 := openTestdataPack(t, "pack-small.pack", "pack-small.idx")
+	if pk1.idxVersion != 1 || pk2.idxVersion != 2 {
+		t.Fatalf("detected index versions %d and %d, expected 1 and 2",
+			pk1.idxVersion, pk2.idxVersion)
+	}
+	hashes1, err := pk1.Objects()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes2, err := pk2.Objects()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes1) != 32 || fmt.Sprint(hashes1) != fmt.Sprint(hashes2) {
+		t.Fatalf("index v1 lists %v, v2 lists %v", hashes1, hashes2)
+	}
+	for _, h := range hashes1 {
+		off1, err1 := pk1.findObject(h)
+		off2, err2 := pk2.findObject(h)
+		if err1 != nil || err2 != nil || off1 != off2 {
+			t.Errorf("%s: found at offsets %d (%v) and %d (%v)", h, off1, err1, off2, err2)
+		}
+		o, err := pk1.Extract(h)
+		if err != nil {
+			t.Errorf("%s: %s", h, err)
+		} else if o.ID() != h {
+			t.Errorf("got %s, expected %s", o.ID(), h)
+		}
+	}
+	prefix := hashes1[0].String()[:4]
+	if found, err := pk1.FindPrefix(prefix); err != nil || len(found) != 1 || found[0] != hashes1[0] {
+		t.Errorf("FindPrefix(%s) = %v, %v, expected %s", prefix, found, err, hashes1[0])
+	}
+	if ok, err := pk1.Has(Hash{}); ok || err != nil {
+		t.Errorf("Has reports a missing object (err=%v)", err)
+	}
+}
+
+func TestIdxVersion(t *testing.T) {
+	pack, err := ioutil.ReadFile("testdata/pack-small.pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := ioutil.ReadFile("testdata/pack-small.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		idx []byte
+		err error
+	}{
+		{append([]byte("\xfftOc\x00\x00\x00\x03"), idx[8:]...), errUnsupportedIdxVersion},
+		{idx[:len(idx)-41], errCorruptedIdx},
+		{bytes.Repeat([]byte("garbage!"), 250), errBadIdxMagic},
+	} {
+		_, err := NewPackReader(
+			io.NewSectionReader(bytes.NewReader(pack), 0, int64(len(pack))),
+			io.NewSectionReader(bytes.NewReader(test.idx), 0, int64(len(test.idx))))
+		if err != test.err {
+			t.Errorf("got error %v, expected %v", err, test.err)
+		}
+	}
+}
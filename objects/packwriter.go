@@ -0,0 +1,349 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package objects
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"sort"
+
+	"github.com/remyoudompheng/gigot/gitdelta"
+)
+
+// This file implements writing of packfiles and their version 2
+// indexes.
+
+// A DeltaKind selects how a PackWriter encodes deltified objects.
+type DeltaKind int
+
+const (
+	NoDelta  DeltaKind = iota // store all objects whole.
+	OfsDelta                  // refer to delta bases by pack offset.
+	RefDelta                  // refer to delta bases by hash.
+)
+
+// A PackWriter writes a packfile from a stream of objects.
+// The number of objects must be known in advance, since it is
+// recorded in the pack header.
+type PackWriter struct {
+	// Delta selects the delta encoding of objects.
+	Delta DeltaKind
+	// Window is the number of preceding objects of the same type
+	// considered as delta bases.
+	Window int
+	// MaxDepth is the maximal length of delta chains.
+	MaxDepth int
+
+	w      io.Writer
+	sum    hash.Hash // checksum of the whole pack.
+	crc    hash.Hash32
+	offset int64
+	count  uint32
+	err    error
+
+	entries  []packEntry
+	seen     map[Hash]bool
+	window   []deltaBase
+	checksum Hash
+	closed   bool
+}
+
+// packEntry describes an object written to the pack.
+type packEntry struct {
+	Hash   Hash
+	Offset int64
+	CRC    uint32
+}
+
+// deltaBase is a recently written object usable as a delta base.
+type deltaBase struct {
+	Hash   Hash
+	Offset int64
+	Type   ObjType
+	Data   []byte
+	Depth  int
+}
+
+var (
+	errPackCountMismatch   = errors.New("gigot: wrong number of objects written to pack")
+	errDuplicatePackObject = errors.New("gigot: object written twice to pack")
+	errPackNotClosed       = errors.New("gigot: pack is not closed")
+)
+
+// NewPackWriter returns a PackWriter writing a pack of count
+// objects to w. Objects are stored whole unless the Delta field
+// is set.
+func NewPackWriter(w io.Writer, count uint32) *PackWriter {
+	pw := &PackWriter{
+		Window:   10,
+		MaxDepth: 50,
+		sum:      sha1.New(),
+		crc:      crc32.NewIEEE(),
+		count:    count,
+		seen:     make(map[Hash]bool, count),
+	}
+	pw.w = io.MultiWriter(w, pw.sum, pw.crc)
+	var hdr [12]byte
+	copy(hdr[:4], "PACK")
+	binary.BigEndian.PutUint32(hdr[4:8], 2)
+	binary.BigEndian.PutUint32(hdr[8:12], count)
+	pw.write(hdr[:])
+	return pw
+}
+
+func (pw *PackWriter) write(p []byte) {
+	if pw.err != nil {
+		return
+	}
+	n, err := pw.w.Write(p)
+	pw.offset += int64(n)
+	pw.err = err
+}
+
+// objectData returns the serialized contents of an object,
+// without the loose object header, and its hash.
+func objectData(o Object) (data []byte, h Hash, err error) {
+	buf := new(bytes.Buffer)
+	if err = o.WriteTo(buf); err != nil {
+		return
+	}
+	data = buf.Bytes()
+	h = NewHash(data)
+	nul := bytes.IndexByte(data, 0)
+	if nul < 0 {
+		err = errCorruptedObjectHeader
+		return
+	}
+	return data[nul+1:], h, nil
+}
+
+// packType returns the pack entry type for an object type.
+func packType(t ObjType) int {
+	switch t {
+	case BLOB:
+		return pkBlob
+	case TREE:
+		return pkTree
+	case COMMIT:
+		return pkCommit
+	case TAG:
+		return pkTag
+	}
+	return pkBad
+}
+
+// WriteObject appends an object to the pack.
+func (pw *PackWriter) WriteObject(o Object) error {
+	if pw.err != nil {
+		return pw.err
+	}
+	if uint32(len(pw.entries)) >= pw.count {
+		return errPackCountMismatch
+	}
+	typ := packType(o.Type())
+	if typ == pkBad {
+		return errInvalidType(o.Type().String())
+	}
+	data, h, err := objectData(o)
+	if err != nil {
+		return err
+	}
+	if pw.seen[h] {
+		return errDuplicatePackObject
+	}
+	pw.seen[h] = true
+
+	entry := packEntry{Hash: h, Offset: pw.offset}
+	pw.crc.Reset()
+	base, delta := pw.findDelta(o.Type(), data)
+	depth := 0
+	switch {
+	case base == nil:
+		pw.write(appendEntryHeader(nil, typ, len(data)))
+		pw.writeCompressed(data)
+	case pw.Delta == OfsDelta:
+		hdr := appendEntryHeader(nil, pkOfsDelta, len(delta))
+		hdr = appendVaroffset(hdr, entry.Offset-base.Offset)
+		pw.write(hdr)
+		pw.writeCompressed(delta)
+		depth = base.Depth + 1
+	case pw.Delta == RefDelta:
+		hdr := appendEntryHeader(nil, pkRefDelta, len(delta))
+		hdr = append(hdr, base.Hash[:]...)
+		pw.write(hdr)
+		pw.writeCompressed(delta)
+		depth = base.Depth + 1
+	}
+	if pw.err != nil {
+		return pw.err
+	}
+	entry.CRC = pw.crc.Sum32()
+	pw.entries = append(pw.entries, entry)
+
+	if pw.Delta != NoDelta && pw.Window > 0 {
+		if len(pw.window) >= pw.Window {
+			copy(pw.window, pw.window[1:])
+			pw.window = pw.window[:len(pw.window)-1]
+		}
+		pw.window = append(pw.window, deltaBase{
+			Hash: h, Offset: entry.Offset,
+			Type: o.Type(), Data: data, Depth: depth,
+		})
+	}
+	return nil
+}
+
+// findDelta selects the best delta base in the window for data.
+// It returns a nil base if storing the object whole is preferable.
+func (pw *PackWriter) findDelta(t ObjType, data []byte) (base *deltaBase, delta []byte) {
+	if pw.Delta == NoDelta || len(data) < 64 {
+		return nil, nil
+	}
+	// Like Git, only accept deltas smaller than half the object.
+	best := len(data)/2 - 20
+	for i := len(pw.window) - 1; i >= 0; i-- {
+		b := &pw.window[i]
+		if b.Type != t || b.Depth >= pw.MaxDepth || len(b.Data) == 0 {
+			continue
+		}
+		d := gitdelta.Diff(b.Data, data)
+		if len(d) < best {
+			base, delta, best = b, d, len(d)
+		}
+	}
+	return base, delta
+}
+
+func (pw *PackWriter) writeCompressed(data []byte) {
+	if pw.err != nil {
+		return
+	}
+	buf := new(bytes.Buffer)
+	zw := zlib.NewWriter(buf)
+	zw.Write(data)
+	zw.Close()
+	pw.write(buf.Bytes())
+}
+
+// Close writes the pack trailer. It does not close the
+// underlying writer.
+func (pw *PackWriter) Close() error {
+	if pw.closed {
+		return pw.err
+	}
+	pw.closed = true
+	if pw.err != nil {
+		return pw.err
+	}
+	if uint32(len(pw.entries)) != pw.count {
+		pw.err = errPackCountMismatch
+		return pw.err
+	}
+	pw.sum.Sum(pw.checksum[:0])
+	n, err := pw.w.Write(pw.checksum[:])
+	pw.offset += int64(n)
+	pw.err = err
+	return err
+}
+
+// Checksum returns the SHA-1 checksum of the pack, which Git uses
+// to name pack files. It is only valid after Close.
+func (pw *PackWriter) Checksum() Hash {
+	return pw.checksum
+}
+
+// WriteIndex writes a version 2 index for the pack to w.
+// It must be called after Close.
+func (pw *PackWriter) WriteIndex(w io.Writer) error {
+	if !pw.closed {
+		return errPackNotClosed
+	}
+	if pw.err != nil {
+		return pw.err
+	}
+	return writeIdx(w, pw.entries, pw.checksum)
+}
+
+type entriesByHash []packEntry
+
+func (s entriesByHash) Len() int           { return len(s) }
+func (s entriesByHash) Less(i, j int) bool { return bytes.Compare(s[i].Hash[:], s[j].Hash[:]) < 0 }
+func (s entriesByHash) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// writeIdx writes a version 2 pack index.
+//
+// The layout is: magic, version, fanout table, sorted hashes,
+// CRC32 of entries, 32-bit offsets, 64-bit offsets for entries
+// beyond 2GB, pack checksum and index checksum.
+func writeIdx(w io.Writer, entries []packEntry, packsum Hash) error {
+	sorted := make([]packEntry, len(entries))
+	copy(sorted, entries)
+	sort.Sort(entriesByHash(sorted))
+
+	buf := new(bytes.Buffer)
+	buf.WriteString("\xfftOc")
+	binary.Write(buf, binary.BigEndian, uint32(2))
+	var fanout [256]uint32
+	for _, e := range sorted {
+		fanout[e.Hash[0]]++
+	}
+	for i := 1; i < 256; i++ {
+		fanout[i] += fanout[i-1]
+	}
+	binary.Write(buf, binary.BigEndian, fanout[:])
+	for _, e := range sorted {
+		buf.Write(e.Hash[:])
+	}
+	for _, e := range sorted {
+		binary.Write(buf, binary.BigEndian, e.CRC)
+	}
+	var large []uint64
+	for _, e := range sorted {
+		if e.Offset < 1<<31 {
+			binary.Write(buf, binary.BigEndian, uint32(e.Offset))
+		} else {
+			binary.Write(buf, binary.BigEndian, uint32(len(large))|1<<31)
+			large = append(large, uint64(e.Offset))
+		}
+	}
+	binary.Write(buf, binary.BigEndian, large)
+	buf.Write(packsum[:])
+	idxsum := NewHash(buf.Bytes())
+	buf.Write(idxsum[:])
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// appendEntryHeader encodes the type and size of a pack entry,
+// as decoded by extractAt.
+func appendEntryHeader(s []byte, typ int, size int) []byte {
+	b := byte(typ<<4) | byte(size&0xf)
+	size >>= 4
+	for size > 0 {
+		s = append(s, b|0x80)
+		b = byte(size & 0x7f)
+		size >>= 7
+	}
+	return append(s, b)
+}
+
+// appendVaroffset encodes an offset as decoded by readVaroffset.
+func appendVaroffset(s []byte, off int64) []byte {
+	var buf [16]byte
+	i := len(buf) - 1
+	buf[i] = byte(off & 0x7f)
+	for off >>= 7; off > 0; off >>= 7 {
+		off--
+		i--
+		buf[i] = 0x80 | byte(off&0x7f)
+	}
+	return append(s, buf[i:]...)
+}
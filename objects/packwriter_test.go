@@ -0,0 +1,107 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package objects
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+// testObjects returns a set of related objects suitable for
+// delta compression.
+func testObjects() []Object {
+	var objs []Object
+	var parent []Hash
+	text := new(bytes.Buffer)
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(text, "line %d: the quick brown fox jumps over the lazy dog\n", i)
+		blob := Blob{Data: append([]byte(nil), text.Bytes()...)}
+		blob.Hash = rehash(blob)
+		tree := Tree{Entries: []TreeElem{{Name: "file", Mode: 0644, Hash: blob.Hash}}}
+		tree.Hash = rehash(tree)
+		when := time.Unix(1356355981+int64(i)*60, 0).In(time.FixedZone("+0100", 3600))
+		commit := Commit{
+			Tree:          tree.Hash,
+			Parents:       parent,
+			Author:        "A U Thor <author@example.com>",
+			AuthorTime:    when,
+			Committer:     "A U Thor <author@example.com>",
+			CommitterTime: when,
+			Message:       []byte(fmt.Sprintf("Commit number %d\n", i)),
+		}
+		commit.Hash = rehash(commit)
+		parent = []Hash{commit.Hash}
+		objs = append(objs, blob, tree, commit)
+	}
+	return objs
+}
+
+func writeTestPack(t *testing.T, objs []Object, delta DeltaKind) (pack, idx []byte) {
+	packbuf, idxbuf := new(bytes.Buffer), new(bytes.Buffer)
+	pw := NewPackWriter(packbuf, uint32(len(objs)))
+	pw.Delta = delta
+	for _, o := range objs {
+		if err := pw.WriteObject(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := pw.WriteIndex(idxbuf); err != nil {
+		t.Fatal(err)
+	}
+	return packbuf.Bytes(), idxbuf.Bytes()
+}
+
+func openTestPack(t *testing.T, pack, idx []byte) *PackReader {
+	pk, err := NewPackReader(
+		io.NewSectionReader(bytes.NewReader(pack), 0, int64(len(pack))),
+		io.NewSectionReader(bytes.NewReader(idx), 0, int64(len(idx))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pk
+}
+
+func TestPackWriter(t *testing.T) {
+	objs := testObjects()
+	for _, delta := range []DeltaKind{NoDelta, OfsDelta, RefDelta} {
+		pack, idx := writeTestPack(t, objs, delta)
+		t.Logf("delta mode %d: pack is %d bytes", delta, len(pack))
+		pk := openTestPack(t, pack, idx)
+		hashes, err := pk.Objects()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hashes) != len(objs) {
+			t.Errorf("got %d objects, expected %d", len(hashes), len(objs))
+		}
+		for _, o := range objs {
+			o2, err := pk.Extract(o.ID())
+			if err != nil {
+				t.Errorf("delta mode %d: extract %s: %s", delta, o.ID(), err)
+				continue
+			}
+			if o2.ID() != o.ID() || o2.Type() != o.Type() {
+				t.Errorf("delta mode %d: got %s %s, expected %s %s",
+					delta, o2.Type(), o2.ID(), o.Type(), o.ID())
+			}
+		}
+	}
+}
+
+func TestVaroffset(t *testing.T) {
+	for _, off := range []int64{0, 1, 127, 128, 129, 16511, 16512, 1 << 20, 1<<35 + 17} {
+		s := appendVaroffset(nil, off)
+		v, n, err := readVaroffset(s)
+		if err != nil || v != off || n != len(s) {
+			t.Errorf("offset %d: encoded as %x, decoded %d (%d bytes, err=%v)", off, s, v, n, err)
+		}
+	}
+}
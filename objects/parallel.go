@@ -0,0 +1,89 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package objects
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// ExtractMany extracts the objects with the given hashes using
+// the given number of goroutines (GOMAXPROCS if workers <= 0).
+// The result is in the same order as hashes. Objects are extracted
+// in pack order, so that delta bases shared by several objects are
+// usually reconstructed once and then found in the delta cache.
+//
+// If any object cannot be extracted, ExtractMany returns the
+// error of the first such object in hashes.
+func (pk *PackReader) ExtractMany(hashes []Hash, workers int) ([]Object, error) {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	objs := make([]Object, len(hashes))
+	errs := make([]error, len(hashes))
+	jobs := make(packJobs, 0, len(hashes))
+	for i, h := range hashes {
+		off, err := pk.findObject(h)
+		if err == errNotFoundInPack {
+			err = ErrNotFound
+		}
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		jobs = append(jobs, packJob{index: i, off: off})
+	}
+	sort.Sort(jobs)
+
+	queue := make(chan packJob)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				objs[job.index], errs[job.index] = pk.extractObjectAt(job.off)
+			}
+		}()
+	}
+	for _, job := range jobs {
+		queue <- job
+	}
+	close(queue)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return objs, err
+		}
+	}
+	return objs, nil
+}
+
+// extractObjectAt extracts and parses the object at offset off.
+func (pk *PackReader) extractObjectAt(off int64) (Object, error) {
+	typ, data, err := pk.extractAt(off)
+	if err != nil {
+		return nil, err
+	}
+	t, err := objType(typ)
+	if err != nil {
+		return nil, err
+	}
+	return readObject(t, data)
+}
+
+// A packJob is an object to be extracted by ExtractMany.
+type packJob struct {
+	index int // position in the list of hashes.
+	off   int64
+}
+
+type packJobs []packJob
+
+func (s packJobs) Len() int           { return len(s) }
+func (s packJobs) Less(i, j int) bool { return s[i].off < s[j].off }
+func (s packJobs) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,45 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package objects
+
+import (
+	"testing"
+)
+
+func TestExtractMany(t *testing.T) {
+	objs := testObjects()
+	hashes := make([]Hash, len(objs))
+	// Request objects in reverse order.
+	for i, o := range objs {
+		hashes[len(objs)-1-i] = o.ID()
+	}
+	for _, delta := range []DeltaKind{NoDelta, OfsDelta, RefDelta} {
+		pack, idx := writeTestPack(t, objs, delta)
+		pk := openTestPack(t, pack, idx)
+		for _, workers := range []int{0, 1, 4} {
+			res, err := pk.ExtractMany(hashes, workers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, o := range res {
+				if o == nil || o.ID() != hashes[i] {
+					t.Errorf("delta=%d workers=%d: object %d is %v, expected %s",
+						delta, workers, i, o, hashes[i])
+				}
+			}
+		}
+		if delta != NoDelta && pk.Cache.Stats().Hits == 0 {
+			t.Errorf("delta=%d: delta bases were not shared", delta)
+		}
+
+		res, err := pk.ExtractMany([]Hash{hashes[0], {}, hashes[1]}, 2)
+		if err != ErrNotFound {
+			t.Errorf("got error %v for missing object, expected ErrNotFound", err)
+		}
+		if res[0] == nil || res[1] != nil || res[2] == nil {
+			t.Errorf("unexpected result %v with a missing object", res)
+		}
+	}
+}
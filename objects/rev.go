@@ -0,0 +1,212 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package objects
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// This file implements pack reverse indexes, which list the objects
+// of a pack in the order of their offsets. They map offsets to index
+// positions, and give the end of each entry, hence its compressed
+// size.
+//
+// A .rev file has a 12-byte header ("RIDX", version and hash
+// function), the index position of each object in pack order as
+// 32-bit integers, the pack checksum and its own checksum. When no
+// .rev file is present, the reverse index is computed in memory.
+//
+// Cf. Documentation/technical/pack-format.txt in Git sources.
+
+var (
+	errBadRevMagic     = errors.New("gigot: bad magic number in reverse index")
+	errCorruptedRev    = errors.New("gigot: corrupted reverse index")
+	errRevPackMismatch = errors.New("gigot: reverse index does not match pack")
+	errNoObjectAtOff   = errors.New("gigot: no object at pack offset")
+)
+
+// readRevFile reads the reverse index of pk from r.
+func readRevFile(r io.Reader, pk *PackReader) ([]uint32, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	count := int(pk.idxFanout[0xff])
+	if len(data) != 12+4*count+40 {
+		return nil, errCorruptedRev
+	}
+	if string(data[:4]) != "RIDX" {
+		return nil, errBadRevMagic
+	}
+	if binary.BigEndian.Uint32(data[4:8]) != 1 || binary.BigEndian.Uint32(data[8:12]) != 1 {
+		return nil, errCorruptedRev
+	}
+	if NewHash(data[:len(data)-20]) != hashOf(data[len(data)-20:]) {
+		return nil, errCorruptedRev
+	}
+	packsum, err := pk.packChecksum()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(data[12+4*count:len(data)-20], packsum[:]) {
+		return nil, errRevPackMismatch
+	}
+	rev := make([]uint32, count)
+	for i := range rev {
+		rev[i] = binary.BigEndian.Uint32(data[12+4*i:])
+		if int(rev[i]) >= count {
+			return nil, errCorruptedRev
+		}
+	}
+	return rev, nil
+}
+
+// loadRevFile uses the reverse index in the given file, if it exists
+// and is valid, instead of computing it.
+func (pk *PackReader) loadRevFile(path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	rev, err := readRevFile(f, pk)
+	if err != nil {
+		return
+	}
+	pk.revOnce.Do(func() { pk.rev = rev })
+}
+
+// revIndex returns the index positions of objects in pack order.
+func (pk *PackReader) revIndex() ([]uint32, error) {
+	pk.revOnce.Do(func() {
+		entries, err := pk.indexEntries()
+		if err != nil {
+			pk.revErr = err
+			return
+		}
+		idxPos := make(map[Hash]uint32, len(entries))
+		for i, e := range entries {
+			idxPos[e.Hash] = uint32(i)
+		}
+		sort.Sort(entriesByOffset(entries))
+		rev := make([]uint32, len(entries))
+		for i, e := range entries {
+			rev[i] = idxPos[e.Hash]
+		}
+		pk.rev = rev
+	})
+	return pk.rev, pk.revErr
+}
+
+// packPosition returns the rank of the entry at the given offset
+// in pack order.
+func (pk *PackReader) packPosition(rev []uint32, offset int64) (int, error) {
+	var err error
+	k := sort.Search(len(rev), func(k int) bool {
+		off, errk := pk.offsetAt(int64(rev[k]))
+		if errk != nil {
+			err = errk
+		}
+		return off >= offset
+	})
+	if err != nil {
+		return 0, err
+	}
+	if k == len(rev) {
+		return 0, errNoObjectAtOff
+	}
+	off, err := pk.offsetAt(int64(rev[k]))
+	if err != nil {
+		return 0, err
+	}
+	if off != offset {
+		return 0, errNoObjectAtOff
+	}
+	return k, nil
+}
+
+// IndexPosition returns the position in the index of the object
+// stored at the given offset of the pack.
+func (pk *PackReader) IndexPosition(offset int64) (int64, error) {
+	rev, err := pk.revIndex()
+	if err != nil {
+		return 0, err
+	}
+	k, err := pk.packPosition(rev, offset)
+	if err != nil {
+		return 0, err
+	}
+	return int64(rev[k]), nil
+}
+
+// ObjectAt returns the hash of the object stored at the given offset
+// of the pack.
+func (pk *PackReader) ObjectAt(offset int64) (Hash, error) {
+	i, err := pk.IndexPosition(offset)
+	if err != nil {
+		return Hash{}, err
+	}
+	hashes, err := pk.readHashes(i, i+1)
+	if err != nil {
+		return Hash{}, err
+	}
+	return hashes[0], nil
+}
+
+// CompressedSize returns the size of the pack entry of an object,
+// including its header: entries end where the next one in pack
+// order starts.
+func (pk *PackReader) CompressedSize(h Hash) (int64, error) {
+	off, err := pk.findObject(h)
+	if err == errNotFoundInPack {
+		err = ErrNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	rev, err := pk.revIndex()
+	if err != nil {
+		return 0, err
+	}
+	k, err := pk.packPosition(rev, off)
+	if err != nil {
+		return 0, err
+	}
+	end := pk.pack.Size() - 20
+	if k+1 < len(rev) {
+		if end, err = pk.offsetAt(int64(rev[k+1])); err != nil {
+			return 0, err
+		}
+	}
+	return end - off, nil
+}
+
+// WriteReverseIndex writes the reverse index of pk to w, in the
+// format of .rev files.
+func WriteReverseIndex(w io.Writer, pk *PackReader) error {
+	rev, err := pk.revIndex()
+	if err != nil {
+		return err
+	}
+	packsum, err := pk.packChecksum()
+	if err != nil {
+		return err
+	}
+	buf := new(bytes.Buffer)
+	buf.WriteString("RIDX")
+	binary.Write(buf, binary.BigEndian, [2]uint32{1, 1})
+	binary.Write(buf, binary.BigEndian, rev)
+	buf.Write(packsum[:])
+	sum := NewHash(buf.Bytes())
+	buf.Write(sum[:])
+	_, err = w.Write(buf.Bytes())
+	return err
+}
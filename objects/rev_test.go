@@ -0,0 +1,104 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package objects
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteReverseIndex(t *testing.T) {
+	// The .rev file was written by git index-pack --rev-index.
+	ref, err := ioutil.ReadFile("testdata/pack-small.rev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := openTestdataPack(t, "pack-small.pack", "pack-small.idx")
+	buf := new(bytes.Buffer)
+	if err := WriteReverseIndex(buf, pk); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), ref) {
+		t.Errorf("reverse index differs from git output")
+	}
+	pk1 := openTestdataPack(t, "pack-small.pack", "pack-small-v1.idx")
+	rev, err := readRevFile(bytes.NewReader(ref), pk1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev1, _ := pk1.revIndex()
+	if fmt.Sprint(rev) != fmt.Sprint(rev1) {
+		t.Errorf("read %v, computed %v", rev, rev1)
+	}
+	if _, err := readRevFile(bytes.NewReader(ref[:len(ref)-4]), pk1); err != errCorruptedRev {
+		t.Errorf("got error %v for truncated file, expected %v", err, errCorruptedRev)
+	}
+}
+
+func TestReverseIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gigot-objects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, ext := range []string{".pack", ".idx", ".rev"} {
+		data, err := ioutil.ReadFile("testdata/pack-small" + ext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "pack-small"+ext), data, 0444); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pk, err := OpenPack(filepath.Join(dir, "pack-small"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pk.Close()
+	if pk.rev == nil {
+		t.Errorf(".rev file was not loaded")
+	}
+
+	hashes, err := pk.Objects()
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := int64(0)
+	for i, h := range hashes {
+		off, _ := pk.findObject(h)
+		if pos, err := pk.IndexPosition(off); err != nil || pos != int64(i) {
+			t.Errorf("IndexPosition(%d) = %d, %v, expected %d", off, pos, err, i)
+		}
+		if h2, err := pk.ObjectAt(off); err != nil || h2 != h {
+			t.Errorf("ObjectAt(%d) = %s, %v, expected %s", off, h2, err, h)
+		}
+		size, err := pk.CompressedSize(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += size
+	}
+	if total != pk.pack.Size()-12-20 {
+		t.Errorf("compressed sizes add up to %d, expected %d", total, pk.pack.Size()-32)
+	}
+
+	// Value reported by git verify-pack -v.
+	var h Hash
+	hex.Decode(h[:], []byte("454ea7a76784eb736761dd18778b777e221c1ea6"))
+	if size, err := pk.CompressedSize(h); err != nil || size != 128 {
+		t.Errorf("CompressedSize(%s) = %d, %v, expected 128", h, size, err)
+	}
+	if _, err := pk.ObjectAt(13); err != errNoObjectAtOff {
+		t.Errorf("got error %v for invalid offset, expected %v", err, errNoObjectAtOff)
+	}
+	if _, err := pk.CompressedSize(Hash{}); err != ErrNotFound {
+		t.Errorf("got error %v for missing object, expected ErrNotFound", err)
+	}
+}
@@ -0,0 +1,465 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package objects
+
+import (
+	"compress/zlib"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// This file implements object databases, as found in the objects/
+// directory of a Git repository.
+
+// An ObjectStore is a database of Git objects indexed by hash.
+type ObjectStore interface {
+	// Has reports whether the object exists in the store.
+	Has(h Hash) (bool, error)
+	// Get retrieves an object. It returns ErrNotFound if the
+	// object does not exist.
+	Get(h Hash) (Object, error)
+	// Put stores an object and returns its hash.
+	Put(o Object) (Hash, error)
+	// Iterate calls fn for each object in the store, stopping at
+	// the first error returned by fn.
+	Iterate(fn func(Hash) error) error
+}
+
+var (
+	// ErrNotFound is returned when an object is absent from a store.
+	ErrNotFound = errors.New("gigot: object not found")
+
+	errReadOnlyStore = errors.New("gigot: object store is read-only")
+)
+
+// A LooseStore is an object store where each object is stored
+// as a zlib-compressed file named objects/xx/yyyy..., where
+// xxyyyy... is its hexadecimal hash.
+type LooseStore struct {
+	Dir string
+}
+
+// NewLooseStore returns a store for loose objects in the given
+// directory, usually the objects/ directory of a repository.
+func NewLooseStore(dir string) *LooseStore {
+	return &LooseStore{Dir: dir}
+}
+
+var (
+	_ ObjectStore = (*LooseStore)(nil)
+	_ ObjectStore = (*PackReader)(nil)
+	_ ObjectStore = (*Database)(nil)
+)
+
+func (s *LooseStore) path(h Hash) string {
+	hexhash := h.String()
+	return filepath.Join(s.Dir, hexhash[:2], hexhash[2:])
+}
+
+func (s *LooseStore) Has(h Hash) (bool, error) {
+	_, err := os.Stat(s.path(h))
+	switch {
+	case err == nil:
+		return true, nil
+	case os.IsNotExist(err):
+		return false, nil
+	}
+	return false, err
+}
+
+func (s *LooseStore) Get(h Hash) (Object, error) {
+	f, err := os.Open(s.path(h))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParseLoose(f)
+}
+
+// Info returns the type and size of a loose object, decompressing
+// only its header.
+func (s *LooseStore) Info(h Hash) (ObjType, int64, error) {
+	f, err := os.Open(s.path(h))
+	if os.IsNotExist(err) {
+		return 0, 0, ErrNotFound
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	t, size, sr, err := openLoose(f)
+	if err != nil {
+		return 0, 0, err
+	}
+	return t, size, sr.Close()
+}
+
+// Put writes an object in loose format. The object is written to
+// a temporary file which is then renamed, so that concurrent
+// readers never observe partial objects.
+func (s *LooseStore) Put(o Object) (Hash, error) {
+	_, h, err := objectData(o)
+	if err != nil {
+		return h, err
+	}
+	if ok, err := s.Has(h); ok || err != nil {
+		return h, err
+	}
+	dir := filepath.Dir(s.path(h))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return h, err
+	}
+	f, err := ioutil.TempFile(dir, "tmp_obj_")
+	if err != nil {
+		return h, err
+	}
+	zw := zlib.NewWriter(f)
+	err = o.WriteTo(zw)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = f.Chmod(0444)
+	}
+	if errc := f.Close(); err == nil {
+		err = errc
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.path(h))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return h, err
+}
+
+func (s *LooseStore) Iterate(fn func(Hash) error) error {
+	dirs, err := ioutil.ReadDir(s.Dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, d := range dirs {
+		if !d.IsDir() || len(d.Name()) != 2 {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(s.Dir, d.Name()))
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			var h Hash
+			n, err := hex.Decode(h[:], []byte(d.Name()+f.Name()))
+			if err != nil || n != len(h) {
+				// not an object (e.g. a temporary file).
+				continue
+			}
+			if err := fn(h); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Get extracts an object from the pack. A PackReader is a read-only
+// ObjectStore.
+func (pk *PackReader) Get(h Hash) (Object, error) {
+	o, err := pk.Extract(h)
+	if err == errNotFoundInPack {
+		err = ErrNotFound
+	}
+	return o, err
+}
+
+// Put always fails: packs are immutable.
+func (pk *PackReader) Put(o Object) (Hash, error) {
+	return Hash{}, errReadOnlyStore
+}
+
+func (pk *PackReader) Iterate(fn func(Hash) error) error {
+	hashes, err := pk.Objects()
+	if err != nil {
+		return err
+	}
+	for _, h := range hashes {
+		if err := fn(h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A Database is the object store of a repository: it looks up
+// objects among loose objects and every pack in the pack/
+// subdirectory. New objects are written as loose objects.
+//
+// If the pack directory has a multi-pack-index, objects of the packs
+// it covers are looked up using it. The commit-graph of the
+// database, if any, is opened as CommitGraph.
+type Database struct {
+	Loose       *LooseStore
+	Packs       []*PackReader
+	MultiIndex  *MultiPackIndex
+	CommitGraph *CommitGraph
+
+	midxPacks []*PackReader // packs of MultiIndex, by pack number.
+	unindexed []*PackReader // packs not covered by MultiIndex.
+}
+
+// OpenDatabase opens the object database stored in dir, usually
+// the objects/ directory of a repository.
+func OpenDatabase(dir string) (*Database, error) {
+	db := &Database{Loose: NewLooseStore(dir)}
+	packs, err := filepath.Glob(filepath.Join(dir, "pack", "pack-*.pack"))
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]*PackReader, len(packs))
+	for _, name := range packs {
+		base := strings.TrimSuffix(name, ".pack")
+		pk, err := OpenPack(base)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		db.Packs = append(db.Packs, pk)
+		byName[filepath.Base(base)+".idx"] = pk
+	}
+	db.openMultiIndex(filepath.Join(dir, "pack", "multi-pack-index"), byName)
+	// Like in Git, a missing or unusable commit-graph is ignored.
+	if g, err := OpenCommitGraph(dir); err == nil {
+		db.CommitGraph = g
+	}
+	return db, nil
+}
+
+// openMultiIndex opens the multi-pack-index at path, given the packs
+// of the database by index name. Like in Git, a missing or unusable
+// multi-pack-index is ignored.
+func (db *Database) openMultiIndex(path string, byName map[string]*PackReader) {
+	m, err := OpenMultiPackIndex(path)
+	if err != nil {
+		return
+	}
+	indexed := make(map[*PackReader]bool)
+	for _, name := range m.PackNames() {
+		pk := byName[name]
+		if pk == nil {
+			m.Close()
+			db.midxPacks = nil
+			return
+		}
+		db.midxPacks = append(db.midxPacks, pk)
+		indexed[pk] = true
+	}
+	for _, pk := range db.Packs {
+		if !indexed[pk] {
+			db.unindexed = append(db.unindexed, pk)
+		}
+	}
+	db.MultiIndex = m
+}
+
+// findPacked returns the pack holding an object and its offset,
+// or ErrNotFound.
+func (db *Database) findPacked(h Hash) (*PackReader, int64, error) {
+	packs := db.Packs
+	if db.MultiIndex != nil {
+		pack, off, err := db.MultiIndex.Find(h)
+		if err == nil {
+			return db.midxPacks[pack], off, nil
+		}
+		if err != ErrNotFound {
+			return nil, 0, err
+		}
+		packs = db.unindexed
+	}
+	for _, pk := range packs {
+		off, err := pk.findObject(h)
+		if err != errNotFoundInPack {
+			return pk, off, err
+		}
+	}
+	return nil, 0, ErrNotFound
+}
+
+// Close releases the files held by the database.
+func (db *Database) Close() error {
+	var err error
+	if db.MultiIndex != nil {
+		err = db.MultiIndex.Close()
+	}
+	if db.CommitGraph != nil {
+		if errc := db.CommitGraph.Close(); err == nil {
+			err = errc
+		}
+	}
+	for _, pk := range db.Packs {
+		if errc := pk.Close(); err == nil {
+			err = errc
+		}
+	}
+	db.Packs, db.MultiIndex, db.CommitGraph = nil, nil, nil
+	db.midxPacks, db.unindexed = nil, nil
+	return err
+}
+
+func (db *Database) Has(h Hash) (bool, error) {
+	_, _, err := db.findPacked(h)
+	switch err {
+	case nil:
+		return true, nil
+	case ErrNotFound:
+		return db.Loose.Has(h)
+	}
+	return false, err
+}
+
+func (db *Database) Get(h Hash) (Object, error) {
+	pk, off, err := db.findPacked(h)
+	switch err {
+	case nil:
+		return pk.extractObjectAt(off)
+	case ErrNotFound:
+		return db.Loose.Get(h)
+	}
+	return nil, err
+}
+
+// Info returns the type and size of an object of the database,
+// without reading its contents.
+func (db *Database) Info(h Hash) (ObjType, int64, error) {
+	pk, off, err := db.findPacked(h)
+	switch err {
+	case nil:
+		return pk.infoAt(off)
+	case ErrNotFound:
+		return db.Loose.Info(h)
+	}
+	return 0, 0, err
+}
+
+func (db *Database) Put(o Object) (Hash, error) {
+	_, h, err := objectData(o)
+	if err != nil {
+		return h, err
+	}
+	if ok, err := db.Has(h); ok || err != nil {
+		return h, err
+	}
+	return db.Loose.Put(o)
+}
+
+// Iterate calls fn for each object of the database. Objects
+// stored in several places are only visited once.
+func (db *Database) Iterate(fn func(Hash) error) error {
+	seen := make(map[Hash]bool)
+	visit := func(h Hash) error {
+		if seen[h] {
+			return nil
+		}
+		seen[h] = true
+		return fn(h)
+	}
+	for _, pk := range db.Packs {
+		if err := pk.Iterate(visit); err != nil {
+			return err
+		}
+	}
+	return db.Loose.Iterate(visit)
+}
+
+var errShortPrefix = errors.New("gigot: hash prefix is too short")
+
+// FindPrefix returns the hashes of the loose objects whose
+// hexadecimal form starts with prefix, which must have at least
+// 2 characters.
+func (s *LooseStore) FindPrefix(prefix string) ([]Hash, error) {
+	if len(prefix) < 2 {
+		return nil, errShortPrefix
+	}
+	prefix = strings.ToLower(prefix)
+	files, err := ioutil.ReadDir(filepath.Join(s.Dir, prefix[:2]))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var hashes []Hash
+	for _, f := range files {
+		name := prefix[:2] + f.Name()
+		var h Hash
+		n, err := hex.Decode(h[:], []byte(name))
+		if err != nil || n != len(h) || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		hashes = append(hashes, h)
+	}
+	return hashes, nil
+}
+
+// FindPrefix returns the hashes of the objects of the pack whose
+// hexadecimal form starts with prefix, which must have at least
+// 2 characters.
+func (pk *PackReader) FindPrefix(prefix string) ([]Hash, error) {
+	if len(prefix) < 2 {
+		return nil, errShortPrefix
+	}
+	prefix = strings.ToLower(prefix)
+	b, err := hex.DecodeString(prefix[:2])
+	if err != nil {
+		return nil, nil
+	}
+	min, max := int64(0), int64(pk.idxFanout[b[0]])
+	if b[0] > 0 {
+		min = int64(pk.idxFanout[b[0]-1])
+	}
+	candidates, err := pk.readHashes(min, max)
+	if err != nil {
+		return nil, err
+	}
+	var hashes []Hash
+	for _, h := range candidates {
+		if strings.HasPrefix(h.String(), prefix) {
+			hashes = append(hashes, h)
+		}
+	}
+	return hashes, nil
+}
+
+// FindPrefix returns the hashes of the objects of the database
+// whose hexadecimal form starts with prefix, which must have at
+// least 2 characters.
+func (db *Database) FindPrefix(prefix string) ([]Hash, error) {
+	seen := make(map[Hash]bool)
+	var hashes []Hash
+	add := func(hs []Hash, err error) error {
+		for _, h := range hs {
+			if !seen[h] {
+				seen[h] = true
+				hashes = append(hashes, h)
+			}
+		}
+		return err
+	}
+	for _, pk := range db.Packs {
+		if err := add(pk.FindPrefix(prefix)); err != nil {
+			return nil, err
+		}
+	}
+	if err := add(db.Loose.FindPrefix(prefix)); err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
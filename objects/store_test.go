@@ -0,0 +1,124 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package objects
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLooseStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gigot-objects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewLooseStore(dir)
+	objs := testObjects()
+	for _, o := range objs {
+		h, err := s.Put(o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h != o.ID() {
+			t.Errorf("Put returned %s, expected %s", h, o.ID())
+		}
+	}
+	for _, o := range objs {
+		o2, err := s.Get(o.ID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if o2.ID() != o.ID() {
+			t.Errorf("got %s, expected %s", o2.ID(), o.ID())
+		}
+	}
+	count := 0
+	s.Iterate(func(h Hash) error {
+		count++
+		return nil
+	})
+	if count != len(objs) {
+		t.Errorf("iterated over %d objects, expected %d", count, len(objs))
+	}
+	if _, err := s.Get(Hash{}); err != ErrNotFound {
+		t.Errorf("got error %v for missing object, expected ErrNotFound", err)
+	}
+	for _, o := range objs {
+		typ, size, err := s.Info(o.ID())
+		data, _, _ := objectData(o)
+		if err != nil || typ != o.Type() || size != int64(len(data)) {
+			t.Errorf("Info(%s) = %s, %d, %v, expected %s, %d",
+				o.ID(), typ, size, err, o.Type(), len(data))
+		}
+	}
+}
+
+func TestDatabase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gigot-objects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Store half the objects in a pack, and the rest as loose objects.
+	objs := testObjects()
+	packed, loose := objs[:len(objs)/2], objs[len(objs)/2:]
+	pack, idx := writeTestPack(t, packed, OfsDelta)
+	os.Mkdir(filepath.Join(dir, "pack"), 0755)
+	base := filepath.Join(dir, "pack", "pack-test")
+	if err := ioutil.WriteFile(base+".pack", pack, 0444); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(base+".idx", idx, 0444); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := OpenDatabase(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, o := range loose {
+		if _, err := db.Put(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, o := range objs {
+		ok, err := db.Has(o.ID())
+		if !ok || err != nil {
+			t.Errorf("Has(%s) = %v, %v", o.ID(), ok, err)
+		}
+		o2, err := db.Get(o.ID())
+		if err != nil {
+			t.Errorf("Get(%s): %s", o.ID(), err)
+		} else if o2.ID() != o.ID() {
+			t.Errorf("got %s, expected %s", o2.ID(), o.ID())
+		}
+		typ, size, err := db.Info(o.ID())
+		data, _, _ := objectData(o)
+		if err != nil || typ != o.Type() || size != int64(len(data)) {
+			t.Errorf("Info(%s) = %s, %d, %v, expected %s, %d",
+				o.ID(), typ, size, err, o.Type(), len(data))
+		}
+	}
+	count := 0
+	db.Iterate(func(h Hash) error {
+		count++
+		return nil
+	})
+	if count != len(objs) {
+		t.Errorf("iterated over %d objects, expected %d", count, len(objs))
+	}
+	if ok, _ := db.Has(Hash{}); ok {
+		t.Errorf("Has reports a missing object")
+	}
+	if _, err := db.Get(Hash{1}); err != ErrNotFound {
+		t.Errorf("got error %v for missing object, expected ErrNotFound", err)
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package objects
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// This file implements streaming access to object contents, so
+// that large blobs can be read without holding them in memory.
+//
+// OpenObject returns the type and size of an object after reading
+// its header only: callers which only need this information can
+// close the reader immediately.
+
+// A streamReader reads the contents of an object, and fails if
+// they are shorter than the size announced by the header.
+type streamReader struct {
+	r      io.Reader
+	remain int64
+	close  func() error
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	if s.remain <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > s.remain {
+		p = p[:s.remain]
+	}
+	n, err := s.r.Read(p)
+	s.remain -= int64(n)
+	switch {
+	case err == io.EOF && s.remain > 0, err == io.ErrUnexpectedEOF:
+		err = errObjectSizeMismatch
+	case err == io.EOF:
+		err = nil
+	}
+	return n, err
+}
+
+func (s *streamReader) Close() error {
+	if s.close == nil {
+		return nil
+	}
+	return s.close()
+}
+
+// OpenObject returns the type and size of a loose object, and
+// a reader streaming its contents, which must be closed after use.
+func (s *LooseStore) OpenObject(h Hash) (ObjType, int64, io.ReadCloser, error) {
+	f, err := os.Open(s.path(h))
+	if os.IsNotExist(err) {
+		return 0, 0, nil, ErrNotFound
+	}
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	t, size, sr, err := openLoose(f)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	return t, size, sr, nil
+}
+
+// OpenObject returns the type and size of an object of the pack,
+// and a reader for its contents, which must be closed after use.
+// The contents of undeltified entries are decompressed as they are
+// read; deltified entries are reconstructed in memory.
+func (pk *PackReader) OpenObject(h Hash) (ObjType, int64, io.ReadCloser, error) {
+	off, err := pk.findObject(h)
+	if err == errNotFoundInPack {
+		err = ErrNotFound
+	}
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	return pk.openObjectAt(off)
+}
+
+// openObjectAt is like OpenObject for the entry at offset off.
+func (pk *PackReader) openObjectAt(off int64) (ObjType, int64, io.ReadCloser, error) {
+	typ, size, n, err := pk.readEntryHeader(off)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if typ == pkOfsDelta || typ == pkRefDelta {
+		typ, data, err := pk.extractAt(off)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		t, err := objType(typ)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		return t, int64(len(data)), ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+	t, err := objType(typ)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	start := off + int64(n)
+	zr, err := zlib.NewReader(io.NewSectionReader(pk.pack, start, pk.pack.Size()-start))
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	return t, size, &streamReader{r: zr, remain: size, close: zr.Close}, nil
+}
+
+// OpenObject returns the type and size of an object of the
+// database, and a reader for its contents, which must be closed
+// after use.
+func (db *Database) OpenObject(h Hash) (ObjType, int64, io.ReadCloser, error) {
+	pk, off, err := db.findPacked(h)
+	switch err {
+	case nil:
+		return pk.openObjectAt(off)
+	case ErrNotFound:
+		return db.Loose.OpenObject(h)
+	}
+	return 0, 0, nil, err
+}
@@ -0,0 +1,117 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package objects
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+// largeBlob returns a blob of n pseudo-random bytes.
+func largeBlob(n int) Blob {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(1)).Read(data)
+	b := Blob{Data: data}
+	b.Hash = rehash(b)
+	return b
+}
+
+// checkStream reads an object from OpenObject and checks its hash.
+func checkStream(t *testing.T, o Object, typ ObjType, size int64, r io.ReadCloser) {
+	defer r.Close()
+	if typ != o.Type() {
+		t.Errorf("%s: got type %s, expected %s", o.ID(), typ, o.Type())
+	}
+	h := sha1.New()
+	fmt.Fprintf(h, "%s %d\x00", typ, size)
+	n, err := io.Copy(h, r)
+	if err != nil {
+		t.Fatalf("%s: %s", o.ID(), err)
+	}
+	if n != size {
+		t.Errorf("%s: read %d bytes, expected %d", o.ID(), n, size)
+	}
+	var sum Hash
+	h.Sum(sum[:0])
+	if sum != o.ID() {
+		t.Errorf("%s: streamed contents have hash %s", o.ID(), sum)
+	}
+}
+
+func TestOpenObject(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gigot-objects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	big := largeBlob(1 << 20)
+	objs := append(testObjects(), big)
+	s := NewLooseStore(dir)
+	for _, o := range objs {
+		if _, err := s.Put(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, o := range objs {
+		typ, size, r, err := s.OpenObject(o.ID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkStream(t, o, typ, size, r)
+	}
+
+	// Packed objects, with deltas.
+	pack, idx := writeTestPack(t, objs, OfsDelta)
+	pk := openTestPack(t, pack, idx)
+	for _, o := range objs {
+		typ, size, r, err := pk.OpenObject(o.ID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkStream(t, o, typ, size, r)
+	}
+
+	// Header only.
+	typ, size, r, err := pk.OpenObject(big.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if typ != BLOB || size != 1<<20 {
+		t.Errorf("got %s of size %d, expected blob of size %d", typ, size, 1<<20)
+	}
+	if _, _, _, err := s.OpenObject(Hash{}); err != ErrNotFound {
+		t.Errorf("got error %v for missing object, expected ErrNotFound", err)
+	}
+	if _, _, _, err := pk.OpenObject(Hash{}); err != ErrNotFound {
+		t.Errorf("got error %v for missing object, expected ErrNotFound", err)
+	}
+}
+
+func TestLooseSizeMismatch(t *testing.T) {
+	for _, data := range []string{
+		"blob 10\x00short",
+		"blob 2\x00long",
+		// Huge sizes are not allocated.
+		"blob 9000000000000000000\x00short",
+	} {
+		var buf bytes.Buffer
+		zw := zlib.NewWriter(&buf)
+		zw.Write([]byte(data))
+		zw.Close()
+		_, _, err := readLoose(ioutil.NopCloser(&buf))
+		if err != errObjectSizeMismatch {
+			t.Errorf("%q: got error %v, expected %v", data, err, errObjectSizeMismatch)
+		}
+	}
+}
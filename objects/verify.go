@@ -0,0 +1,211 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package objects
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+)
+
+// This file implements integrity checks of packs, like
+// git verify-pack.
+
+var (
+	errPackTrailer      = errors.New("gigot: pack checksum does not match pack contents")
+	errIdxTrailer       = errors.New("gigot: index checksum does not match index contents")
+	errIdxPackChecksum  = errors.New("gigot: index refers to a different pack checksum")
+	errPackCount        = errors.New("gigot: pack header and index disagree on object count")
+	errEntryCRC         = errors.New("gigot: CRC32 mismatch for pack entry")
+	errEntryHash        = errors.New("gigot: object contents do not match its hash")
+	errEntryOutOfBounds = errors.New("gigot: index offset is outside the pack")
+)
+
+// A PackError is a problem found by Verify. Hash is zero for
+// problems concerning the pack as a whole.
+type PackError struct {
+	Hash   Hash
+	Offset int64
+	Err    error
+}
+
+func (e PackError) Error() string {
+	if e.Hash == (Hash{}) {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s (object %s at offset %d)", e.Err, e.Hash, e.Offset)
+}
+
+// A VerifyError lists all problems found by Verify.
+type VerifyError []PackError
+
+func (e VerifyError) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d other errors)", e[0], len(e)-1)
+}
+
+// Verify checks the integrity of the pack and its index: the
+// checksums of both files, the object count, the CRC32 of each entry
+// (for version 2 indexes) and the hash of each object. It returns
+// nil or a VerifyError listing every problem found.
+func (pk *PackReader) Verify() error {
+	var errs VerifyError
+	fail := func(h Hash, off int64, err error) {
+		errs = append(errs, PackError{Hash: h, Offset: off, Err: err})
+	}
+
+	packsum, err := checkTrailer(pk.pack, pk.packData)
+	switch err {
+	case nil:
+	case errBadChecksum:
+		fail(Hash{}, 0, errPackTrailer)
+	default:
+		return err
+	}
+	_, err = checkTrailer(pk.idx, pk.idxData)
+	switch err {
+	case nil:
+	case errBadChecksum:
+		fail(Hash{}, 0, errIdxTrailer)
+	default:
+		return err
+	}
+	var idxPacksum Hash
+	b, err := readAt(pk.idx, pk.idxData, idxPacksum[:], pk.idx.Size()-40)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(b, packsum[:]) {
+		fail(Hash{}, 0, errIdxPackChecksum)
+	}
+	_, count, err := checkPackMagic(pk.pack)
+	if err != nil {
+		return err
+	}
+	if count != pk.idxFanout[0xff] {
+		fail(Hash{}, 0, errPackCount)
+	}
+
+	// Check entries in pack order: entries end where the next one
+	// starts, and bases are extracted before deltas.
+	entries, err := pk.indexEntries()
+	if err != nil {
+		return err
+	}
+	sort.Sort(entriesByOffset(entries))
+	end := pk.pack.Size() - 20
+	for i, e := range entries {
+		next := end
+		if i+1 < len(entries) {
+			next = entries[i+1].Offset
+		}
+		if e.Offset < 12 || e.Offset >= next {
+			fail(e.Hash, e.Offset, errEntryOutOfBounds)
+			continue
+		}
+		if pk.idxVersion >= 2 {
+			crc := crc32.NewIEEE()
+			_, err := io.Copy(crc, io.NewSectionReader(pk.pack, e.Offset, next-e.Offset))
+			if err != nil {
+				return err
+			}
+			if crc.Sum32() != e.CRC {
+				fail(e.Hash, e.Offset, errEntryCRC)
+			}
+		}
+		typ, data, err := pk.extractAt(e.Offset)
+		if err != nil {
+			fail(e.Hash, e.Offset, err)
+			continue
+		}
+		t, err := objType(typ)
+		if err != nil {
+			fail(e.Hash, e.Offset, err)
+			continue
+		}
+		h := sha1.New()
+		fmt.Fprintf(h, "%s %d\x00", t, len(data))
+		h.Write(data)
+		var sum Hash
+		h.Sum(sum[:0])
+		if sum != e.Hash {
+			fail(e.Hash, e.Offset, errEntryHash)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+var errBadChecksum = errors.New("gigot: bad checksum")
+
+// checkTrailer checks that a file ends with the SHA-1 checksum of
+// its contents, and returns it.
+func checkTrailer(r *io.SectionReader, data []byte) (sum Hash, err error) {
+	size := r.Size()
+	if size < 20 {
+		return sum, io.ErrUnexpectedEOF
+	}
+	h := sha1.New()
+	if data != nil {
+		h.Write(data[:size-20])
+	} else if _, err := io.Copy(h, io.NewSectionReader(r, 0, size-20)); err != nil {
+		return sum, err
+	}
+	var trailer Hash
+	b, err := readAt(r, data, trailer[:], size-20)
+	if err != nil {
+		return sum, err
+	}
+	h.Sum(sum[:0])
+	if !bytes.Equal(b, sum[:]) {
+		return sum, errBadChecksum
+	}
+	return sum, nil
+}
+
+// indexEntries returns the hash, offset and CRC32 of all objects
+// in the index, in hash order. CRC32s are only present in version 2
+// indexes.
+func (pk *PackReader) indexEntries() ([]packEntry, error) {
+	count := int64(pk.idxFanout[0xff])
+	hashes, err := pk.readHashes(0, count)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]packEntry, count)
+	var crcs []byte
+	if pk.idxVersion >= 2 {
+		crcs, err = readAt(pk.idx, pk.idxData, make([]byte, 4*count), idxHeaderSize+20*count)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i := range entries {
+		e := &entries[i]
+		e.Hash = hashes[i]
+		if e.Offset, err = pk.offsetAt(int64(i)); err != nil {
+			return nil, err
+		}
+		if crcs != nil {
+			e.CRC = binary.BigEndian.Uint32(crcs[4*i:])
+		}
+	}
+	return entries, nil
+}
+
+type entriesByOffset []packEntry
+
+func (s entriesByOffset) Len() int           { return len(s) }
+func (s entriesByOffset) Less(i, j int) bool { return s[i].Offset < s[j].Offset }
+func (s entriesByOffset) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,170 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package objects
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	for _, iname := range []string{"pack-small.idx", "pack-small-v1.idx"} {
+		pk := openTestdataPack(t, "pack-small.pack", iname)
+		if err := pk.Verify(); err != nil {
+			t.Errorf("%s: %s", iname, err)
+		}
+	}
+	if err := getPack(t).Verify(); err != nil {
+		t.Error(err)
+	}
+}
+
+// hasPackError reports whether errs contains an error err for the
+// object h.
+func hasPackError(errs VerifyError, h Hash, err error) bool {
+	for _, e := range errs {
+		if e.Hash == h && e.Err == err {
+			return true
+		}
+	}
+	return false
+}
+
+func TestVerifyCorrupted(t *testing.T) {
+	pack, err := ioutil.ReadFile("testdata/pack-small.pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := ioutil.ReadFile("testdata/pack-small.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := openTestPack(t, pack, idx)
+	entries, err := pk.indexEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	victim := entries[5]
+
+	// Flip a bit in the compressed data of an entry.
+	bad := append([]byte(nil), pack...)
+	bad[victim.Offset+4] ^= 0x10
+	err = openTestPack(t, bad, idx).Verify()
+	errs, ok := err.(VerifyError)
+	if !ok {
+		t.Fatalf("got error %v, expected a VerifyError", err)
+	}
+	if !hasPackError(errs, Hash{}, errPackTrailer) {
+		t.Errorf("pack checksum error not reported: %v", errs)
+	}
+	if !hasPackError(errs, victim.Hash, errEntryCRC) {
+		t.Errorf("CRC32 error not reported for %s: %v", victim.Hash, errs)
+	}
+	for _, e := range errs {
+		if e.Hash != (Hash{}) && e.Hash != victim.Hash {
+			t.Errorf("unexpected error for other object: %s", e)
+		}
+	}
+
+	// Change the object count, with a valid pack checksum.
+	bad = append([]byte(nil), pack...)
+	binary.BigEndian.PutUint32(bad[8:12], uint32(len(entries)+1))
+	sum := sha1.Sum(bad[:len(bad)-20])
+	copy(bad[len(bad)-20:], sum[:])
+	errs, _ = openTestPack(t, bad, idx).Verify().(VerifyError)
+	if len(errs) != 2 || !hasPackError(errs, Hash{}, errPackCount) ||
+		!hasPackError(errs, Hash{}, errIdxPackChecksum) {
+		t.Errorf("got %v, expected count and checksum errors", errs)
+	}
+
+	// Corrupt the index trailer.
+	badIdx := append([]byte(nil), idx...)
+	badIdx[len(badIdx)-1] ^= 1
+	errs, _ = openTestPack(t, pack, badIdx).Verify().(VerifyError)
+	if len(errs) != 1 || !hasPackError(errs, Hash{}, errIdxTrailer) {
+		t.Errorf("got %v, expected index checksum error", errs)
+	}
+}
+
+// A rawEntry is an entry of a test pack, listed in its index with
+// the given hash.
+type rawEntry struct {
+	hash      Hash
+	typ       int
+	hdr, data []byte // data is compressed after hdr.
+}
+
+// rawPack returns a pack holding the given entries and its index,
+// with valid CRCs and checksums.
+func rawPack(entries []rawEntry) (pack, idx []byte) {
+	buf := new(bytes.Buffer)
+	buf.WriteString("PACK")
+	binary.Write(buf, binary.BigEndian, [2]uint32{2, uint32(len(entries))})
+	packed := make([]packEntry, len(entries))
+	for i, e := range entries {
+		off := buf.Len()
+		buf.Write(appendEntryHeader(nil, e.typ, len(e.data)))
+		buf.Write(e.hdr)
+		zw := zlib.NewWriter(buf)
+		zw.Write(e.data)
+		zw.Close()
+		packed[i] = packEntry{
+			Hash:   e.hash,
+			Offset: int64(off),
+			CRC:    crc32.ChecksumIEEE(buf.Bytes()[off:]),
+		}
+	}
+	sum := sha1.Sum(buf.Bytes())
+	buf.Write(sum[:])
+	ibuf := new(bytes.Buffer)
+	writeIdx(ibuf, packed, sum)
+	return buf.Bytes(), ibuf.Bytes()
+}
+
+func TestVerifyCorruptDelta(t *testing.T) {
+	base := Blob{Data: []byte("0123456789")}
+	base.Hash = rehash(base)
+	hashA, hashB := Hash(sha1.Sum([]byte("a"))), Hash(sha1.Sum([]byte("b")))
+	for _, test := range []struct {
+		name    string
+		entries []rawEntry
+		bad     []Hash
+	}{
+		{"copy beyond base", []rawEntry{
+			{base.Hash, pkBlob, nil, base.Data},
+			{hashA, pkRefDelta, base.Hash[:], []byte{10, 100, 0x90, 100}},
+		}, []Hash{hashA}},
+		{"truncated delta", []rawEntry{
+			{base.Hash, pkBlob, nil, base.Data},
+			{hashA, pkRefDelta, base.Hash[:], []byte{10, 5, 5, 'a'}},
+		}, []Hash{hashA}},
+		{"delta cycle", []rawEntry{
+			{hashA, pkRefDelta, hashB[:], []byte{10, 10, 0x90, 10}},
+			{hashB, pkRefDelta, hashA[:], []byte{10, 10, 0x90, 10}},
+		}, []Hash{hashA, hashB}},
+	} {
+		pack, idx := rawPack(test.entries)
+		err := openTestPack(t, pack, idx).Verify()
+		errs, ok := err.(VerifyError)
+		if !ok {
+			t.Errorf("%s: got error %v, expected a VerifyError", test.name, err)
+			continue
+		}
+		if len(errs) != len(test.bad) {
+			t.Errorf("%s: got errors %v", test.name, errs)
+			continue
+		}
+		for i, e := range errs {
+			if e.Hash != test.bad[i] || e.Err == nil {
+				t.Errorf("%s: got error %v, expected an error for %s", test.name, e, test.bad[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repo
+
+import (
+	"bytes"
+	"path/filepath"
+
+	"github.com/remyoudompheng/gigot/objects"
+)
+
+// WriteCommitGraph writes the commit-graph of the repository, as
+// objects/info/commit-graph, with the commits reachable from its refs
+// and HEAD, like "git commit-graph write --reachable". The new graph
+// is then used by the object database.
+func (r *Repo) WriteCommitGraph() error {
+	refs, err := r.listRefs("refs/")
+	if err != nil {
+		return err
+	}
+	if head, err := r.Head(); err == nil {
+		refs = append(refs, head)
+	}
+	var tips []objects.Hash
+	seen := make(map[objects.Hash]bool)
+	for _, ref := range refs {
+		if ref.Id == (objects.Hash{}) {
+			// Unborn branch, or dangling symbolic ref.
+			continue
+		}
+		h, err := r.peel(ref.Id, objects.COMMIT)
+		if err == errBadPeel {
+			// Tags of trees or blobs.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !seen[h] {
+			seen[h] = true
+			tips = append(tips, h)
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if err := objects.WriteCommitGraph(buf, r.Objects, tips); err != nil {
+		return err
+	}
+	dir := filepath.Join(r.Path, "objects")
+	lock, err := lockFile(filepath.Join(dir, "info", "commit-graph"))
+	if err != nil {
+		return err
+	}
+	if err := lock.commit(buf.Bytes()); err != nil {
+		return err
+	}
+	g, err := objects.OpenCommitGraph(dir)
+	if err != nil {
+		return err
+	}
+	if r.Objects.CommitGraph != nil {
+		r.Objects.CommitGraph.Close()
+	}
+	r.Objects.CommitGraph = g
+	return nil
+}
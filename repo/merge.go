@@ -0,0 +1,82 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repo
+
+import (
+	"github.com/remyoudompheng/gigot/merge"
+	"github.com/remyoudompheng/gigot/objects"
+)
+
+// MergeCommits merges commits ours and theirs without a working
+// directory, as "git merge-tree --write-tree ours theirs". The base
+// of the merge is their merge base. When there are several merge
+// bases, they are merged first, and the resulting virtual tree is
+// used as the base, like Git's recursive strategy. New objects are
+// written to the object database. Options may be nil.
+func (r *Repo) MergeCommits(ours, theirs objects.Hash, opts *merge.Options) (*merge.Result, error) {
+	bases, err := r.MergeBase(ours, theirs)
+	if err != nil {
+		return nil, err
+	}
+	base, err := r.mergeBases(bases, opts)
+	if err != nil {
+		return nil, err
+	}
+	oursTree, err := r.peel(ours, objects.TREE)
+	if err != nil {
+		return nil, err
+	}
+	theirsTree, err := r.peel(theirs, objects.TREE)
+	if err != nil {
+		return nil, err
+	}
+	return merge.MergeTrees(r.Objects, base, oursTree, theirsTree, opts)
+}
+
+// mergeBases returns the tree of the virtual merge base of the given
+// commits, sorted by decreasing date. The oldest commits are merged
+// first, and conflicts are left in the tree with their markers. A
+// zero hash stands for the empty tree.
+func (r *Repo) mergeBases(bases []objects.Hash, opts *merge.Options) (objects.Hash, error) {
+	if len(bases) == 0 {
+		return objects.Hash{}, nil
+	}
+	var virtualOpts merge.Options
+	if opts != nil {
+		virtualOpts = *opts
+	}
+	virtualOpts.OursLabel = "Temporary merge branch 1"
+	virtualOpts.TheirsLabel = "Temporary merge branch 2"
+
+	last := bases[len(bases)-1]
+	tree, err := r.peel(last, objects.TREE)
+	if err != nil {
+		return tree, err
+	}
+	merged := []objects.Hash{last}
+	for i := len(bases) - 2; i >= 0; i-- {
+		next := bases[i]
+		// The virtual commit has the merged commits as parents.
+		subBases, err := r.MergeBase(next, merged...)
+		if err != nil {
+			return tree, err
+		}
+		sub, err := r.mergeBases(subBases, opts)
+		if err != nil {
+			return tree, err
+		}
+		nextTree, err := r.peel(next, objects.TREE)
+		if err != nil {
+			return tree, err
+		}
+		res, err := merge.MergeTrees(r.Objects, sub, tree, nextTree, &virtualOpts)
+		if err != nil {
+			return tree, err
+		}
+		tree = res.Tree
+		merged = append(merged, next)
+	}
+	return tree, nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repo
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/remyoudompheng/gigot/merge"
+	"github.com/remyoudompheng/gigot/objects"
+)
+
+func TestMergeCommits(t *testing.T) {
+	r, commits, _ := testMergeHistory(t)
+	defer os.RemoveAll(r.Path)
+	defer r.Close()
+	for _, test := range []struct {
+		ours, theirs string
+		tree         string // commit whose tree is the result, if any.
+		conflicts    string
+	}{
+		{"F", "D", "F", ""},
+		{"D", "F", "F", ""},
+		{"F", "G", "", "content dir/file, content name"},
+		{"F", "X", "", "add/add dir/file, add/add name"},
+	} {
+		opts := &merge.Options{OursLabel: test.ours, TheirsLabel: test.theirs}
+		res, err := r.MergeCommits(commits[test.ours], commits[test.theirs], opts)
+		if err != nil {
+			t.Errorf("MergeCommits(%s, %s): %s", test.ours, test.theirs, err)
+			continue
+		}
+		var s []string
+		for _, c := range res.Conflicts {
+			s = append(s, fmt.Sprintf("%s %s", c.Type, c.Path))
+		}
+		if got := strings.Join(s, ", "); got != test.conflicts {
+			t.Errorf("MergeCommits(%s, %s): got conflicts %q, expected %q",
+				test.ours, test.theirs, got, test.conflicts)
+		}
+		if test.tree != "" {
+			o, err := r.Objects.Get(commits[test.tree])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tree := o.(objects.Commit).Tree; res.Tree != tree {
+				t.Errorf("MergeCommits(%s, %s): got tree %s, expected %s",
+					test.ours, test.theirs, res.Tree, tree)
+			}
+		}
+	}
+
+	// The conflict of F and G is against the merge of B and C.
+	res, err := r.MergeCommits(commits["F"], commits["G"], &merge.Options{OursLabel: "F", TheirsLabel: "G"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := r.lookupPath(res.Tree, "name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, err := r.Objects.Get(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := "<<<<<<< F\nF\n=======\nG\n>>>>>>> G\n"
+	if got := string(o.(objects.Blob).Data); got != expect {
+		t.Errorf("got merged file:\n%s\nexpected:\n%s", got, expect)
+	}
+}
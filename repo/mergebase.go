@@ -0,0 +1,259 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repo
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/remyoudompheng/gigot/objects"
+)
+
+// This file implements ancestry queries between commits, in the
+// manner of git-merge-base(1).
+//
+// They paint the history downwards from two sets of commits, by
+// decreasing commit date, until every commit left to examine is
+// known to be reachable from both sides. Generation numbers from
+// the commit-graph, when available, stop the walk early.
+
+const (
+	paintParent1 = 1 << iota // reachable from the first commit.
+	paintParent2             // reachable from the other commits.
+	paintStale               // reachable from a common ancestor.
+	paintResult              // already returned as a common ancestor.
+)
+
+// paintDownToCommon marks commits reachable from one and from twos,
+// and returns their common ancestors that are not reachable from
+// another common ancestor found by the walk. Commits whose known
+// generation is below minGen are not walked, if minGen is positive.
+// It also returns the marks of walked commits.
+func (w *RevWalk) paintDownToCommon(one *walkCommit, twos []*walkCommit, minGen uint32) ([]*walkCommit, map[*walkCommit]uint8, error) {
+	flags := make(map[*walkCommit]uint8)
+	var queue commitQueue
+	flags[one] |= paintParent1
+	queue.push(one)
+	for _, c := range twos {
+		flags[c] |= paintParent2
+		queue.push(c)
+	}
+	var result []*walkCommit
+	for hasNonStale(&queue, flags) {
+		c := queue.pop()
+		f := flags[c] & (paintParent1 | paintParent2 | paintStale)
+		if f == paintParent1|paintParent2 {
+			if flags[c]&paintResult == 0 {
+				flags[c] |= paintResult
+				result = append(result, c)
+			}
+			f |= paintStale
+		}
+		for _, h := range c.parents {
+			p, err := w.lookup(h)
+			if err != nil {
+				return nil, nil, err
+			}
+			if flags[p]&f == f {
+				continue
+			}
+			if minGen > 0 && p.gen > 0 && p.gen < minGen {
+				continue
+			}
+			flags[p] |= f
+			queue.push(p)
+		}
+	}
+	out := result[:0]
+	for _, c := range result {
+		if flags[c]&paintStale == 0 {
+			out = append(out, c)
+		}
+	}
+	return out, flags, nil
+}
+
+// hasNonStale reports whether some queued commit is not known to be
+// a common ancestor.
+func hasNonStale(q *commitQueue, flags map[*walkCommit]uint8) bool {
+	for _, it := range q.items {
+		if flags[it.c]&paintStale == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// minGeneration returns the smallest generation of commits, or zero
+// if one of them is unknown.
+func minGeneration(commits []*walkCommit) uint32 {
+	var min uint32
+	for i, c := range commits {
+		if c.gen == 0 {
+			return 0
+		}
+		if i == 0 || c.gen < min {
+			min = c.gen
+		}
+	}
+	return min
+}
+
+// removeRedundant removes from commits those reachable from another
+// one, and duplicates. The order of commits is preserved.
+func (w *RevWalk) removeRedundant(commits []*walkCommit) ([]*walkCommit, error) {
+	var uniq []*walkCommit
+	seen := make(map[*walkCommit]bool)
+	for _, c := range commits {
+		if !seen[c] {
+			seen[c] = true
+			uniq = append(uniq, c)
+		}
+	}
+	redundant := make(map[*walkCommit]bool)
+	for _, c := range uniq {
+		if redundant[c] {
+			continue
+		}
+		var others []*walkCommit
+		for _, o := range uniq {
+			if o != c && !redundant[o] {
+				others = append(others, o)
+			}
+		}
+		if len(others) == 0 {
+			break
+		}
+		minGen := minGeneration(append([]*walkCommit{c}, others...))
+		_, flags, err := w.paintDownToCommon(c, others, minGen)
+		if err != nil {
+			return nil, err
+		}
+		if flags[c]&paintParent2 != 0 {
+			redundant[c] = true
+		}
+		for _, o := range others {
+			if flags[o]&paintParent1 != 0 {
+				redundant[o] = true
+			}
+		}
+	}
+	out := uniq[:0]
+	for _, c := range uniq {
+		if !redundant[c] {
+			out = append(out, c)
+		}
+	}
+	return out, nil
+}
+
+// lookupAll loads the given commits.
+func (w *RevWalk) lookupAll(hashes []objects.Hash) ([]*walkCommit, error) {
+	commits := make([]*walkCommit, len(hashes))
+	for i, h := range hashes {
+		c, err := w.lookup(h)
+		if err != nil {
+			return nil, err
+		}
+		commits[i] = c
+	}
+	return commits, nil
+}
+
+// MergeBase returns the best common ancestors of a and the other
+// commits b, as "git merge-base --all a b...": common ancestors of a
+// and a hypothetical merge of the commits b, that are not ancestors
+// of another common ancestor. They are sorted by decreasing commit
+// date. The result is empty if the commits have no common history.
+func (r *Repo) MergeBase(a objects.Hash, b ...objects.Hash) ([]objects.Hash, error) {
+	w := r.RevWalk()
+	one, err := w.lookup(a)
+	if err != nil {
+		return nil, err
+	}
+	twos, err := w.lookupAll(b)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range twos {
+		if c == one {
+			return []objects.Hash{a}, nil
+		}
+	}
+	bases, _, err := w.paintDownToCommon(one, twos, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(bases) > 1 {
+		if bases, err = w.removeRedundant(bases); err != nil {
+			return nil, err
+		}
+	}
+	sort.Sort(commitsByDate(bases))
+	hashes := make([]objects.Hash, len(bases))
+	for i, c := range bases {
+		hashes[i] = c.hash
+	}
+	return hashes, nil
+}
+
+// commitsByDate sorts commits by decreasing date, then by hash.
+type commitsByDate []*walkCommit
+
+func (s commitsByDate) Len() int      { return len(s) }
+func (s commitsByDate) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s commitsByDate) Less(i, j int) bool {
+	if s[i].time != s[j].time {
+		return s[i].time > s[j].time
+	}
+	return bytes.Compare(s[i].hash[:], s[j].hash[:]) < 0
+}
+
+// IsAncestor reports whether commit a is an ancestor of commit b,
+// as "git merge-base --is-ancestor a b". A commit is an ancestor of
+// itself. In particular, b can be fast-forwarded to a if b is an
+// ancestor of a.
+func (r *Repo) IsAncestor(a, b objects.Hash) (bool, error) {
+	w := r.RevWalk()
+	ca, err := w.lookup(a)
+	if err != nil {
+		return false, err
+	}
+	cb, err := w.lookup(b)
+	if err != nil {
+		return false, err
+	}
+	if ca == cb {
+		return true, nil
+	}
+	if ca.gen > 0 && cb.gen > 0 && ca.gen >= cb.gen {
+		return false, nil
+	}
+	_, flags, err := w.paintDownToCommon(ca, []*walkCommit{cb}, ca.gen)
+	if err != nil {
+		return false, err
+	}
+	return flags[ca]&paintParent2 != 0, nil
+}
+
+// Independent returns the commits that are not reachable from
+// another one of the given commits, as "git merge-base --independent".
+// Duplicates are removed, and the order of commits is preserved.
+func (r *Repo) Independent(hashes ...objects.Hash) ([]objects.Hash, error) {
+	w := r.RevWalk()
+	commits, err := w.lookupAll(hashes)
+	if err != nil {
+		return nil, err
+	}
+	commits, err = w.removeRedundant(commits)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]objects.Hash, len(commits))
+	for i, c := range commits {
+		out[i] = c.hash
+	}
+	return out, nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repo
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/remyoudompheng/gigot/objects"
+)
+
+// testMergeHistory is a history with a criss-cross merge and an
+// unrelated root commit X:
+//
+//	A - B - D - F
+//	 \   \ /
+//	  \   X
+//	   \ / \
+//	    C - E - G
+func testMergeHistory(t *testing.T) (*Repo, map[string]objects.Hash, map[objects.Hash]string) {
+	dir, commits, names := buildHistory(t,
+		"A", "B A", "C A", "D B C", "E C B", "F D", "G E", "X")
+	r, err := Open(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return r, commits, names
+}
+
+func TestMergeBase(t *testing.T) {
+	r, commits, names := testMergeHistory(t)
+	defer os.RemoveAll(r.Path)
+	defer r.Close()
+	for _, graph := range []bool{false, true} {
+		if graph {
+			for name, branch := range map[string]string{"F": "master", "G": "side", "X": "other"} {
+				if err := r.Refs.Update("refs/heads/"+branch, commits[name], nil, ""); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := r.WriteCommitGraph(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		testMergeBase(t, r, commits, names)
+	}
+}
+
+func hashNames(hashes []objects.Hash, names map[objects.Hash]string) string {
+	var s []string
+	for _, h := range hashes {
+		s = append(s, names[h])
+	}
+	return strings.Join(s, " ")
+}
+
+func testMergeBase(t *testing.T, r *Repo, commits map[string]objects.Hash, names map[objects.Hash]string) {
+	lookup := func(spec string) (hashes []objects.Hash) {
+		for _, name := range strings.Fields(spec) {
+			hashes = append(hashes, commits[name])
+		}
+		return hashes
+	}
+	for _, test := range []struct {
+		args, expect string
+	}{
+		{"B C", "A"},
+		{"D E", "C B"},
+		{"F G", "C B"},
+		{"F D", "D"},
+		{"A G", "A"},
+		{"B C D", "B"},
+		{"B C E", "B"},
+		{"F X", ""},
+		{"G G", "G"},
+	} {
+		args := lookup(test.args)
+		bases, err := r.MergeBase(args[0], args[1:]...)
+		if err != nil {
+			t.Errorf("MergeBase(%s): %s", test.args, err)
+			continue
+		}
+		if got := hashNames(bases, names); got != test.expect {
+			t.Errorf("MergeBase(%s): got %q, expected %q", test.args, got, test.expect)
+		}
+	}
+
+	for _, test := range []struct {
+		a, b   string
+		expect bool
+	}{
+		{"A", "F", true},
+		{"F", "A", false},
+		{"B", "C", false},
+		{"C", "G", true},
+		{"C", "F", true},
+		{"D", "G", false},
+		{"D", "D", true},
+		{"X", "G", false},
+	} {
+		ok, err := r.IsAncestor(commits[test.a], commits[test.b])
+		if err != nil || ok != test.expect {
+			t.Errorf("IsAncestor(%s, %s) = %v, %v, expected %v", test.a, test.b, ok, err, test.expect)
+		}
+	}
+
+	for _, test := range []struct {
+		args, expect string
+	}{
+		{"F G D B F", "F G"},
+		{"B C", "B C"},
+		{"A B C D", "D"},
+		{"X A G", "X G"},
+	} {
+		heads, err := r.Independent(lookup(test.args)...)
+		if err != nil {
+			t.Errorf("Independent(%s): %s", test.args, err)
+			continue
+		}
+		if got := hashNames(heads, names); got != test.expect {
+			t.Errorf("Independent(%s): got %q, expected %q", test.args, got, test.expect)
+		}
+	}
+
+	// Trees are not commits.
+	o, err := r.Objects.Get(commits["A"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.IsAncestor(o.(objects.Commit).Tree, commits["A"]); err != errNotCommit {
+		t.Errorf("got %v, expected errNotCommit", err)
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/remyoudompheng/gigot/objects"
+)
+
+// This file implements reference logs, stored under logs/ in
+// the repository directory.
+//
+// Each line of a reflog has the form:
+// <old hash> <new hash> <identity> <unix time> <zone>\t<message>
+
+// A ReflogEntry records an update of a reference.
+type ReflogEntry struct {
+	Old, New objects.Hash
+	Who      string // The identity of the author of the change.
+	When     time.Time
+	Message  string
+}
+
+var (
+	errMalformedReflog = errors.New("gigot: malformed reflog entry")
+	errNoReflog        = errors.New("gigot: reference has no reflog")
+	errReflogTooShort  = errors.New("gigot: reflog has too few entries")
+)
+
+func (s *RefStore) logPath(name string) string {
+	return filepath.Join(s.Dir, "logs", filepath.FromSlash(name))
+}
+
+// shouldLog reports whether updates of a ref are logged: Git
+// logs HEAD, branches, remote-tracking branches and notes, and
+// any other ref which already has a reflog.
+func (s *RefStore) shouldLog(name string) bool {
+	if s.Identity == "" {
+		return false
+	}
+	if name == "HEAD" || strings.HasPrefix(name, "refs/heads/") ||
+		strings.HasPrefix(name, "refs/remotes/") ||
+		strings.HasPrefix(name, "refs/notes/") {
+		return true
+	}
+	_, err := os.Stat(s.logPath(name))
+	return err == nil
+}
+
+// formatReflogEntry formats a reflog line. Like Git, whitespace
+// in the message is collapsed to single spaces.
+func formatReflogEntry(e ReflogEntry) string {
+	line := fmt.Sprintf("%s %s %s", e.Old, e.New, objects.FormatIdent(e.Who, e.When))
+	if msg := strings.Join(strings.Fields(e.Message), " "); msg != "" {
+		line += "\t" + msg
+	}
+	return line + "\n"
+}
+
+func parseReflogEntry(line []byte) (e ReflogEntry, err error) {
+	if len(line) < 82 || line[40] != ' ' || line[81] != ' ' {
+		return e, errMalformedReflog
+	}
+	n1, err1 := hex.Decode(e.Old[:], line[:40])
+	n2, err2 := hex.Decode(e.New[:], line[41:81])
+	if err1 != nil || err2 != nil || n1 != len(e.Old) || n2 != len(e.New) {
+		return e, errMalformedReflog
+	}
+	line = line[82:]
+	if tab := bytes.IndexByte(line, '\t'); tab >= 0 {
+		e.Message = string(line[tab+1:])
+		line = line[:tab]
+	}
+	e.Who, e.When, err = objects.ParseIdent(line)
+	return e, err
+}
+
+// appendReflog adds an entry to the reflog of a ref.
+func (s *RefStore) appendReflog(name string, e ReflogEntry) error {
+	path := s.logPath(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(formatReflogEntry(e))
+	if errc := f.Close(); err == nil {
+		err = errc
+	}
+	return err
+}
+
+// logUpdate records an update of a ref in its reflog, and in the
+// reflog of HEAD if HEAD points to it.
+func (s *RefStore) logUpdate(name string, old, id objects.Hash, msg string) error {
+	e := ReflogEntry{Old: old, New: id, Who: s.Identity, When: time.Now(), Message: msg}
+	if s.shouldLog(name) {
+		if err := s.appendReflog(name, e); err != nil {
+			return err
+		}
+	}
+	if name != "HEAD" && s.shouldLog("HEAD") {
+		head, err := s.resolveForUpdate("HEAD")
+		if err == nil && head == name {
+			return s.appendReflog("HEAD", e)
+		}
+	}
+	return nil
+}
+
+// Reflog returns the entries of the reflog of a ref, from oldest
+// to newest.
+func (s *RefStore) Reflog(name string) ([]ReflogEntry, error) {
+	if !validRefName(name) {
+		return nil, errInvalidRefName(name)
+	}
+	f, err := os.Open(s.logPath(name))
+	if os.IsNotExist(err) {
+		return nil, errNoReflog
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []ReflogEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		e, err := parseReflogEntry(scanner.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// ReflogAt returns the value of a ref n updates ago, as in the
+// ref@{n} syntax: n = 0 is the current value.
+func (s *RefStore) ReflogAt(name string, n int) (objects.Hash, error) {
+	entries, err := s.Reflog(name)
+	if err != nil {
+		return objects.Hash{}, err
+	}
+	switch {
+	case n < 0 || n > len(entries):
+		return objects.Hash{}, errReflogTooShort
+	case n == len(entries):
+		// The value before the oldest entry.
+		if old := entries[0].Old; old != (objects.Hash{}) {
+			return old, nil
+		}
+		return objects.Hash{}, errReflogTooShort
+	}
+	return entries[len(entries)-1-n].New, nil
+}
+
+// ReflogAtTime returns the value a ref had at the given time, as in
+// the ref@{date} syntax. If the reflog starts after that time, the
+// oldest known value is returned.
+func (s *RefStore) ReflogAtTime(name string, t time.Time) (objects.Hash, error) {
+	entries, err := s.Reflog(name)
+	if err != nil {
+		return objects.Hash{}, err
+	}
+	if len(entries) == 0 {
+		return objects.Hash{}, errReflogTooShort
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if !entries[i].When.After(t) {
+			return entries[i].New, nil
+		}
+	}
+	if old := entries[0].Old; old != (objects.Hash{}) {
+		return old, nil
+	}
+	return entries[0].New, nil
+}
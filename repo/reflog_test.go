@@ -0,0 +1,89 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repo
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseReflog(t *testing.T) {
+	const line = "0000000000000000000000000000000000000000 cff5570614ef7eb3620e0e98f9938e8ade423e1a " +
+		"Rémy Oudompheng <remy@archlinux.org> 1356355981 +0100\tcommit (initial): Hello!"
+	e, err := parseReflogEntry([]byte(line))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.New.String() != "cff5570614ef7eb3620e0e98f9938e8ade423e1a" ||
+		e.Who != "Rémy Oudompheng <remy@archlinux.org>" ||
+		e.When.Unix() != 1356355981 ||
+		e.Message != "commit (initial): Hello!" {
+		t.Errorf("bad entry %+v", e)
+	}
+	if s := formatReflogEntry(e); s != line+"\n" {
+		t.Errorf("got %q, expected %q", s, line+"\n")
+	}
+}
+
+func TestReflogUpdate(t *testing.T) {
+	dir := makeRefs(t)
+	defer os.RemoveAll(dir)
+	s := NewRefStore(dir)
+	s.Identity = "A U Thor <author@example.com>"
+
+	a, b, c := hash(hashA), hash(hashB), hash(hashC)
+	if err := s.Update("refs/heads/master", b, nil, "commit: second"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Update("HEAD", c, nil, "commit: third\nwith details"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"HEAD", "refs/heads/master"} {
+		entries, err := s.Reflog(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 2 {
+			t.Fatalf("%s: got %d entries, expected 2", name, len(entries))
+		}
+		if entries[0].Old != a || entries[0].New != b || entries[1].New != c {
+			t.Errorf("%s: bad entries %+v", name, entries)
+		}
+		if entries[1].Message != "commit: third with details" {
+			t.Errorf("%s: bad message %q", name, entries[1].Message)
+		}
+		for n, expect := range []string{hashC, hashB, hashA} {
+			h, err := s.ReflogAt(name, n)
+			if err != nil || h != hash(expect) {
+				t.Errorf("%s@{%d} = %s, %v, expected %s", name, n, h, err, expect)
+			}
+		}
+		if _, err := s.ReflogAt(name, 3); err != errReflogTooShort {
+			t.Errorf("got %v, expected %v", err, errReflogTooShort)
+		}
+		h, err := s.ReflogAtTime(name, time.Now().Add(time.Hour))
+		if err != nil || h != c {
+			t.Errorf("%s@{now} = %s, %v, expected %s", name, h, err, c)
+		}
+		h, err = s.ReflogAtTime(name, time.Now().Add(-time.Hour))
+		if err != nil || h != a {
+			t.Errorf("%s@{1 hour ago} = %s, %v, expected %s", name, h, err, a)
+		}
+	}
+	// Tags are not logged by default.
+	if err := s.Update("refs/tags/v2.0", a, nil, "tag"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Reflog("refs/tags/v2.0"); err != errNoReflog {
+		t.Errorf("got %v, expected %v", err, errNoReflog)
+	}
+	if err := s.Delete("refs/heads/master", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Reflog("refs/heads/master"); err != errNoReflog {
+		t.Errorf("got %v after deletion, expected %v", err, errNoReflog)
+	}
+}
@@ -0,0 +1,509 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/remyoudompheng/gigot/objects"
+)
+
+// This file implements the reference database: loose refs stored
+// as files under the repository directory, and the packed-refs file.
+//
+// Cf. Documentation/technical/ and git-pack-refs(1) in Git sources.
+
+// A RefStore gives access to the references of a repository.
+type RefStore struct {
+	Dir string // The repository directory.
+	// Identity is recorded in reflogs as the author of updates,
+	// in the form "Name <email>". Reflogs are not written if it
+	// is empty.
+	Identity string
+}
+
+// NewRefStore returns the ref store of the repository at dir.
+func NewRefStore(dir string) *RefStore {
+	return &RefStore{Dir: dir}
+}
+
+var (
+	errRefNotFound     = errors.New("gigot: reference not found")
+	errRefLoop         = errors.New("gigot: symbolic reference loop")
+	errRefLocked       = errors.New("gigot: reference is locked")
+	errRefChanged      = errors.New("gigot: reference changed concurrently")
+	errRefConflict     = errors.New("gigot: reference name conflicts with an existing reference")
+	errMalformedRef    = errors.New("gigot: malformed reference")
+	errMalformedPacked = errors.New("gigot: malformed packed-refs file")
+)
+
+type errInvalidRefName string
+
+func (err errInvalidRefName) Error() string {
+	return fmt.Sprintf("gigot: invalid reference name %q", string(err))
+}
+
+// maxSymrefDepth is the maximal length of symbolic ref chains,
+// as in Git.
+const maxSymrefDepth = 5
+
+// validRefName checks a reference name according to the rules of
+// git-check-ref-format(1).
+func validRefName(name string) bool {
+	if name == "" || name == "@" || strings.HasSuffix(name, "/") ||
+		strings.HasSuffix(name, ".") || strings.Contains(name, "..") ||
+		strings.Contains(name, "//") || strings.Contains(name, "@{") {
+		return false
+	}
+	for _, c := range name {
+		if c < 040 || c == 0177 || strings.ContainsRune(" ~^:?*[\\", c) {
+			return false
+		}
+	}
+	for _, comp := range strings.Split(name, "/") {
+		if strings.HasPrefix(comp, ".") || strings.HasSuffix(comp, ".lock") {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *RefStore) path(name string) string {
+	return filepath.Join(s.Dir, filepath.FromSlash(name))
+}
+
+// readLoose reads a loose ref. It returns errRefNotFound if the
+// file does not exist.
+func (s *RefStore) readLoose(name string) (ref Ref, err error) {
+	data, err := ioutil.ReadFile(s.path(name))
+	if err != nil {
+		if os.IsNotExist(err) || isDirError(s.path(name)) {
+			err = errRefNotFound
+		}
+		return
+	}
+	return parseLooseRef(name, data)
+}
+
+func isDirError(path string) bool {
+	st, err := os.Stat(path)
+	return err == nil && st.IsDir()
+}
+
+func parseLooseRef(name string, data []byte) (ref Ref, err error) {
+	ref.Name = name
+	data = bytes.TrimRight(data, "\n")
+	if bytes.HasPrefix(data, []byte("ref: ")) {
+		ref.Target = string(bytes.TrimSpace(data[5:]))
+		return ref, nil
+	}
+	// Refs like FETCH_HEAD may have extra fields after the hash.
+	fields := bytes.Fields(data)
+	if len(fields) == 0 {
+		return ref, errMalformedRef
+	}
+	n, err := hex.Decode(ref.Id[:], fields[0])
+	if err == nil && n != len(ref.Id) {
+		err = errMalformedRef
+	}
+	return ref, err
+}
+
+// packedRefs is the parsed contents of a packed-refs file.
+type packedRefs struct {
+	header string // the initial comment line, if any.
+	refs   []Ref  // sorted by name.
+}
+
+func (p *packedRefs) find(name string) (int, bool) {
+	i := sort.Search(len(p.refs), func(i int) bool { return p.refs[i].Name >= name })
+	return i, i < len(p.refs) && p.refs[i].Name == name
+}
+
+func (s *RefStore) readPacked() (*packedRefs, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.Dir, "packed-refs"))
+	if os.IsNotExist(err) {
+		return new(packedRefs), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parsePackedRefs(data)
+}
+
+// parsePackedRefs parses a packed-refs file. Its lines have the
+// form "<hex> <refname>", each optionally followed by a line
+// "^<hex>" giving the object the previous ref peels to.
+func parsePackedRefs(data []byte) (*packedRefs, error) {
+	p := new(packedRefs)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	sorted := true
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		switch {
+		case len(line) == 0:
+			continue
+		case line[0] == '#':
+			if len(p.refs) == 0 {
+				p.header = string(line)
+			}
+		case line[0] == '^':
+			if len(p.refs) == 0 {
+				return nil, errMalformedPacked
+			}
+			ref := &p.refs[len(p.refs)-1]
+			n, err := hex.Decode(ref.Peeled[:], line[1:])
+			if err != nil || n != len(ref.Peeled) {
+				return nil, errMalformedPacked
+			}
+		default:
+			sp := bytes.IndexByte(line, ' ')
+			if sp < 0 {
+				return nil, errMalformedPacked
+			}
+			ref := Ref{Name: string(line[sp+1:])}
+			n, err := hex.Decode(ref.Id[:], line[:sp])
+			if err != nil || n != len(ref.Id) {
+				return nil, errMalformedPacked
+			}
+			if k := len(p.refs); k > 0 && p.refs[k-1].Name >= ref.Name {
+				sorted = false
+			}
+			p.refs = append(p.refs, ref)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !sorted {
+		sort.Sort(refsByName(p.refs))
+	}
+	return p, nil
+}
+
+func (p *packedRefs) bytes() []byte {
+	buf := new(bytes.Buffer)
+	if p.header != "" {
+		buf.WriteString(p.header + "\n")
+	}
+	for _, ref := range p.refs {
+		fmt.Fprintf(buf, "%s %s\n", ref.Id, ref.Name)
+		if ref.Peeled != (objects.Hash{}) {
+			fmt.Fprintf(buf, "^%s\n", ref.Peeled)
+		}
+	}
+	return buf.Bytes()
+}
+
+type refsByName []Ref
+
+func (s refsByName) Len() int           { return len(s) }
+func (s refsByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s refsByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Read reads a reference without following symbolic refs.
+// Loose refs take precedence over packed refs.
+func (s *RefStore) Read(name string) (Ref, error) {
+	if !validRefName(name) {
+		return Ref{}, errInvalidRefName(name)
+	}
+	ref, err := s.readLoose(name)
+	if err != errRefNotFound {
+		return ref, err
+	}
+	packed, err := s.readPacked()
+	if err != nil {
+		return Ref{}, err
+	}
+	if i, ok := packed.find(name); ok {
+		return packed.refs[i], nil
+	}
+	return Ref{}, errRefNotFound
+}
+
+// Resolve reads a reference and follows symbolic refs. The
+// returned Ref has the name of the last ref of the chain.
+func (s *RefStore) Resolve(name string) (Ref, error) {
+	for depth := 0; depth <= maxSymrefDepth; depth++ {
+		ref, err := s.Read(name)
+		if err != nil || ref.Target == "" {
+			return ref, err
+		}
+		name = ref.Target
+	}
+	return Ref{}, errRefLoop
+}
+
+// isDangling reports whether an error returned by Resolve means
+// that a symbolic ref does not lead to an existing ref.
+func isDangling(err error) bool {
+	if _, ok := err.(errInvalidRefName); ok {
+		return true
+	}
+	return err == errRefNotFound || err == errRefLoop
+}
+
+// List returns the references whose name starts with prefix,
+// sorted by name. Symbolic refs are not followed.
+func (s *RefStore) List(prefix string) ([]Ref, error) {
+	packed, err := s.readPacked()
+	if err != nil {
+		return nil, err
+	}
+	refs := make(map[string]Ref)
+	for _, ref := range packed.refs {
+		if strings.HasPrefix(ref.Name, prefix) {
+			refs[ref.Name] = ref
+		}
+	}
+	root := filepath.Join(s.Dir, "refs")
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == root {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(s.Dir, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if info.IsDir() || !strings.HasPrefix(name, prefix) || !validRefName(name) {
+			return nil
+		}
+		ref, err := s.readLoose(name)
+		if err != nil {
+			return err
+		}
+		refs[name] = ref
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Ref, 0, len(refs))
+	for _, ref := range refs {
+		list = append(list, ref)
+	}
+	sort.Sort(refsByName(list))
+	return list, nil
+}
+
+// A refLock is a lock file used to update a ref atomically.
+type refLock struct {
+	path string
+	f    *os.File
+}
+
+func lockFile(path string) (*refLock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if os.IsExist(err) {
+		return nil, errRefLocked
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &refLock{path: path, f: f}, nil
+}
+
+// commit writes data to the lock file and renames it over the
+// locked file.
+func (l *refLock) commit(data []byte) error {
+	_, err := l.f.Write(data)
+	if errc := l.f.Close(); err == nil {
+		err = errc
+	}
+	if err == nil {
+		err = os.Rename(l.path+".lock", l.path)
+	}
+	if err != nil {
+		os.Remove(l.path + ".lock")
+	}
+	return err
+}
+
+func (l *refLock) release() {
+	l.f.Close()
+	os.Remove(l.path + ".lock")
+}
+
+// resolveForUpdate follows symbolic refs starting at name, and
+// returns the name of the ref to modify.
+func (s *RefStore) resolveForUpdate(name string) (string, error) {
+	for depth := 0; depth <= maxSymrefDepth; depth++ {
+		if !validRefName(name) {
+			return "", errInvalidRefName(name)
+		}
+		ref, err := s.Read(name)
+		if err == errRefNotFound || (err == nil && ref.Target == "") {
+			return name, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		name = ref.Target
+	}
+	return "", errRefLoop
+}
+
+// checkConflict reports whether creating the ref name would
+// conflict with existing refs, such as refs/heads/a when creating
+// refs/heads/a/b or conversely.
+func (s *RefStore) checkConflict(name string) error {
+	refs, err := s.List("")
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		if strings.HasPrefix(ref.Name, name+"/") || strings.HasPrefix(name, ref.Name+"/") {
+			return errRefConflict
+		}
+	}
+	return nil
+}
+
+// current returns the value of a ref, or the zero hash if it
+// does not exist.
+func (s *RefStore) current(name string) (objects.Hash, error) {
+	ref, err := s.Read(name)
+	if err == errRefNotFound {
+		return objects.Hash{}, nil
+	}
+	return ref.Id, err
+}
+
+// Update atomically sets a reference to id, following symbolic
+// refs. If old is not nil, the update only happens if the ref
+// currently has value *old, where the zero hash means that the
+// ref must not exist. The update is recorded in reflogs with
+// the given message.
+func (s *RefStore) Update(name string, id objects.Hash, old *objects.Hash, msg string) error {
+	name, err := s.resolveForUpdate(name)
+	if err != nil {
+		return err
+	}
+	cur, err := s.current(name)
+	if err == nil && cur == (objects.Hash{}) {
+		err = s.checkConflict(name)
+	}
+	if err != nil {
+		return err
+	}
+	lock, err := lockFile(s.path(name))
+	if err != nil {
+		return err
+	}
+	// Check the old value again now that we hold the lock.
+	cur, err = s.current(name)
+	if err == nil && old != nil && cur != *old {
+		err = errRefChanged
+	}
+	if err == nil {
+		err = s.logUpdate(name, cur, id, msg)
+	}
+	if err != nil {
+		lock.release()
+		return err
+	}
+	return lock.commit([]byte(id.String() + "\n"))
+}
+
+// SetSymbolic makes name a symbolic ref pointing to target.
+func (s *RefStore) SetSymbolic(name, target string) error {
+	if !validRefName(name) {
+		return errInvalidRefName(name)
+	}
+	if !validRefName(target) {
+		return errInvalidRefName(target)
+	}
+	lock, err := lockFile(s.path(name))
+	if err != nil {
+		return err
+	}
+	return lock.commit([]byte("ref: " + target + "\n"))
+}
+
+// Delete removes a reference, both from loose refs and from the
+// packed-refs file, along with its reflog. If old is not nil, the
+// ref is only deleted if it currently has value *old. Symbolic
+// refs are deleted themselves, not their targets.
+func (s *RefStore) Delete(name string, old *objects.Hash) error {
+	if !validRefName(name) {
+		return errInvalidRefName(name)
+	}
+	lock, err := lockFile(s.path(name))
+	if err != nil {
+		return err
+	}
+	err = s.deleteLocked(name, old)
+	lock.release()
+	s.pruneDirs(filepath.Join(s.Dir, "refs"), filepath.Dir(s.path(name)))
+	s.pruneDirs(filepath.Join(s.Dir, "logs", "refs"), filepath.Dir(s.logPath(name)))
+	return err
+}
+
+func (s *RefStore) deleteLocked(name string, old *objects.Hash) error {
+	ref, err := s.Read(name)
+	if err != nil {
+		return err
+	}
+	if old != nil && ref.Id != *old {
+		return errRefChanged
+	}
+
+	// Remove the ref from packed-refs first, so that the packed
+	// value never reappears once the loose file is removed.
+	plock, err := lockFile(filepath.Join(s.Dir, "packed-refs"))
+	if err != nil {
+		return err
+	}
+	packed, err := s.readPacked()
+	if err != nil {
+		plock.release()
+		return err
+	}
+	if i, ok := packed.find(name); ok {
+		packed.refs = append(packed.refs[:i], packed.refs[i+1:]...)
+		if err := plock.commit(packed.bytes()); err != nil {
+			return err
+		}
+	} else {
+		plock.release()
+	}
+
+	err = os.Remove(s.path(name))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Remove(s.logPath(name))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// pruneDirs removes empty directories under root left after
+// deleting a ref.
+func (s *RefStore) pruneDirs(root, dir string) {
+	for strings.HasPrefix(dir, root+string(filepath.Separator)) {
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
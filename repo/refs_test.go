@@ -0,0 +1,178 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repo
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/remyoudompheng/gigot/objects"
+)
+
+func hash(s string) (h objects.Hash) {
+	n, err := hex.Decode(h[:], []byte(s))
+	if err != nil || n != len(h) {
+		panic("invalid hash " + s)
+	}
+	return h
+}
+
+const (
+	hashA = "1111111111111111111111111111111111111111"
+	hashB = "2222222222222222222222222222222222222222"
+	hashC = "3333333333333333333333333333333333333333"
+	hashD = "4444444444444444444444444444444444444444"
+)
+
+// makeRefs creates a repository directory holding refs in loose
+// and packed form.
+func makeRefs(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "gigot-refs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"HEAD":                     "ref: refs/heads/master\n",
+		"refs/heads/master":        hashA + "\n",
+		"refs/heads/feature/x":     hashB + "\n",
+		"refs/remotes/origin/HEAD": "ref: refs/remotes/origin/master\n",
+		"refs/heads/loop1":         "ref: refs/heads/loop2\n",
+		"refs/heads/loop2":         "ref: refs/heads/loop1\n",
+		"packed-refs": "# pack-refs with: peeled fully-peeled sorted \n" +
+			hashC + " refs/heads/master\n" +
+			hashC + " refs/remotes/origin/master\n" +
+			hashD + " refs/tags/v1.0\n" +
+			"^" + hashA + "\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestRefRead(t *testing.T) {
+	dir := makeRefs(t)
+	defer os.RemoveAll(dir)
+	s := NewRefStore(dir)
+
+	for _, test := range []struct {
+		name, resolved, id string
+	}{
+		{"HEAD", "refs/heads/master", hashA},
+		{"refs/heads/master", "refs/heads/master", hashA}, // loose wins.
+		{"refs/heads/feature/x", "refs/heads/feature/x", hashB},
+		{"refs/remotes/origin/HEAD", "refs/remotes/origin/master", hashC},
+		{"refs/tags/v1.0", "refs/tags/v1.0", hashD},
+	} {
+		ref, err := s.Resolve(test.name)
+		if err != nil {
+			t.Errorf("resolve %s: %s", test.name, err)
+			continue
+		}
+		if ref.Name != test.resolved || ref.Id != hash(test.id) {
+			t.Errorf("resolve %s: got %s %s, expected %s %s",
+				test.name, ref.Name, ref.Id, test.resolved, test.id)
+		}
+	}
+	tag, _ := s.Read("refs/tags/v1.0")
+	if tag.Peeled != hash(hashA) {
+		t.Errorf("got peeled %s, expected %s", tag.Peeled, hashA)
+	}
+	if _, err := s.Resolve("refs/heads/loop1"); err != errRefLoop {
+		t.Errorf("got %v for symref loop, expected %v", err, errRefLoop)
+	}
+	if _, err := s.Read("refs/heads/nonexistent"); err != errRefNotFound {
+		t.Errorf("got %v for missing ref, expected %v", err, errRefNotFound)
+	}
+	if _, err := s.Read("refs/heads/a..b"); err == nil {
+		t.Errorf("invalid name accepted")
+	}
+
+	refs, err := s.List("refs/heads/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, r := range refs {
+		names = append(names, r.Name)
+	}
+	expect := []string{"refs/heads/feature/x", "refs/heads/loop1", "refs/heads/loop2", "refs/heads/master"}
+	if len(names) != len(expect) {
+		t.Fatalf("got refs %q, expected %q", names, expect)
+	}
+	for i := range names {
+		if names[i] != expect[i] {
+			t.Errorf("got refs %q, expected %q", names, expect)
+			break
+		}
+	}
+}
+
+func TestRefUpdate(t *testing.T) {
+	dir := makeRefs(t)
+	defer os.RemoveAll(dir)
+	s := NewRefStore(dir)
+
+	// Updating HEAD updates the branch it points to.
+	a, b, zero := hash(hashA), hash(hashB), objects.Hash{}
+	if err := s.Update("HEAD", b, &a, ""); err != nil {
+		t.Fatal(err)
+	}
+	if ref, _ := s.Read("refs/heads/master"); ref.Id != b {
+		t.Errorf("got %s after update, expected %s", ref.Id, b)
+	}
+	// Compare and swap failure.
+	if err := s.Update("refs/heads/master", a, &a, ""); err != errRefChanged {
+		t.Errorf("got %v, expected %v", err, errRefChanged)
+	}
+	// Creation only if absent.
+	if err := s.Update("refs/heads/feature/x", a, &zero, ""); err != errRefChanged {
+		t.Errorf("got %v, expected %v", err, errRefChanged)
+	}
+	if err := s.Update("refs/heads/new", a, &zero, ""); err != nil {
+		t.Error(err)
+	}
+	// D/F conflicts.
+	if err := s.Update("refs/heads/feature", a, nil, ""); err != errRefConflict {
+		t.Errorf("got %v, expected %v", err, errRefConflict)
+	}
+	// Locked refs.
+	ioutil.WriteFile(filepath.Join(dir, "refs/heads/new.lock"), nil, 0644)
+	if err := s.Update("refs/heads/new", b, nil, ""); err != errRefLocked {
+		t.Errorf("got %v, expected %v", err, errRefLocked)
+	}
+	os.Remove(filepath.Join(dir, "refs/heads/new.lock"))
+
+	// Deleting a ref removes it from packed-refs as well.
+	if err := s.Delete("refs/heads/master", &b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Read("refs/heads/master"); err != errRefNotFound {
+		t.Errorf("got %v after deletion, expected %v", err, errRefNotFound)
+	}
+	if err := s.Delete("refs/tags/v1.0", nil); err != nil {
+		t.Fatal(err)
+	}
+	packed, err := s.readPacked()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packed.refs) != 1 || packed.refs[0].Name != "refs/remotes/origin/master" {
+		t.Errorf("unexpected packed refs after deletion: %+v", packed.refs)
+	}
+	if err := s.Delete("refs/heads/feature/x", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "refs/heads/feature")); !os.IsNotExist(err) {
+		t.Errorf("empty directory refs/heads/feature was not removed")
+	}
+}
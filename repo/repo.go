@@ -6,51 +6,87 @@
 package repo
 
 import (
-	"bytes"
-	"encoding/hex"
-	"errors"
-	"io/ioutil"
 	"path/filepath"
+	"strings"
 
 	"github.com/remyoudompheng/gigot/objects"
 )
 
+// Open opens the Git repository at dirname, which is usually
+// a .git directory or a bare repository.
 func Open(dirname string) (*Repo, error) {
-	headfiles, err := ioutil.ReadDir(filepath.Join(dirname, "refs/heads"))
-	if err != nil {
+	repo := &Repo{Path: dirname, Refs: NewRefStore(dirname)}
+	var err error
+	if repo.Branches, err = repo.listRefs("refs/heads/"); err != nil {
 		return nil, err
 	}
-	repo := new(Repo)
-	repo.Path = dirname
-	for _, h := range headfiles {
-		s, err := ioutil.ReadFile(filepath.Join(dirname, "refs/heads", h.Name()))
-		if err != nil {
-			return nil, err
-		}
-		ref := Ref{Name: h.Name()}
-		s = bytes.TrimSpace(s)
-		n, err := hex.Decode(ref.Id[:], s)
-		if err != nil {
-			return nil, err
-		}
-		if n < 20 {
-			return nil, errTruncatedHead
-		}
-		repo.Branches = append(repo.Branches, ref)
+	if repo.Tags, err = repo.listRefs("refs/tags/"); err != nil {
+		return nil, err
+	}
+	if repo.Remotes, err = repo.listRefs("refs/remotes/"); err != nil {
+		return nil, err
+	}
+	repo.Objects, err = objects.OpenDatabase(filepath.Join(dirname, "objects"))
+	if err != nil {
+		return nil, err
 	}
 	return repo, nil
 }
 
-var (
-	errTruncatedHead = errors.New("gigot: head info truncated")
-)
+// listRefs lists references under a prefix, with names relative
+// to the prefix. Symbolic refs are resolved. Like Git, dangling
+// symbolic refs, such as the HEAD of a deleted remote branch, are
+// not an error: they are listed with a zero Id.
+func (r *Repo) listRefs(prefix string) ([]Ref, error) {
+	refs, err := r.Refs.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	for i, ref := range refs {
+		if ref.Target != "" {
+			target, err := r.Refs.Resolve(ref.Target)
+			switch {
+			case err == nil:
+				refs[i].Id = target.Id
+			case !isDangling(err):
+				return nil, err
+			}
+		}
+		refs[i].Name = strings.TrimPrefix(ref.Name, prefix)
+	}
+	return refs, nil
+}
 
 type Repo struct {
 	Path     string
-	Branches []Ref
+	Branches []Ref // Local branches, named relative to refs/heads/.
+	Tags     []Ref // Tags, named relative to refs/tags/.
+	Remotes  []Ref // Remote-tracking branches, named relative to refs/remotes/.
+	Refs     *RefStore
+	Objects  *objects.Database
+}
+
+// Head returns the reference currently checked out, usually
+// a branch.
+func (r *Repo) Head() (Ref, error) {
+	return r.Refs.Resolve("HEAD")
+}
+
+// Close releases the resources held by the repository.
+func (r *Repo) Close() error {
+	return r.Objects.Close()
+}
+
+// Object retrieves an object from the repository, whether it is
+// stored loose or in a pack.
+func (r *Repo) Object(h objects.Hash) (objects.Object, error) {
+	return r.Objects.Get(h)
 }
 
+// A Ref is a named pointer to an object, or to another ref.
 type Ref struct {
-	Name string
-	Id   objects.Hash
+	Name   string
+	Id     objects.Hash
+	Target string       // For symbolic refs, the name of the target ref.
+	Peeled objects.Hash // For packed annotated tags, the tagged object.
 }
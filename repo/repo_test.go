@@ -5,7 +5,12 @@
 package repo
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/remyoudompheng/gigot/objects"
 )
 
 func TestRepo(t *testing.T) {
@@ -15,3 +20,54 @@ func TestRepo(t *testing.T) {
 	}
 	t.Logf("%+v", repo)
 }
+
+func TestRepoObjects(t *testing.T) {
+	repo, err := Open("../.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	for _, b := range repo.Branches {
+		o, err := repo.Object(b.Id)
+		if err != nil {
+			t.Fatalf("branch %s: %s", b.Name, err)
+		}
+		if o.Type() != objects.COMMIT {
+			t.Errorf("branch %s points to a %s", b.Name, o.Type())
+		}
+	}
+}
+
+func TestOpenDanglingRefs(t *testing.T) {
+	dir := makeRefs(t)
+	defer os.RemoveAll(dir)
+	// The remote branch of origin/HEAD was deleted.
+	head := filepath.Join(dir, "refs", "remotes", "upstream", "HEAD")
+	os.MkdirAll(filepath.Dir(head), 0755)
+	if err := ioutil.WriteFile(head, []byte("ref: refs/remotes/upstream/master\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Mkdir(filepath.Join(dir, "objects"), 0755)
+
+	repo, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	refs := make(map[string]Ref)
+	for _, ref := range append(repo.Branches, repo.Remotes...) {
+		refs[ref.Name] = ref
+	}
+	for name, target := range map[string]string{
+		"upstream/HEAD": "refs/remotes/upstream/master",
+		"loop1":         "refs/heads/loop2",
+	} {
+		ref, ok := refs[name]
+		if !ok || ref.Id != (objects.Hash{}) || ref.Target != target {
+			t.Errorf("got ref %s = %+v, expected a dangling ref to %s", name, ref, target)
+		}
+	}
+	if ref := refs["origin/HEAD"]; ref.Id != hash(hashC) {
+		t.Errorf("origin/HEAD resolves to %s, expected %s", ref.Id, hashC)
+	}
+}
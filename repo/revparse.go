@@ -0,0 +1,605 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repo
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/remyoudompheng/gigot/dircache"
+	"github.com/remyoudompheng/gigot/objects"
+)
+
+// This file implements revision expressions.
+//
+// Cf. gitrevisions(7) for reference.
+
+type errUnknownRevision string
+
+func (err errUnknownRevision) Error() string {
+	return fmt.Sprintf("gigot: unknown revision %q", string(err))
+}
+
+type errAmbiguousRevision string
+
+func (err errAmbiguousRevision) Error() string {
+	return fmt.Sprintf("gigot: ambiguous revision %q", string(err))
+}
+
+type errBadRevision string
+
+func (err errBadRevision) Error() string {
+	return fmt.Sprintf("gigot: invalid revision syntax %q", string(err))
+}
+
+var (
+	errNoSuchParent = errors.New("gigot: commit has no such parent")
+	errBadPeel      = errors.New("gigot: object cannot be peeled to the requested type")
+	errNoSuchPath   = errors.New("gigot: path does not exist in tree")
+	errNoMatch      = errors.New("gigot: no commit message matches")
+)
+
+// minAbbrev is the minimal length of abbreviated hashes.
+const minAbbrev = 4
+
+// refRules is the search order of git when looking up a short
+// ref name, as in Git's ref_rev_parse_rules.
+var refRules = []string{
+	"%s",
+	"refs/%s",
+	"refs/tags/%s",
+	"refs/heads/%s",
+	"refs/remotes/%s",
+	"refs/remotes/%s/HEAD",
+}
+
+// Resolve evaluates a revision expression and returns the hash of
+// the designated object. The following syntax is supported:
+//
+//	<sha1>, <abbreviated sha1>, <refname>, @
+//	<rev>~<n>, <rev>^<n>, <rev>^{<type>}, <rev>^{}, <rev>^{/<regex>}
+//	<ref>@{<n>}, <ref>@{<date>}, @{-<n>}
+//	<rev>:<path>, :<path>, :<n>:<path>, :/<regex>
+func (r *Repo) Resolve(expr string) (objects.Hash, error) {
+	switch {
+	case expr == "":
+		return objects.Hash{}, errBadRevision(expr)
+	case strings.HasPrefix(expr, ":/"):
+		starts, err := r.allCommits()
+		if err != nil {
+			return objects.Hash{}, err
+		}
+		return r.searchMessage(starts, expr[2:])
+	case expr[0] == ':':
+		return r.resolveIndexPath(expr[1:])
+	}
+	if i := topLevelIndex(expr, ':'); i >= 0 {
+		h, err := r.Resolve(expr[:i])
+		if err != nil {
+			return h, err
+		}
+		if h, err = r.peel(h, objects.TREE); err != nil {
+			return h, err
+		}
+		return r.lookupPath(h, expr[i+1:])
+	}
+	base, suffix := expr, ""
+	if i := topLevelIndexAny(expr, "~^"); i >= 0 {
+		base, suffix = expr[:i], expr[i:]
+	}
+	h, err := r.resolveBase(base, suffix != "")
+	if err != nil {
+		return h, err
+	}
+	return r.applySuffix(h, suffix, expr)
+}
+
+// topLevelIndex returns the index of the first c in s outside of
+// braces, or -1.
+func topLevelIndex(s string, c byte) int {
+	return topLevelIndexAny(s, string(c))
+}
+
+func topLevelIndexAny(s string, chars string) int {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '{':
+			depth++
+		case s[i] == '}' && depth > 0:
+			depth--
+		case depth == 0 && strings.IndexByte(chars, s[i]) >= 0:
+			return i
+		}
+	}
+	return -1
+}
+
+// matchingBrace returns the index of the brace closing the one
+// at s[0], or -1.
+func matchingBrace(s string) int {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func isHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", rune(s[i])) {
+			return false
+		}
+	}
+	return true
+}
+
+// resolveBase resolves a revision without suffix operators. If
+// commitish is true, the revision is expected to name a commit,
+// which helps disambiguate abbreviated hashes.
+func (r *Repo) resolveBase(base string, commitish bool) (objects.Hash, error) {
+	if i := strings.Index(base, "@{"); i >= 0 && strings.HasSuffix(base, "}") {
+		return r.resolveReflog(base[:i], base[i+2:len(base)-1])
+	}
+	if base == "@" {
+		base = "HEAD"
+	}
+	if len(base) == 40 && isHex(base) {
+		var h objects.Hash
+		hex.Decode(h[:], []byte(base))
+		return h, nil
+	}
+	if ref, ok, err := r.dwimRef(base); ok || err != nil {
+		return ref.Id, err
+	}
+	if len(base) >= minAbbrev && isHex(base) {
+		return r.resolvePrefix(base, commitish)
+	}
+	return objects.Hash{}, errUnknownRevision(base)
+}
+
+// dwimRef looks up a short ref name using Git's search order.
+func (r *Repo) dwimRef(name string) (ref Ref, ok bool, err error) {
+	for _, full := range refCandidates(name) {
+		ref, err = r.Refs.Resolve(full)
+		switch err {
+		case nil:
+			return ref, true, nil
+		case errRefNotFound:
+			continue
+		}
+		return ref, false, err
+	}
+	return ref, false, nil
+}
+
+// refCandidates returns the full ref names a short name may
+// designate, in search order.
+func refCandidates(name string) []string {
+	if name == "" {
+		return nil
+	}
+	var names []string
+	for _, rule := range refRules {
+		full := fmt.Sprintf(rule, name)
+		if validRefName(full) && (rule != "%s" || isRootRef(full) || strings.HasPrefix(full, "refs/")) {
+			names = append(names, full)
+		}
+	}
+	return names
+}
+
+// isRootRef reports whether name can designate a ref stored at
+// the root of the repository, like HEAD or FETCH_HEAD.
+func isRootRef(name string) bool {
+	for _, c := range name {
+		if (c < 'A' || c > 'Z') && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Repo) resolvePrefix(prefix string, commitish bool) (objects.Hash, error) {
+	hashes, err := r.Objects.FindPrefix(prefix)
+	if err != nil {
+		return objects.Hash{}, err
+	}
+	if len(hashes) > 1 && commitish {
+		var commits []objects.Hash
+		for _, h := range hashes {
+			if o, err := r.Objects.Get(h); err == nil && o.Type() == objects.COMMIT {
+				commits = append(commits, h)
+			}
+		}
+		if len(commits) == 1 {
+			hashes = commits
+		}
+	}
+	switch len(hashes) {
+	case 0:
+		return objects.Hash{}, errUnknownRevision(prefix)
+	case 1:
+		return hashes[0], nil
+	}
+	return objects.Hash{}, errAmbiguousRevision(prefix)
+}
+
+// resolveReflog resolves ref@{selector}.
+func (r *Repo) resolveReflog(ref, selector string) (objects.Hash, error) {
+	if strings.HasPrefix(selector, "-") && ref == "" {
+		n, err := strconv.Atoi(selector[1:])
+		if err != nil || n <= 0 {
+			return objects.Hash{}, errBadRevision("@{" + selector + "}")
+		}
+		return r.previousCheckout(n)
+	}
+	var name string
+	switch ref {
+	case "":
+		// The current branch.
+		head, err := r.Refs.Read("HEAD")
+		if err != nil {
+			return objects.Hash{}, err
+		}
+		name = "HEAD"
+		if head.Target != "" {
+			name = head.Target
+		}
+	case "@", "HEAD":
+		name = "HEAD"
+	default:
+		for _, full := range refCandidates(ref) {
+			if _, err := r.Refs.Read(full); err == nil {
+				name = full
+				break
+			}
+		}
+		if name == "" {
+			return objects.Hash{}, errUnknownRevision(ref)
+		}
+	}
+	if n, err := strconv.Atoi(selector); err == nil {
+		return r.Refs.ReflogAt(name, n)
+	}
+	t, err := parseApproxDate(selector, time.Now())
+	if err != nil {
+		return objects.Hash{}, err
+	}
+	return r.Refs.ReflogAtTime(name, t)
+}
+
+// previousCheckout returns the n-th branch or commit checked out
+// before the current one, as recorded in the reflog of HEAD.
+func (r *Repo) previousCheckout(n int) (objects.Hash, error) {
+	entries, err := r.Refs.Reflog("HEAD")
+	if err != nil {
+		return objects.Hash{}, err
+	}
+	const prefix = "checkout: moving from "
+	for i := len(entries) - 1; i >= 0; i-- {
+		msg := entries[i].Message
+		if !strings.HasPrefix(msg, prefix) {
+			continue
+		}
+		if n--; n > 0 {
+			continue
+		}
+		from := msg[len(prefix):]
+		if j := strings.Index(from, " to "); j >= 0 {
+			from = from[:j]
+		}
+		return r.resolveBase(from, true)
+	}
+	return objects.Hash{}, errReflogTooShort
+}
+
+// applySuffix applies the ~, ^ and ^{...} operators.
+func (r *Repo) applySuffix(h objects.Hash, s string, expr string) (objects.Hash, error) {
+	for len(s) > 0 {
+		op := s[0]
+		s = s[1:]
+		if op == '^' && strings.HasPrefix(s, "{") {
+			end := matchingBrace(s)
+			if end < 0 {
+				return h, errBadRevision(expr)
+			}
+			var err error
+			h, err = r.peelExpr(h, s[1:end], expr)
+			if err != nil {
+				return h, err
+			}
+			s = s[end+1:]
+			continue
+		}
+		digits := 0
+		for digits < len(s) && '0' <= s[digits] && s[digits] <= '9' {
+			digits++
+		}
+		n := 1
+		if digits > 0 {
+			var err error
+			if n, err = strconv.Atoi(s[:digits]); err != nil {
+				return h, errBadRevision(expr)
+			}
+		}
+		s = s[digits:]
+		var err error
+		switch op {
+		case '~':
+			for i := 0; i < n && err == nil; i++ {
+				h, err = r.parent(h, 1)
+			}
+		case '^':
+			h, err = r.parent(h, n)
+		default:
+			err = errBadRevision(expr)
+		}
+		if err != nil {
+			return h, err
+		}
+	}
+	return h, nil
+}
+
+// parent returns the n-th parent of a commit, starting at 1.
+// The 0-th parent is the commit itself.
+func (r *Repo) parent(h objects.Hash, n int) (objects.Hash, error) {
+	h, err := r.peel(h, objects.COMMIT)
+	if err != nil || n == 0 {
+		return h, err
+	}
+	o, err := r.Objects.Get(h)
+	if err != nil {
+		return h, err
+	}
+	parents := o.(objects.Commit).Parents
+	if n > len(parents) {
+		return h, errNoSuchParent
+	}
+	return parents[n-1], nil
+}
+
+// peelExpr evaluates the contents of a ^{...} operator.
+func (r *Repo) peelExpr(h objects.Hash, what string, expr string) (objects.Hash, error) {
+	switch what {
+	case "":
+		// Peel tags until a non-tag object.
+		for {
+			o, err := r.Objects.Get(h)
+			if err != nil {
+				return h, err
+			}
+			tag, ok := o.(objects.Tag)
+			if !ok {
+				return h, nil
+			}
+			h = tag.Object
+		}
+	case "object":
+		_, err := r.Objects.Get(h)
+		return h, err
+	case "commit":
+		return r.peel(h, objects.COMMIT)
+	case "tree":
+		return r.peel(h, objects.TREE)
+	case "blob":
+		return r.peel(h, objects.BLOB)
+	case "tag":
+		return r.peel(h, objects.TAG)
+	}
+	if strings.HasPrefix(what, "/") {
+		return r.searchMessage([]objects.Hash{h}, what[1:])
+	}
+	return h, errBadRevision(expr)
+}
+
+// peel dereferences tags, and commits to their trees, until an
+// object of type t is found.
+func (r *Repo) peel(h objects.Hash, t objects.ObjType) (objects.Hash, error) {
+	for {
+		o, err := r.Objects.Get(h)
+		if err != nil {
+			return h, err
+		}
+		if o.Type() == t {
+			return h, nil
+		}
+		switch o := o.(type) {
+		case objects.Tag:
+			h = o.Object
+		case objects.Commit:
+			if t != objects.TREE {
+				return h, errBadPeel
+			}
+			return o.Tree, nil
+		default:
+			return h, errBadPeel
+		}
+	}
+}
+
+// lookupPath finds the object at path in a tree.
+func (r *Repo) lookupPath(tree objects.Hash, path string) (objects.Hash, error) {
+	h := tree
+	for _, name := range strings.Split(path, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		o, err := r.Objects.Get(h)
+		if err != nil {
+			return h, err
+		}
+		t, ok := o.(objects.Tree)
+		if !ok {
+			return h, errNoSuchPath
+		}
+		found := false
+		for _, e := range t.Entries {
+			if e.Name == name {
+				h, found = e.Hash, true
+				break
+			}
+		}
+		if !found {
+			return h, errNoSuchPath
+		}
+	}
+	return h, nil
+}
+
+// resolveIndexPath resolves [<n>:]<path> in the index.
+func (r *Repo) resolveIndexPath(s string) (objects.Hash, error) {
+	stage := 0
+	if len(s) >= 2 && s[1] == ':' && '0' <= s[0] && s[0] <= '3' {
+		stage, s = int(s[0]-'0'), s[2:]
+	}
+	idx, err := dircache.ReadFile(filepath.Join(r.Path, "index"))
+	if err != nil {
+		return objects.Hash{}, err
+	}
+	for _, e := range idx.Entries {
+		if e.Path == s && e.Stage == stage {
+			return e.Hash, nil
+		}
+	}
+	return objects.Hash{}, errNoSuchPath
+}
+
+// allCommits returns the commits pointed to by refs, peeling tags.
+func (r *Repo) allCommits() ([]objects.Hash, error) {
+	refs, err := r.Refs.List("")
+	if err != nil {
+		return nil, err
+	}
+	if head, err := r.Refs.Read("HEAD"); err == nil {
+		refs = append(refs, head)
+	}
+	var starts []objects.Hash
+	for _, ref := range refs {
+		if ref.Target != "" {
+			if ref, err = r.Refs.Resolve(ref.Target); err != nil {
+				continue
+			}
+		}
+		if h, err := r.peel(ref.Id, objects.COMMIT); err == nil {
+			starts = append(starts, h)
+		}
+	}
+	return starts, nil
+}
+
+// searchMessage returns the most recent commit reachable from
+// starts whose message matches a regular expression. A pattern
+// starting with "!-" selects commits not matching the rest of it,
+// and "!!" escapes a literal "!".
+func (r *Repo) searchMessage(starts []objects.Hash, pattern string) (objects.Hash, error) {
+	negate := false
+	switch {
+	case strings.HasPrefix(pattern, "!-"):
+		negate, pattern = true, pattern[2:]
+	case strings.HasPrefix(pattern, "!!"):
+		pattern = pattern[1:]
+	case strings.HasPrefix(pattern, "!"):
+		return objects.Hash{}, errBadRevision(pattern)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return objects.Hash{}, err
+	}
+	w := r.RevWalk()
+	for _, h := range starts {
+		c, err := r.peel(h, objects.COMMIT)
+		if err != nil {
+			return c, err
+		}
+		if err := w.Push(c); err != nil {
+			return c, err
+		}
+	}
+	for {
+		c, err := w.Next()
+		if err == io.EOF {
+			return objects.Hash{}, errNoMatch
+		}
+		if err != nil {
+			return objects.Hash{}, err
+		}
+		if re.Match(c.Message) != negate {
+			return c.Hash, nil
+		}
+	}
+}
+
+var dateLayouts = []string{
+	"2006-01-02",
+	"2006-01-02 15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05 -0700",
+	time.RFC3339,
+	time.RFC1123Z,
+	time.RFC1123,
+	time.RFC822Z,
+	time.UnixDate,
+}
+
+var dateUnits = map[string]time.Duration{
+	"second": time.Second,
+	"minute": time.Minute,
+	"hour":   time.Hour,
+	"day":    24 * time.Hour,
+	"week":   7 * 24 * time.Hour,
+}
+
+// parseApproxDate parses the dates accepted in reflog selectors:
+// "now", "yesterday", "<n> <unit>s ago" (where spaces may be dots)
+// and absolute dates in common formats, interpreted in local time.
+func parseApproxDate(s string, now time.Time) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	switch s {
+	case "now":
+		return now, nil
+	case "yesterday":
+		return now.AddDate(0, 0, -1), nil
+	}
+	for _, layout := range dateLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	words := strings.FieldsFunc(s, func(r rune) bool { return r == ' ' || r == '.' })
+	if len(words) == 3 && words[2] == "ago" {
+		n, err := strconv.Atoi(words[0])
+		unit := strings.TrimSuffix(words[1], "s")
+		if err == nil {
+			switch unit {
+			case "month":
+				return now.AddDate(0, -n, 0), nil
+			case "year":
+				return now.AddDate(-n, 0, 0), nil
+			}
+			if d, ok := dateUnits[unit]; ok {
+				return now.Add(-time.Duration(n) * d), nil
+			}
+		}
+	}
+	return time.Time{}, errBadRevision("@{" + s + "}")
+}
@@ -0,0 +1,188 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repo
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/remyoudompheng/gigot/dircache"
+	"github.com/remyoudompheng/gigot/objects"
+)
+
+// testRepo creates a repository holding the history of testHistory,
+// with branches master (F) and side (D), an annotated tag v1 (C)
+// and an index holding the tree of D.
+func testRepo(t *testing.T) (r *Repo, commits map[string]objects.Hash) {
+	dir, commits, _ := testHistory(t)
+	store := objects.NewLooseStore(filepath.Join(dir, "objects"))
+	tag := objects.Tag{
+		Object:     commits["C"],
+		ObjectType: objects.COMMIT,
+		Name:       "v1",
+		Tagger:     "A U Thor <author@example.com>",
+		TaggerTime: time.Unix(1356355981, 0).In(time.FixedZone("+0100", 3600)),
+		Message:    []byte("Version 1\n"),
+	}
+	taghash, err := store.Put(tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs := NewRefStore(dir)
+	refs.Identity = "A U Thor <author@example.com>"
+	if err := refs.SetSymbolic("HEAD", "refs/heads/master"); err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []struct{ name, msg string }{
+		{"A", "commit (initial): A"}, {"B", "commit: B"}, {"C", "commit: C"},
+		{"E", "merge side"}, {"F", "commit: F"},
+	} {
+		if err := refs.Update("refs/heads/master", commits[u.name], nil, u.msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	refs.Update("refs/heads/side", commits["D"], nil, "branch: Created from B")
+	refs.Update("refs/tags/v1", taghash, nil, "")
+
+	idx := &dircache.Index{Version: 2}
+	o, _ := store.Get(commits["D"])
+	tree, _ := store.Get(o.(objects.Commit).Tree)
+	for _, e := range tree.(objects.Tree).Entries {
+		if e.Name == "name" {
+			idx.Add(dircache.Entry{Path: "name", Mode: 0100644, Hash: e.Hash})
+		}
+	}
+	if err := idx.WriteFile(filepath.Join(dir, "index")); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, commits
+}
+
+func TestResolve(t *testing.T) {
+	r, commits := testRepo(t)
+	defer os.RemoveAll(r.Path)
+	defer r.Close()
+
+	blobOf := func(commit string) objects.Hash {
+		return objects.NewHash([]byte("blob 2\x00" + commit + "\n"))
+	}
+	tagHash, err := r.Refs.Resolve("refs/tags/v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		expr   string
+		expect objects.Hash
+	}{
+		{"HEAD", commits["F"]},
+		{"@", commits["F"]},
+		{"master", commits["F"]},
+		{"refs/heads/side", commits["D"]},
+		{"heads/side", commits["D"]},
+		{commits["B"].String(), commits["B"]},
+		{commits["B"].String()[:7], commits["B"]},
+		{"v1", tagHash.Id},
+		{"v1^{}", commits["C"]},
+		{"v1^{commit}", commits["C"]},
+		{"v1~1", commits["B"]},
+		{"HEAD~2", commits["C"]},
+		{"HEAD~", commits["E"]},
+		{"HEAD^", commits["E"]},
+		{"HEAD^^2", commits["D"]},
+		{"HEAD~1^2~1", commits["B"]},
+		{"HEAD^0", commits["F"]},
+		{"master^{/Commit B}", commits["B"]},
+		{"HEAD^{/^Commit [CD]}~1", commits["B"]},
+		{":/Commit D", commits["D"]},
+		{"side:name", blobOf("D")},
+		{"HEAD~2:dir/file", blobOf("C")},
+		{"HEAD^{tree}", func() objects.Hash {
+			o, _ := r.Object(commits["F"])
+			return o.(objects.Commit).Tree
+		}()},
+		{":name", blobOf("D")},
+		{":0:name", blobOf("D")},
+		{"master@{0}", commits["F"]},
+		{"master@{1}", commits["E"]},
+		{"@{3}", commits["B"]},
+		{"HEAD@{1}", commits["E"]},
+		{"master@{1 hour ago}", commits["A"]},
+		{"master@{now}", commits["F"]},
+		{"side@{0}~1", commits["B"]},
+	} {
+		h, err := r.Resolve(test.expr)
+		if err != nil {
+			t.Errorf("%s: %s", test.expr, err)
+			continue
+		}
+		if h != test.expect {
+			t.Errorf("%s: got %s, expected %s", test.expr, h, test.expect)
+		}
+	}
+
+	for _, expr := range []string{
+		"nonexistent", "HEAD~10", "HEAD^3", "master:nofile",
+		"HEAD^{/nomatch}", "master@{10}", "v1^{blob}", "HEAD^{",
+	} {
+		if h, err := r.Resolve(expr); err == nil {
+			t.Errorf("%s: got %s, expected an error", expr, h)
+		}
+	}
+}
+
+func TestResolveAmbiguous(t *testing.T) {
+	r, _ := testRepo(t)
+	defer os.RemoveAll(r.Path)
+	defer r.Close()
+
+	// Find two objects sharing a 4-digit prefix.
+	seen := make(map[string]bool)
+	ambiguous := ""
+	r.Objects.Iterate(func(h objects.Hash) error {
+		p := h.String()[:minAbbrev]
+		if seen[p] {
+			ambiguous = p
+		}
+		seen[p] = true
+		return nil
+	})
+	if ambiguous == "" {
+		t.Skip("no ambiguous prefix in test repository")
+	}
+	if _, err := r.Resolve(ambiguous); err != errAmbiguousRevision(ambiguous) {
+		t.Errorf("got %v, expected %v", err, errAmbiguousRevision(ambiguous))
+	}
+}
+
+func TestParseApproxDate(t *testing.T) {
+	now := time.Date(2012, 12, 24, 14, 0, 0, 0, time.Local)
+	for _, test := range []struct {
+		s      string
+		expect time.Time
+	}{
+		{"now", now},
+		{"yesterday", now.AddDate(0, 0, -1)},
+		{"2.days.ago", now.AddDate(0, 0, -2)},
+		{"3 hours ago", now.Add(-3 * time.Hour)},
+		{"1 month ago", now.AddDate(0, -1, 0)},
+		{"2012-12-01", time.Date(2012, 12, 1, 0, 0, 0, 0, time.Local)},
+		{"2012-12-01 10:30:00", time.Date(2012, 12, 1, 10, 30, 0, 0, time.Local)},
+	} {
+		got, err := parseApproxDate(test.s, now)
+		if err != nil {
+			t.Errorf("%s: %s", test.s, err)
+		} else if !got.Equal(test.expect) {
+			t.Errorf("%s: got %s, expected %s", test.s, got, test.expect)
+		}
+	}
+}
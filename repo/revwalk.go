@@ -0,0 +1,443 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repo
+
+import (
+	"container/heap"
+	"errors"
+	"io"
+
+	"github.com/remyoudompheng/gigot/objects"
+)
+
+// This file implements traversal of the commit graph, in the
+// manner of git-rev-list(1).
+
+// A SortOrder defines the order in which a RevWalk yields commits.
+type SortOrder int
+
+const (
+	// SortDate yields commits by decreasing commit date.
+	SortDate SortOrder = iota
+	// SortTopo never yields a parent before all its children,
+	// and avoids intermixing lines of history.
+	SortTopo
+)
+
+// A RevWalk walks the history of a repository: it yields commits
+// reachable from a set of starting commits but not from a set of
+// hidden commits, as in "git rev-list A B ^C".
+type RevWalk struct {
+	Sort        SortOrder
+	Reverse     bool // Yield commits in reverse order.
+	FirstParent bool // Only follow the first parent of merges.
+	MaxCount    int  // Maximal number of commits to yield, if positive.
+
+	store   objects.ObjectStore
+	graph   *objects.CommitGraph
+	commits map[objects.Hash]*walkCommit
+	queue   commitQueue
+	tips    []*walkCommit
+	hidden  bool
+	started bool
+	list    []*walkCommit // the precomputed output, in limited mode.
+	limited bool
+	count   int
+	err     error
+}
+
+// walkCommit holds the data needed to walk through a commit.
+type walkCommit struct {
+	hash    objects.Hash
+	parents []objects.Hash
+	time    int64           // committer time.
+	gen     uint32          // generation number, or zero if unknown.
+	commit  *objects.Commit // nil until needed, for commits read from the commit-graph.
+	flags   uint8
+}
+
+const (
+	walkSeen          = 1 << iota // the commit was queued.
+	walkUninteresting             // the commit is reachable from a hidden commit.
+	walkShown                     // the commit was yielded.
+)
+
+var (
+	errWalkStarted = errors.New("gigot: revision walk already started")
+	errNotCommit   = errors.New("gigot: object is not a commit")
+)
+
+// NewRevWalk returns a RevWalk loading commits from store. If store
+// is a Database with a commit-graph, parents and dates of commits are
+// read from the commit-graph, and only yielded commits are decoded.
+func NewRevWalk(store objects.ObjectStore) *RevWalk {
+	w := &RevWalk{
+		store:   store,
+		commits: make(map[objects.Hash]*walkCommit),
+	}
+	if db, ok := store.(*objects.Database); ok {
+		w.graph = db.CommitGraph
+	}
+	return w
+}
+
+// RevWalk returns a RevWalk over the commits of the repository.
+func (r *Repo) RevWalk() *RevWalk {
+	return NewRevWalk(r.Objects)
+}
+
+// lookup loads a commit, or returns it from cache.
+func (w *RevWalk) lookup(h objects.Hash) (*walkCommit, error) {
+	if c, ok := w.commits[h]; ok {
+		return c, nil
+	}
+	if c := w.lookupGraph(h); c != nil {
+		w.commits[h] = c
+		return c, nil
+	}
+	o, err := w.store.Get(h)
+	if err != nil {
+		return nil, err
+	}
+	commit, ok := o.(objects.Commit)
+	if !ok {
+		return nil, errNotCommit
+	}
+	c := &walkCommit{
+		hash:    h,
+		parents: commit.Parents,
+		time:    commit.CommitterTime.Unix(),
+		commit:  &commit,
+	}
+	w.commits[h] = c
+	return c, nil
+}
+
+// lookupGraph reads a commit from the commit-graph. It returns nil
+// if the commit is not found there.
+func (w *RevWalk) lookupGraph(h objects.Hash) *walkCommit {
+	if w.graph == nil {
+		return nil
+	}
+	pos, err := w.graph.Find(h)
+	if err != nil {
+		return nil
+	}
+	gc, err := w.graph.Commit(pos)
+	if err != nil {
+		return nil
+	}
+	c := &walkCommit{hash: h, time: gc.Time, gen: gc.Generation}
+	for _, p := range gc.Parents {
+		ph, err := w.graph.HashAt(p)
+		if err != nil {
+			return nil
+		}
+		c.parents = append(c.parents, ph)
+	}
+	return c
+}
+
+// load returns the decoded commit c.
+func (w *RevWalk) load(c *walkCommit) (objects.Commit, error) {
+	if c.commit != nil {
+		return *c.commit, nil
+	}
+	o, err := w.store.Get(c.hash)
+	if err != nil {
+		return objects.Commit{}, err
+	}
+	commit, ok := o.(objects.Commit)
+	if !ok {
+		return objects.Commit{}, errNotCommit
+	}
+	c.commit = &commit
+	return commit, nil
+}
+
+// Push adds starting points of the walk.
+func (w *RevWalk) Push(hashes ...objects.Hash) error {
+	return w.add(hashes, 0)
+}
+
+// Hide excludes commits reachable from the given commits from
+// the walk.
+func (w *RevWalk) Hide(hashes ...objects.Hash) error {
+	w.hidden = true
+	return w.add(hashes, walkUninteresting)
+}
+
+func (w *RevWalk) add(hashes []objects.Hash, flags uint8) error {
+	if w.started {
+		return errWalkStarted
+	}
+	for _, h := range hashes {
+		c, err := w.lookup(h)
+		if err != nil {
+			return err
+		}
+		c.flags |= flags
+		w.tips = append(w.tips, c)
+	}
+	return nil
+}
+
+// parentsOf returns the parents followed by the walk.
+func (w *RevWalk) parentsOf(c *walkCommit) []objects.Hash {
+	if w.FirstParent && len(c.parents) > 1 {
+		return c.parents[:1]
+	}
+	return c.parents
+}
+
+// enqueueParents adds the parents of c to the queue, and propagates
+// the uninteresting flag.
+func (w *RevWalk) enqueueParents(c *walkCommit) error {
+	for _, h := range w.parentsOf(c) {
+		p, err := w.lookup(h)
+		if err != nil {
+			return err
+		}
+		if c.flags&walkUninteresting != 0 && p.flags&walkUninteresting == 0 {
+			w.markUninteresting(p)
+		}
+		if p.flags&walkSeen == 0 {
+			p.flags |= walkSeen
+			w.queue.push(p)
+		}
+	}
+	return nil
+}
+
+// markUninteresting marks a commit and its already loaded
+// ancestors as uninteresting.
+func (w *RevWalk) markUninteresting(c *walkCommit) {
+	stack := []*walkCommit{c}
+	for len(stack) > 0 {
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		c.flags |= walkUninteresting
+		for _, h := range w.parentsOf(c) {
+			if p, ok := w.commits[h]; ok && p.flags&walkUninteresting == 0 {
+				stack = append(stack, p)
+			}
+		}
+	}
+}
+
+// start initializes the walk, and computes the output list
+// if the walk cannot be streamed.
+func (w *RevWalk) start() error {
+	w.started = true
+	for _, c := range w.tips {
+		if c.flags&walkSeen == 0 {
+			c.flags |= walkSeen
+			w.queue.push(c)
+		}
+	}
+	w.limited = w.hidden || w.Sort == SortTopo || w.Reverse
+	if !w.limited {
+		return nil
+	}
+	list, err := w.limit()
+	if err != nil {
+		return err
+	}
+	if w.Sort == SortTopo {
+		list = w.sortTopo(list)
+	}
+	if w.MaxCount > 0 && len(list) > w.MaxCount {
+		list = list[:w.MaxCount]
+	}
+	if w.Reverse {
+		for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+			list[i], list[j] = list[j], list[i]
+		}
+	}
+	w.list = list
+	return nil
+}
+
+// slop is the number of extra commits examined after only
+// uninteresting commits remain, to tolerate clock skew.
+const slop = 5
+
+// limit walks the history until the set of commits to output
+// is known. Commits are returned by decreasing date.
+func (w *RevWalk) limit() ([]*walkCommit, error) {
+	var list []*walkCommit
+	extra := slop
+	for w.queue.Len() > 0 {
+		c := w.queue.pop()
+		if err := w.enqueueParents(c); err != nil {
+			return nil, err
+		}
+		if c.flags&walkUninteresting == 0 {
+			list = append(list, c)
+		}
+		if w.queue.onlyUninteresting() {
+			if extra--; extra == 0 {
+				break
+			}
+		} else {
+			extra = slop
+		}
+	}
+	// Some commits may have been found to be uninteresting after
+	// being added to the list.
+	out := list[:0]
+	for _, c := range list {
+		if c.flags&walkUninteresting == 0 {
+			out = append(out, c)
+		}
+	}
+	return out, nil
+}
+
+// sortTopo sorts commits so that children come before their
+// parents. Like Git, it walks down each line of history as far as
+// possible before switching to another one.
+func (w *RevWalk) sortTopo(list []*walkCommit) []*walkCommit {
+	children := make(map[*walkCommit]int, len(list))
+	for _, c := range list {
+		children[c] += 0
+	}
+	for _, c := range list {
+		for _, h := range w.parentsOf(c) {
+			if p := w.commits[h]; p != nil {
+				if _, ok := children[p]; ok {
+					children[p]++
+				}
+			}
+		}
+	}
+	// Tips, in date order: the stack yields the most recent first.
+	var stack []*walkCommit
+	for i := len(list) - 1; i >= 0; i-- {
+		if children[list[i]] == 0 {
+			stack = append(stack, list[i])
+		}
+	}
+	sorted := make([]*walkCommit, 0, len(list))
+	for len(stack) > 0 {
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		sorted = append(sorted, c)
+		parents := w.parentsOf(c)
+		// Push parents in reverse order so that the first parent
+		// is visited first.
+		for i := len(parents) - 1; i >= 0; i-- {
+			p := w.commits[parents[i]]
+			n, ok := children[p]
+			if !ok {
+				continue
+			}
+			children[p] = n - 1
+			if n == 1 {
+				stack = append(stack, p)
+			}
+		}
+	}
+	return sorted
+}
+
+// Next returns the next commit of the walk. It returns io.EOF
+// when the walk is over.
+func (w *RevWalk) Next() (objects.Commit, error) {
+	if w.err != nil {
+		return objects.Commit{}, w.err
+	}
+	if !w.started {
+		if w.err = w.start(); w.err != nil {
+			return objects.Commit{}, w.err
+		}
+	}
+	c, err := w.next()
+	if err != nil {
+		w.err = err
+		return objects.Commit{}, err
+	}
+	commit, err := w.load(c)
+	if err != nil {
+		w.err = err
+		return objects.Commit{}, err
+	}
+	w.count++
+	return commit, nil
+}
+
+func (w *RevWalk) next() (*walkCommit, error) {
+	if w.limited {
+		if len(w.list) == 0 {
+			return nil, io.EOF
+		}
+		c := w.list[0]
+		w.list = w.list[1:]
+		return c, nil
+	}
+	if w.MaxCount > 0 && w.count >= w.MaxCount {
+		return nil, io.EOF
+	}
+	for w.queue.Len() > 0 {
+		c := w.queue.pop()
+		if err := w.enqueueParents(c); err != nil {
+			return nil, err
+		}
+		if c.flags&walkShown == 0 {
+			c.flags |= walkShown
+			return c, nil
+		}
+	}
+	return nil, io.EOF
+}
+
+// A commitQueue is a priority queue of commits, yielding the most
+// recent commits first, and commits with equal dates in insertion
+// order.
+type commitQueue struct {
+	items []queueItem
+	n     int
+}
+
+type queueItem struct {
+	c   *walkCommit
+	seq int
+}
+
+func (q *commitQueue) Len() int { return len(q.items) }
+func (q *commitQueue) Less(i, j int) bool {
+	a, b := q.items[i], q.items[j]
+	if a.c.time != b.c.time {
+		return a.c.time > b.c.time
+	}
+	return a.seq < b.seq
+}
+func (q *commitQueue) Swap(i, j int)      { q.items[i], q.items[j] = q.items[j], q.items[i] }
+func (q *commitQueue) Push(x interface{}) { q.items = append(q.items, x.(queueItem)) }
+func (q *commitQueue) Pop() interface{} {
+	x := q.items[len(q.items)-1]
+	q.items = q.items[:len(q.items)-1]
+	return x
+}
+
+func (q *commitQueue) push(c *walkCommit) {
+	heap.Push(q, queueItem{c: c, seq: q.n})
+	q.n++
+}
+
+func (q *commitQueue) pop() *walkCommit {
+	return heap.Pop(q).(queueItem).c
+}
+
+// onlyUninteresting reports whether all queued commits are
+// uninteresting.
+func (q *commitQueue) onlyUninteresting() bool {
+	for _, it := range q.items {
+		if it.c.flags&walkUninteresting == 0 {
+			return false
+		}
+	}
+	return true
+}
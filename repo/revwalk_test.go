@@ -0,0 +1,203 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repo
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/remyoudompheng/gigot/objects"
+)
+
+// testHistory stores a small history in the object store of a
+// temporary repository:
+//
+//	A - B - C - E - F
+//	     \     /
+//	      - D -
+//
+// Commit dates follow alphabetical order.
+func testHistory(t *testing.T) (dir string, commits map[string]objects.Hash, names map[objects.Hash]string) {
+	return buildHistory(t, "A", "B A", "C B", "D B", "E C D", "F E")
+}
+
+// buildHistory stores commits in the object store of a temporary
+// repository. Each spec is the name of a commit followed by the
+// names of its parents, which must come earlier. Commit dates follow
+// the order of specs. The tree of each commit holds a file "name" and
+// a file "dir/file", both containing the commit name.
+func buildHistory(t *testing.T, specs ...string) (dir string, commits map[string]objects.Hash, names map[objects.Hash]string) {
+	dir, err := ioutil.TempDir("", "gigot-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := objects.NewLooseStore(filepath.Join(dir, "objects"))
+	commits = make(map[string]objects.Hash)
+	names = make(map[objects.Hash]string)
+	put := func(o objects.Object) objects.Hash {
+		h, err := store.Put(o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	for i, spec := range specs {
+		words := strings.Fields(spec)
+		blob := put(objects.Blob{Data: []byte(words[0] + "\n")})
+		sub := put(objects.Tree{Entries: []objects.TreeElem{{Name: "file", Mode: 0644, Hash: blob}}})
+		tree := put(objects.Tree{Entries: []objects.TreeElem{
+			{Name: "dir", Mode: os.ModeDir, Hash: sub},
+			{Name: "name", Mode: 0644, Hash: blob},
+		}})
+		when := time.Unix(1356355981+int64(i)*3600, 0).In(time.FixedZone("+0100", 3600))
+		c := objects.Commit{
+			Tree:          tree,
+			Author:        "A U Thor <author@example.com>",
+			AuthorTime:    when,
+			Committer:     "A U Thor <author@example.com>",
+			CommitterTime: when,
+			Message:       []byte("Commit " + words[0] + "\n"),
+		}
+		for _, p := range words[1:] {
+			c.Parents = append(c.Parents, commits[p])
+		}
+		h := put(c)
+		commits[words[0]] = h
+		names[h] = words[0]
+	}
+	return dir, commits, names
+}
+
+func walkNames(t *testing.T, w *RevWalk, names map[objects.Hash]string) string {
+	var s []string
+	for {
+		c, err := w.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		s = append(s, names[c.Hash])
+	}
+	return strings.Join(s, " ")
+}
+
+func TestRevWalk(t *testing.T) {
+	dir, commits, names := testHistory(t)
+	defer os.RemoveAll(dir)
+	store := objects.NewLooseStore(filepath.Join(dir, "objects"))
+	testRevWalk(t, func() *RevWalk { return NewRevWalk(store) }, commits, names)
+}
+
+func TestRevWalkCommitGraph(t *testing.T) {
+	dir, commits, names := testHistory(t)
+	defer os.RemoveAll(dir)
+	r, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if err := r.Refs.Update("refs/heads/master", commits["F"], nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	// Dangling symbolic refs are ignored.
+	if err := r.Refs.SetSymbolic("refs/remotes/origin/HEAD", "refs/remotes/origin/gone"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.WriteCommitGraph(); err != nil {
+		t.Fatal(err)
+	}
+	g := r.Objects.CommitGraph
+	if g == nil || g.Len() != len(commits) {
+		t.Fatalf("commit-graph was not written")
+	}
+	pos, err := g.Find(commits["E"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, err := g.Commit(pos); err != nil || c.Generation != 4 || len(c.Parents) != 2 {
+		t.Errorf("commit E: got %+v, %v", c, err)
+	}
+	testRevWalk(t, r.RevWalk, commits, names)
+
+	// Hidden commits are not decoded.
+	w := r.RevWalk()
+	w.Push(commits["F"])
+	w.Hide(commits["C"])
+	if got := walkNames(t, w, names); got != "F E D" {
+		t.Errorf("got %q", got)
+	}
+	for _, name := range []string{"A", "B", "C"} {
+		if c := w.commits[commits[name]]; c == nil || c.commit != nil {
+			t.Errorf("commit %s was not read from the commit-graph", name)
+		}
+	}
+
+	// Commits missing from the commit-graph are decoded.
+	o, err := r.Objects.Get(commits["F"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	g2 := o.(objects.Commit)
+	g2.Parents = []objects.Hash{commits["F"]}
+	g2.CommitterTime = g2.CommitterTime.Add(time.Hour)
+	g2.Message = []byte("Commit G\n")
+	h, err := r.Objects.Put(g2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names[h] = "G"
+	w = r.RevWalk()
+	w.Push(h)
+	if got := walkNames(t, w, names); got != "G F E D C B A" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func testRevWalk(t *testing.T, newWalk func() *RevWalk, commits map[string]objects.Hash, names map[objects.Hash]string) {
+	for _, test := range []struct {
+		push, hide  string
+		sort        SortOrder
+		reverse     bool
+		firstParent bool
+		max         int
+		expect      string
+	}{
+		{push: "F", expect: "F E D C B A"},
+		{push: "F", firstParent: true, expect: "F E C B A"},
+		{push: "F", hide: "C", expect: "F E D"},
+		{push: "D", hide: "C", expect: "D"},
+		{push: "F D", hide: "E", expect: "F"},
+		{push: "C D", expect: "D C B A"},
+		{push: "F", sort: SortTopo, expect: "F E C D B A"},
+		{push: "F", reverse: true, expect: "A B C D E F"},
+		{push: "F", max: 2, expect: "F E"},
+		{push: "F", max: 2, reverse: true, expect: "E F"},
+		{push: "F", hide: "D", sort: SortTopo, expect: "F E C"},
+	} {
+		w := newWalk()
+		w.Sort, w.Reverse = test.sort, test.reverse
+		w.FirstParent, w.MaxCount = test.firstParent, test.max
+		for _, name := range strings.Fields(test.push) {
+			if err := w.Push(commits[name]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, name := range strings.Fields(test.hide) {
+			if err := w.Hide(commits[name]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := walkNames(t, w, names); got != test.expect {
+			t.Errorf("%+v: got %q", test, got)
+		}
+	}
+}
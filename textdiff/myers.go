@@ -0,0 +1,105 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package textdiff
+
+// This file implements the O(ND) difference algorithm of Eugene
+// W. Myers, in its linear space variant: forward and backward
+// searches meet in the middle of an optimal path, which splits
+// the problem in two halves.
+
+// myers marks the changed lines between a[a0:a1] and b[b0:b1].
+func (d *differ) myers(a0, a1, b0, b1 int) {
+	a0, a1, b0, b1 = d.trim(a0, a1, b0, b1)
+	if a0 == a1 || b0 == b1 {
+		d.markAll(a0, a1, b0, b1)
+		return
+	}
+	x, y, ok := d.bisect(a0, a1, b0, b1)
+	if !ok {
+		d.markAll(a0, a1, b0, b1)
+		return
+	}
+	d.myers(a0, x, b0, y)
+	d.myers(x, a1, y, b1)
+}
+
+// bisect finds a point (x, y) of an optimal edit path between
+// a[a0:a1] and b[b0:b1], which must be non-empty and differ in
+// their first and last lines.
+func (d *differ) bisect(a0, a1, b0, b1 int) (x, y int, ok bool) {
+	n, m := a1-a0, b1-b0
+	maxD := (n + m + 1) / 2
+	// vf[off+k] is the furthest x reached by forward paths on
+	// diagonal k = x-y. vb is the same for backward paths,
+	// measured from the end of both texts.
+	off := maxD
+	vf := make([]int, 2*maxD+2)
+	vb := make([]int, 2*maxD+2)
+	for i := range vf {
+		vf[i], vb[i] = -1, -1
+	}
+	vf[off+1], vb[off+1] = 0, 0
+	delta := n - m
+	// If delta is odd, paths overlap after a forward step,
+	// otherwise after a backward step.
+	odd := delta%2 != 0
+	// Diagonals leaving the edit graph are skipped.
+	kfStart, kfEnd, kbStart, kbEnd := 0, 0, 0, 0
+	for D := 0; D < maxD; D++ {
+		for k := -D + kfStart; k <= D-kfEnd; k += 2 {
+			var x int
+			if k == -D || (k != D && vf[off+k-1] < vf[off+k+1]) {
+				x = vf[off+k+1]
+			} else {
+				x = vf[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && d.a[a0+x] == d.b[b0+y] {
+				x, y = x+1, y+1
+			}
+			vf[off+k] = x
+			switch {
+			case x > n:
+				kfEnd += 2
+			case y > m:
+				kfStart += 2
+			case odd:
+				kb := off + delta - k
+				if kb >= 0 && kb < len(vb) && vb[kb] != -1 && x >= n-vb[kb] {
+					return a0 + x, b0 + y, true
+				}
+			}
+		}
+		for k := -D + kbStart; k <= D-kbEnd; k += 2 {
+			var x int
+			if k == -D || (k != D && vb[off+k-1] < vb[off+k+1]) {
+				x = vb[off+k+1]
+			} else {
+				x = vb[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && d.a[a1-x-1] == d.b[b1-y-1] {
+				x, y = x+1, y+1
+			}
+			vb[off+k] = x
+			switch {
+			case x > n:
+				kbEnd += 2
+			case y > m:
+				kbStart += 2
+			case !odd:
+				kf := off + delta - k
+				if kf >= 0 && kf < len(vf) && vf[kf] != -1 {
+					xf := vf[kf]
+					yf := xf - (kf - off)
+					if xf >= n-x {
+						return a0 + xf, b0 + yf, true
+					}
+				}
+			}
+		}
+	}
+	return 0, 0, false
+}
@@ -0,0 +1,232 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package textdiff
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/remyoudompheng/gigot/objects"
+	"github.com/remyoudompheng/gigot/treediff"
+)
+
+// This file implements the patch format of git-diff(1):
+//
+//	diff --git a/old b/new
+//	<extended headers>
+//	--- a/old
+//	+++ b/new
+//	<hunks>
+//
+// Extended headers describe creations, deletions, mode changes,
+// renames and copies, and the hashes of both versions.
+
+// A File is a change to a file with the contents of both versions.
+type File struct {
+	treediff.Change
+	OldData, NewData []byte
+}
+
+// abbrev is the length of abbreviated hashes in index lines.
+const abbrev = 7
+
+var errNotBlob = errors.New("textdiff: object is not a blob")
+
+// IsBinary reports whether data looks like binary data. It uses
+// the same rule as rename detection in treediff.
+func IsBinary(data []byte) bool {
+	return treediff.IsBinary(data)
+}
+
+// WritePatch writes the differences of a file in Git patch format.
+// Nothing is written if the file is unchanged, up to ignored
+// whitespace. Type changes must be written as a deletion followed
+// by an addition.
+func WritePatch(w io.Writer, f *File, opts *Options) error {
+	if opts == nil {
+		opts = &defaultOptions
+	}
+	var a, b [][]byte
+	var hunks []Hunk
+	binary := IsBinary(f.OldData) || IsBinary(f.NewData)
+	if !binary {
+		a, b = SplitLines(f.OldData), SplitLines(f.NewData)
+		edits := Diff(a, b, opts)
+		hunks = Hunks(edits, len(a), len(b), opts.Context)
+	}
+
+	oldPath, newPath := f.OldPath, f.NewPath
+	switch f.Type {
+	case treediff.Added:
+		oldPath = newPath
+	case treediff.Deleted:
+		newPath = oldPath
+	}
+	var hdr bytes.Buffer
+	fmt.Fprintf(&hdr, "diff --git %s %s\n", quotePath("a/"+oldPath), quotePath("b/"+newPath))
+	switch {
+	case f.Type == treediff.Added:
+		fmt.Fprintf(&hdr, "new file mode %06o\n", objects.GitMode(f.NewMode))
+	case f.Type == treediff.Deleted:
+		fmt.Fprintf(&hdr, "deleted file mode %06o\n", objects.GitMode(f.OldMode))
+	case f.OldMode != f.NewMode:
+		fmt.Fprintf(&hdr, "old mode %06o\n", objects.GitMode(f.OldMode))
+		fmt.Fprintf(&hdr, "new mode %06o\n", objects.GitMode(f.NewMode))
+	}
+	switch f.Type {
+	case treediff.Renamed:
+		fmt.Fprintf(&hdr, "similarity index %d%%\n", f.Score)
+		fmt.Fprintf(&hdr, "rename from %s\nrename to %s\n", quotePath(f.OldPath), quotePath(f.NewPath))
+	case treediff.Copied:
+		fmt.Fprintf(&hdr, "similarity index %d%%\n", f.Score)
+		fmt.Fprintf(&hdr, "copy from %s\ncopy to %s\n", quotePath(f.OldPath), quotePath(f.NewPath))
+	}
+	changed := f.OldHash != f.NewHash
+	if changed {
+		fmt.Fprintf(&hdr, "index %s..%s", f.OldHash.String()[:abbrev], f.NewHash.String()[:abbrev])
+		if f.OldMode == f.NewMode {
+			fmt.Fprintf(&hdr, " %06o", objects.GitMode(f.NewMode))
+		}
+		hdr.WriteByte('\n')
+	}
+	if f.Type == treediff.Modified && f.OldMode == f.NewMode &&
+		(!changed || !binary && len(hunks) == 0) {
+		// Nothing changed, or only ignored whitespace.
+		return nil
+	}
+
+	oldName, newName := quotePath("a/"+oldPath), quotePath("b/"+newPath)
+	if f.Type == treediff.Added {
+		oldName = "/dev/null"
+	}
+	if f.Type == treediff.Deleted {
+		newName = "/dev/null"
+	}
+	switch {
+	case !changed:
+	case binary:
+		fmt.Fprintf(&hdr, "Binary files %s and %s differ\n", oldName, newName)
+	case len(hunks) > 0:
+		fmt.Fprintf(&hdr, "--- %s\n+++ %s\n", oldName, newName)
+	}
+	if _, err := w.Write(hdr.Bytes()); err != nil {
+		return err
+	}
+	if changed && !binary {
+		return writeHunks(w, a, b, hunks)
+	}
+	return nil
+}
+
+// WriteChanges writes the differences between two trees, as
+// computed by treediff.DiffTrees, in Git patch format. File
+// contents are read from store.
+func WriteChanges(w io.Writer, store objects.ObjectStore, changes []treediff.Change, opts *Options) error {
+	bw := bufio.NewWriter(w)
+	for _, c := range changes {
+		if c.Type == treediff.TypeChanged {
+			// Like Git, show a deletion followed by an addition.
+			del := treediff.Change{Type: treediff.Deleted,
+				OldPath: c.OldPath, OldMode: c.OldMode, OldHash: c.OldHash}
+			add := treediff.Change{Type: treediff.Added,
+				NewPath: c.NewPath, NewMode: c.NewMode, NewHash: c.NewHash}
+			if err := writeChange(bw, store, del, opts); err != nil {
+				return err
+			}
+			if err := writeChange(bw, store, add, opts); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := writeChange(bw, store, c, opts); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func writeChange(w io.Writer, store objects.ObjectStore, c treediff.Change, opts *Options) error {
+	f := &File{Change: c}
+	var err error
+	if c.Type != treediff.Added {
+		if f.OldData, err = fileData(store, c.OldMode, c.OldHash); err != nil {
+			return err
+		}
+	}
+	if c.Type != treediff.Deleted {
+		if f.NewData, err = fileData(store, c.NewMode, c.NewHash); err != nil {
+			return err
+		}
+	}
+	return WritePatch(w, f, opts)
+}
+
+// fileData returns the contents of a file for display. Like Git,
+// gitlinks are shown as the hash of the submodule commit.
+func fileData(store objects.ObjectStore, mode os.FileMode, h objects.Hash) ([]byte, error) {
+	if mode&os.ModeDir != 0 && mode&os.ModeSymlink != 0 {
+		return []byte("Subproject commit " + h.String() + "\n"), nil
+	}
+	o, err := store.Get(h)
+	if err != nil {
+		return nil, err
+	}
+	blob, ok := o.(objects.Blob)
+	if !ok {
+		return nil, errNotBlob
+	}
+	return blob.Data, nil
+}
+
+// quotePath quotes a path as Git does when it contains special
+// characters: the path is enclosed in double quotes, and special
+// bytes are escaped as in C.
+func quotePath(p string) string {
+	needed := false
+	for i := 0; i < len(p); i++ {
+		if c := p[i]; c < 0x20 || c == '"' || c == '\\' || c >= 0x7f {
+			needed = true
+			break
+		}
+	}
+	if !needed {
+		return p
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('"')
+	for i := 0; i < len(p); i++ {
+		switch c := p[i]; c {
+		case '\a':
+			buf.WriteString(`\a`)
+		case '\b':
+			buf.WriteString(`\b`)
+		case '\t':
+			buf.WriteString(`\t`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\v':
+			buf.WriteString(`\v`)
+		case '\f':
+			buf.WriteString(`\f`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '"', '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		default:
+			if c < 0x20 || c >= 0x7f {
+				fmt.Fprintf(&buf, "\\%03o", c)
+			} else {
+				buf.WriteByte(c)
+			}
+		}
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
@@ -0,0 +1,144 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package textdiff
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/remyoudompheng/gigot/objects"
+	"github.com/remyoudompheng/gigot/treediff"
+)
+
+type testFile struct {
+	name string
+	mode os.FileMode
+	data string
+}
+
+// putTree stores a flat tree holding the given files, which must
+// be sorted by name.
+func putTree(t *testing.T, store objects.ObjectStore, files []testFile) objects.Hash {
+	var tree objects.Tree
+	for _, f := range files {
+		h, err := store.Put(objects.Blob{Data: []byte(f.data)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree.Entries = append(tree.Entries, objects.TreeElem{Name: f.name, Mode: f.mode, Hash: h})
+	}
+	h, err := store.Put(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+const helloOld = `package main
+
+import "fmt"
+
+func greet(name string) {
+	fmt.Println("Hello,", name)
+}
+
+func main() {
+	greet("world")
+	greet("gopher")
+	for i := 0; i < 3; i++ {
+		fmt.Println(i)
+	}
+}
+`
+
+func TestWriteChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gigot-textdiff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := objects.NewLooseStore(dir)
+
+	lines := "line 1\nline 2\nline 3\nline 4\nline 5\nline 6\nline 7\nline 8\nline 9\nline 10\n"
+	helloNew := strings.Replace(helloOld, `"world"`, `"everyone"`, 1)
+	helloNew = strings.Replace(helloNew, "i < 3", "i < 5", 1)
+	old := putTree(t, store, []testFile{
+		{"bin", 0644, "\x00\x01"},
+		{"gone.txt", 0644, "bye\n"},
+		{"hello.go", 0644, helloOld},
+		{"link", os.ModeSymlink, "target"},
+		{"mode.sh", 0644, "echo\n"},
+		{"noeol", 0644, "a\nb"},
+		{"renamed.txt", 0644, lines},
+	})
+	new := putTree(t, store, []testFile{
+		{"bin", 0644, "\x00\x02"},
+		{"hello.go", 0644, helloNew},
+		{"link", 0644, "target"},
+		{"mode.sh", 0755, "echo\n"},
+		{"moved.txt", 0644, strings.Replace(lines, "line 5", "line five", 1)},
+		{"new.txt", 0644, "new\n"},
+		{"noeol", 0644, "a\nc"},
+	})
+	changes, err := treediff.DiffTrees(store, old, new, &treediff.Options{DetectRenames: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := WriteChanges(&buf, store, changes, nil); err != nil {
+		t.Fatal(err)
+	}
+	// The output of git diff-tree -p -M --no-indent-heuristic.
+	expect, err := ioutil.ReadFile("testdata/changes.patch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != string(expect) {
+		t.Errorf("got:\n%s\nexpected:\n%s", buf.Bytes(), expect)
+	}
+}
+
+func TestWritePatchGitlink(t *testing.T) {
+	var oldHash, newHash objects.Hash
+	oldHash[0], newHash[0] = 0x12, 0x34
+	f := &File{
+		Change: treediff.Change{
+			Type:    treediff.Modified,
+			OldPath: "sub", OldMode: os.ModeDir | os.ModeSymlink, OldHash: oldHash,
+			NewPath: "sub", NewMode: os.ModeDir | os.ModeSymlink, NewHash: newHash,
+		},
+		OldData: []byte("Subproject commit " + oldHash.String() + "\n"),
+		NewData: []byte("Subproject commit " + newHash.String() + "\n"),
+	}
+	var buf bytes.Buffer
+	if err := WritePatch(&buf, f, nil); err != nil {
+		t.Fatal(err)
+	}
+	expect := "diff --git a/sub b/sub\n" +
+		"index 1200000..3400000 160000\n" +
+		"--- a/sub\n+++ b/sub\n" +
+		"@@ -1 +1 @@\n" +
+		"-Subproject commit " + oldHash.String() + "\n" +
+		"+Subproject commit " + newHash.String() + "\n"
+	if buf.String() != expect {
+		t.Errorf("got:\n%s\nexpected:\n%s", buf.Bytes(), expect)
+	}
+}
+
+func TestQuotePath(t *testing.T) {
+	for _, test := range []struct{ path, quoted string }{
+		{"a/simple name.txt", "a/simple name.txt"},
+		{"a/tab\there", `"a/tab\there"`},
+		{`a/quote"back\slash`, `"a/quote\"back\\slash"`},
+		{"a/caf\xc3\xa9", `"a/caf\303\251"`},
+	} {
+		if q := quotePath(test.path); q != test.quoted {
+			t.Errorf("quotePath(%q) = %s, expected %s", test.path, q, test.quoted)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package textdiff
+
+import (
+	"sort"
+)
+
+// This file implements the patience and histogram algorithms,
+// which split texts around well-chosen common lines and fall back
+// to the Myers algorithm when no such line exists.
+
+// patience marks the changed lines between a[a0:a1] and b[b0:b1]:
+// the longest increasing sequence of lines which occur exactly once
+// in both ranges is kept, and the gaps between them are processed
+// recursively.
+func (d *differ) patience(a0, a1, b0, b1 int) {
+	a0, a1, b0, b1 = d.trim(a0, a1, b0, b1)
+	if a0 == a1 || b0 == b1 {
+		d.markAll(a0, a1, b0, b1)
+		return
+	}
+	// Find unique common lines.
+	type occurrence struct{ countA, countB, posA, posB int }
+	occ := make(map[int]*occurrence)
+	for i := a0; i < a1; i++ {
+		o := occ[d.a[i]]
+		if o == nil {
+			o = new(occurrence)
+			occ[d.a[i]] = o
+		}
+		o.countA++
+		o.posA = i
+	}
+	var pairs [][2]int
+	for j := b0; j < b1; j++ {
+		if o := occ[d.b[j]]; o != nil {
+			o.countB++
+			o.posB = j
+		}
+	}
+	for j := b0; j < b1; j++ {
+		if o := occ[d.b[j]]; o != nil && o.countA == 1 && o.countB == 1 {
+			pairs = append(pairs, [2]int{o.posA, j})
+		}
+	}
+	if len(pairs) == 0 {
+		d.myers(a0, a1, b0, b1)
+		return
+	}
+	// pairs are sorted by position in b: keep a longest
+	// increasing subsequence of positions in a.
+	anchors := longestIncreasing(pairs)
+	for _, p := range anchors {
+		d.patience(a0, p[0], b0, p[1])
+		a0, b0 = p[0]+1, p[1]+1
+	}
+	d.patience(a0, a1, b0, b1)
+}
+
+// longestIncreasing returns a longest subsequence of pairs whose
+// first elements are increasing, using patience sorting.
+func longestIncreasing(pairs [][2]int) [][2]int {
+	// tops[i] is the index of the top card of the i-th pile,
+	// prev[k] the top of the previous pile when card k was placed.
+	var tops []int
+	prev := make([]int, len(pairs))
+	for k, p := range pairs {
+		i := sort.Search(len(tops), func(i int) bool { return pairs[tops[i]][0] > p[0] })
+		prev[k] = -1
+		if i > 0 {
+			prev[k] = tops[i-1]
+		}
+		if i == len(tops) {
+			tops = append(tops, k)
+		} else {
+			tops[i] = k
+		}
+	}
+	seq := make([][2]int, len(tops))
+	for i, k := len(tops)-1, tops[len(tops)-1]; i >= 0; i, k = i-1, prev[k] {
+		seq[i] = pairs[k]
+	}
+	return seq
+}
+
+// maxChain is the maximal number of occurrences of a line for it
+// to be used as a split point by the histogram algorithm.
+const maxChain = 64
+
+// histogram marks the changed lines between a[a0:a1] and b[b0:b1]:
+// the longest common region containing the least frequent lines of
+// a is kept, and the regions before and after it are processed
+// recursively.
+func (d *differ) histogram(a0, a1, b0, b1 int) {
+	a0, a1, b0, b1 = d.trim(a0, a1, b0, b1)
+	if a0 == a1 || b0 == b1 {
+		d.markAll(a0, a1, b0, b1)
+		return
+	}
+	positions := make(map[int][]int)
+	for i := a0; i < a1; i++ {
+		positions[d.a[i]] = append(positions[d.a[i]], i)
+	}
+	count := func(i int) int { return len(positions[d.a[i]]) }
+
+	bestA, bestB, bestLen, bestCount := 0, 0, 0, maxChain+1
+	for j := b0; j < b1; {
+		next := j + 1
+		pos := positions[d.b[j]]
+		if len(pos) == 0 || len(pos) > bestCount {
+			j = next
+			continue
+		}
+		for _, i := range pos {
+			// Extend the match around (i, j), computing the
+			// minimal number of occurrences in the region.
+			s1, s2, e1, e2 := i, j, i+1, j+1
+			c := count(i)
+			for s1 > a0 && s2 > b0 && d.a[s1-1] == d.b[s2-1] {
+				s1, s2 = s1-1, s2-1
+				if n := count(s1); n < c {
+					c = n
+				}
+			}
+			for e1 < a1 && e2 < b1 && d.a[e1] == d.b[e2] {
+				if n := count(e1); n < c {
+					c = n
+				}
+				e1, e2 = e1+1, e2+1
+			}
+			if e2 > next {
+				next = e2
+			}
+			if e1-s1 > bestLen || c < bestCount {
+				bestA, bestB, bestLen, bestCount = s1, s2, e1-s1, c
+			}
+		}
+		j = next
+	}
+	if bestLen == 0 {
+		d.myers(a0, a1, b0, b1)
+		return
+	}
+	d.histogram(a0, bestA, b0, bestB)
+	d.histogram(bestA+bestLen, a1, bestB+bestLen, b1)
+}
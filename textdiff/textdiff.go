@@ -0,0 +1,322 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// package textdiff computes line-oriented differences between
+// texts and formats them as unified diffs, in the manner of
+// git-diff(1).
+//
+// The Myers, patience and histogram algorithms of Git are
+// available. Like in Git, lines may be compared ignoring some
+// whitespace differences.
+package textdiff
+
+import (
+	"bytes"
+)
+
+// An Algorithm selects the method used to compute differences.
+type Algorithm int
+
+const (
+	// Myers is the classic minimal diff algorithm.
+	Myers Algorithm = iota
+	// Patience matches lines which are unique in both texts
+	// first, which often gives more readable diffs.
+	Patience
+	// Histogram extends the patience algorithm to lines which
+	// are not unique, preferring the least frequent ones.
+	Histogram
+)
+
+// Whitespace flags select whitespace differences that are ignored
+// when comparing lines.
+type Whitespace int
+
+const (
+	// IgnoreSpaceAtEOL ignores whitespace at end of lines.
+	IgnoreSpaceAtEOL Whitespace = 1 << iota
+	// IgnoreSpaceChange ignores changes in the amount of
+	// whitespace, as git diff -b.
+	IgnoreSpaceChange
+	// IgnoreAllSpace ignores all whitespace, as git diff -w.
+	IgnoreAllSpace
+)
+
+// Options control the computation and formatting of differences.
+type Options struct {
+	Algorithm  Algorithm
+	Whitespace Whitespace
+	// Context is the number of unchanged lines shown around
+	// changes in unified diffs.
+	Context int
+}
+
+// defaultOptions are used when nil Options are given.
+var defaultOptions = Options{Context: 3}
+
+// An Edit replaces OldLines lines of the old text starting at line
+// OldPos by NewLines lines of the new text starting at NewPos.
+// Line numbers start at zero.
+type Edit struct {
+	OldPos, OldLines int
+	NewPos, NewLines int
+}
+
+// SplitLines splits data after each newline. The last line has no
+// terminating newline if data does not end with a newline.
+func SplitLines(data []byte) [][]byte {
+	var lines [][]byte
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n') + 1
+		if i == 0 {
+			i = len(data)
+		}
+		lines = append(lines, data[:i:i])
+		data = data[i:]
+	}
+	return lines
+}
+
+// Diff computes the differences between two lists of lines, as
+// returned by SplitLines. The returned edits are sorted and never
+// adjacent.
+func Diff(a, b [][]byte, opts *Options) []Edit {
+	if opts == nil {
+		opts = &defaultOptions
+	}
+	d := newDiffer(a, b, opts.Whitespace)
+	switch opts.Algorithm {
+	case Patience:
+		d.patience(0, len(a), 0, len(b))
+	case Histogram:
+		d.histogram(0, len(a), 0, len(b))
+	default:
+		d.myers(0, len(a), 0, len(b))
+	}
+	compact(d.a, d.ra, d.rb)
+	compact(d.b, d.rb, d.ra)
+	return d.edits()
+}
+
+// A differ holds the state of a diff computation: lines are
+// replaced by integer identifiers, and changed lines are marked
+// in ra and rb.
+type differ struct {
+	a, b   []int
+	ra, rb []bool
+}
+
+func newDiffer(a, b [][]byte, ws Whitespace) *differ {
+	ids := make(map[string]int)
+	encode := func(lines [][]byte) []int {
+		s := make([]int, len(lines))
+		for i, l := range lines {
+			key := string(normalize(l, ws))
+			id, ok := ids[key]
+			if !ok {
+				id = len(ids)
+				ids[key] = id
+			}
+			s[i] = id
+		}
+		return s
+	}
+	return &differ{
+		a:  encode(a),
+		b:  encode(b),
+		ra: make([]bool, len(a)),
+		rb: make([]bool, len(b)),
+	}
+}
+
+func isSpace(c byte) bool {
+	switch c {
+	case ' ', '\t', '\n', '\v', '\f', '\r':
+		return true
+	}
+	return false
+}
+
+// normalize returns the comparison key of a line.
+func normalize(line []byte, ws Whitespace) []byte {
+	switch {
+	case ws&IgnoreAllSpace != 0:
+		key := make([]byte, 0, len(line))
+		for _, c := range line {
+			if !isSpace(c) {
+				key = append(key, c)
+			}
+		}
+		return key
+	case ws&IgnoreSpaceChange != 0:
+		key := make([]byte, 0, len(line))
+		for i, c := range line {
+			if !isSpace(c) {
+				key = append(key, c)
+			} else if i+1 < len(line) && !isSpace(line[i+1]) {
+				key = append(key, ' ')
+			}
+		}
+		return key
+	case ws&IgnoreSpaceAtEOL != 0:
+		return bytes.TrimRight(line, " \t\n\v\f\r")
+	}
+	return line
+}
+
+// trim skips the common prefix and suffix of a[a0:a1] and b[b0:b1].
+func (d *differ) trim(a0, a1, b0, b1 int) (int, int, int, int) {
+	for a0 < a1 && b0 < b1 && d.a[a0] == d.b[b0] {
+		a0, b0 = a0+1, b0+1
+	}
+	for a0 < a1 && b0 < b1 && d.a[a1-1] == d.b[b1-1] {
+		a1, b1 = a1-1, b1-1
+	}
+	return a0, a1, b0, b1
+}
+
+// markAll marks all lines of both ranges as changed.
+func (d *differ) markAll(a0, a1, b0, b1 int) {
+	for i := a0; i < a1; i++ {
+		d.ra[i] = true
+	}
+	for j := b0; j < b1; j++ {
+		d.rb[j] = true
+	}
+}
+
+// A group is a maximal run of changed lines [start, end) of one
+// text, possibly empty. Groups of both texts are in one-to-one
+// correspondence, since they are separated by unchanged lines.
+type group struct{ start, end int }
+
+func (g *group) extend(r []bool) {
+	for g.end < len(r) && r[g.end] {
+		g.end++
+	}
+}
+
+// next moves to the following group.
+func (g *group) next(r []bool) bool {
+	if g.end == len(r) {
+		return false
+	}
+	g.start = g.end + 1
+	g.end = g.start
+	g.extend(r)
+	return true
+}
+
+// prev moves to the preceding group.
+func (g *group) prev(r []bool) bool {
+	if g.start == 0 {
+		return false
+	}
+	g.end = g.start - 1
+	g.start = g.end
+	for g.start > 0 && r[g.start-1] {
+		g.start--
+	}
+	return true
+}
+
+// slideDown moves a group one line down, if the line following it
+// equals its first line, merging it with the next group if needed.
+func (g *group) slideDown(s []int, r []bool) bool {
+	if g.end == len(s) || s[g.start] != s[g.end] {
+		return false
+	}
+	r[g.start], r[g.end] = false, true
+	g.start, g.end = g.start+1, g.end+1
+	g.extend(r)
+	return true
+}
+
+// slideUp moves a group one line up, if the line preceding it
+// equals its last line, merging it with the previous group if
+// needed.
+func (g *group) slideUp(s []int, r []bool) bool {
+	if g.start == 0 || s[g.start-1] != s[g.end-1] {
+		return false
+	}
+	g.start, g.end = g.start-1, g.end-1
+	r[g.start], r[g.end] = true, false
+	for g.start > 0 && r[g.start-1] {
+		g.start--
+	}
+	return true
+}
+
+// compact moves groups of changed lines of the text s, with marks
+// r, to a canonical position: as low as possible, unless the group
+// can be aligned with a group of changes of the other text, with
+// marks ro. This does not change the number of changed lines.
+// It follows xdl_change_compact in Git sources, without the
+// indentation heuristic.
+func compact(s []int, r, ro []bool) {
+	var g, gother group
+	g.extend(r)
+	gother.extend(ro)
+	for {
+		if g.end > g.start {
+			var size, earliestEnd, endMatchingOther int
+			for {
+				size = g.end - g.start
+				endMatchingOther = -1
+				// Slide up as much as possible, then down
+				// as much as possible, while groups merge.
+				for g.slideUp(s, r) {
+					gother.prev(ro)
+				}
+				earliestEnd = g.end
+				if gother.end > gother.start {
+					endMatchingOther = g.end
+				}
+				for g.slideDown(s, r) {
+					gother.next(ro)
+					if gother.end > gother.start {
+						endMatchingOther = g.end
+					}
+				}
+				if size == g.end-g.start {
+					break
+				}
+			}
+			if g.end != earliestEnd && endMatchingOther != -1 {
+				// Line up with the last group of changes
+				// of the other text.
+				for gother.end == gother.start {
+					g.slideUp(s, r)
+					gother.prev(ro)
+				}
+			}
+		}
+		if !g.next(r) {
+			break
+		}
+		gother.next(ro)
+	}
+}
+
+// edits converts the marks of changed lines to a list of edits.
+func (d *differ) edits() []Edit {
+	var edits []Edit
+	i, j := 0, 0
+	for i < len(d.a) || j < len(d.b) {
+		if (i < len(d.a) && d.ra[i]) || (j < len(d.b) && d.rb[j]) {
+			e := Edit{OldPos: i, NewPos: j}
+			for i < len(d.a) && d.ra[i] {
+				i++
+			}
+			for j < len(d.b) && d.rb[j] {
+				j++
+			}
+			e.OldLines, e.NewLines = i-e.OldPos, j-e.NewPos
+			edits = append(edits, e)
+			continue
+		}
+		i, j = i+1, j+1
+	}
+	return edits
+}
@@ -0,0 +1,218 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package textdiff
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+var algorithms = []struct {
+	name string
+	algo Algorithm
+}{
+	{"myers", Myers},
+	{"patience", Patience},
+	{"histogram", Histogram},
+}
+
+// apply applies edits to a, taking new lines from b.
+func apply(a, b [][]byte, edits []Edit) [][]byte {
+	var out [][]byte
+	i := 0
+	for _, e := range edits {
+		out = append(out, a[i:e.OldPos]...)
+		out = append(out, b[e.NewPos:e.NewPos+e.NewLines]...)
+		i = e.OldPos + e.OldLines
+	}
+	return append(out, a[i:]...)
+}
+
+// lcsLength computes the length of a longest common subsequence.
+func lcsLength(a, b [][]byte) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for i := range a {
+		for j := range b {
+			switch {
+			case bytes.Equal(a[i], b[j]):
+				cur[j+1] = prev[j] + 1
+			case prev[j+1] > cur[j]:
+				cur[j+1] = prev[j+1]
+			default:
+				cur[j+1] = cur[j]
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// randomLines returns n lines chosen among the given number of
+// distinct lines.
+func randomLines(r *rand.Rand, n, distinct int) [][]byte {
+	lines := make([][]byte, n)
+	for i := range lines {
+		lines[i] = []byte{byte('a' + r.Intn(distinct)), '\n'}
+	}
+	return lines
+}
+
+func TestDiffRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for iter := 0; iter < 5000; iter++ {
+		// Few distinct lines make groups of changes slide.
+		distinct := 2 + iter%4
+		a := randomLines(r, r.Intn(40), distinct)
+		b := randomLines(r, r.Intn(40), distinct)
+		checkDiff(t, a, b)
+	}
+}
+
+func TestDiffCompact(t *testing.T) {
+	// Groups of changes sliding over repeated lines used to make
+	// compaction loop forever.
+	a := SplitLines([]byte("a\na\nc\na\na\nc\na\n"))
+	b := SplitLines([]byte("a\nc\na\nb\nb\n"))
+	checkDiff(t, a, b)
+}
+
+// checkDiff checks that the edits computed by each algorithm
+// transform a into b, and that Myers edits are minimal.
+func checkDiff(t *testing.T, a, b [][]byte) {
+	for _, alg := range algorithms {
+		edits := Diff(a, b, &Options{Algorithm: alg.algo})
+		if got := apply(a, b, edits); !bytes.Equal(bytes.Join(got, nil), bytes.Join(b, nil)) {
+			t.Fatalf("%s: edits %v do not transform %q into %q", alg.name, edits, a, b)
+		}
+		for i := 1; i < len(edits); i++ {
+			p, e := edits[i-1], edits[i]
+			if e.OldPos <= p.OldPos+p.OldLines || e.NewPos-e.OldPos != p.NewPos+p.NewLines-p.OldPos-p.OldLines {
+				t.Fatalf("%s: invalid edits %v", alg.name, edits)
+			}
+		}
+		if alg.algo != Myers {
+			continue
+		}
+		// The Myers algorithm is minimal.
+		changed := 0
+		for _, e := range edits {
+			changed += e.OldLines + e.NewLines
+		}
+		if lcs := lcsLength(a, b); changed != len(a)+len(b)-2*lcs {
+			t.Fatalf("%q -> %q: %d changed lines, expected %d", a, b, changed, len(a)+len(b)-2*lcs)
+		}
+	}
+}
+
+func TestWriteUnified(t *testing.T) {
+	old, err := ioutil.ReadFile("testdata/frob.c.old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	new, err := ioutil.ReadFile("testdata/frob.c.new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The outputs of git diff --no-indent-heuristic. The Myers
+	// algorithm is not compared, since several minimal diffs exist
+	// and the choice of Git depends on heuristics.
+	for _, alg := range algorithms[1:] {
+		expect, err := ioutil.ReadFile("testdata/frob.c." + alg.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		err = WriteUnified(&buf, old, new, &Options{Algorithm: alg.algo, Context: 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != string(expect) {
+			t.Errorf("%s: got:\n%s\nexpected:\n%s", alg.name, buf.Bytes(), expect)
+		}
+	}
+}
+
+func TestWhitespace(t *testing.T) {
+	old := []byte("a  b\nc\t\nd e\n")
+	new := []byte("a b\nc\nde\n")
+	for _, test := range []struct {
+		ws     Whitespace
+		expect string
+	}{
+		{0, "@@ -1,3 +1,3 @@\n-a  b\n-c\t\n-d e\n+a b\n+c\n+de\n"},
+		{IgnoreSpaceAtEOL, "@@ -1,3 +1,3 @@\n-a  b\n+a b\n c\n-d e\n+de\n"},
+		{IgnoreSpaceChange, "@@ -1,3 +1,3 @@\n a b\n c\n-d e\n+de\n"},
+		{IgnoreAllSpace, ""},
+	} {
+		var buf bytes.Buffer
+		if err := WriteUnified(&buf, old, new, &Options{Whitespace: test.ws, Context: 3}); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.expect {
+			t.Errorf("whitespace %d: got:\n%s\nexpected:\n%s", test.ws, buf.Bytes(), test.expect)
+		}
+	}
+}
+
+func TestHunks(t *testing.T) {
+	var old, new bytes.Buffer
+	for i := 0; i < 30; i++ {
+		fmt.Fprintf(&old, "line %d\n", i)
+		switch i {
+		case 2, 10, 17:
+			fmt.Fprintf(&new, "changed %d\n", i)
+		default:
+			fmt.Fprintf(&new, "line %d\n", i)
+		}
+	}
+	a, b := SplitLines(old.Bytes()), SplitLines(new.Bytes())
+	edits := Diff(a, b, nil)
+	if len(edits) != 3 {
+		t.Fatalf("got edits %v", edits)
+	}
+	for _, test := range []struct {
+		context int
+		expect  []Hunk
+	}{
+		{0, []Hunk{{2, 1, 2, 1, edits[:1]}, {10, 1, 10, 1, edits[1:2]}, {17, 1, 17, 1, edits[2:]}}},
+		{3, []Hunk{{0, 6, 0, 6, edits[:1]}, {7, 14, 7, 14, edits[1:]}}},
+		{4, []Hunk{{0, 22, 0, 22, edits}}},
+	} {
+		hunks := Hunks(edits, len(a), len(b), test.context)
+		if len(hunks) != len(test.expect) {
+			t.Errorf("context %d: got %v, expected %v", test.context, hunks, test.expect)
+			continue
+		}
+		for i, h := range hunks {
+			x := test.expect[i]
+			if h.OldPos != x.OldPos || h.OldLines != x.OldLines ||
+				h.NewPos != x.NewPos || h.NewLines != x.NewLines || len(h.Edits) != len(x.Edits) {
+				t.Errorf("context %d: got %v, expected %v", test.context, hunks, test.expect)
+				break
+			}
+		}
+	}
+}
+
+func TestHunkRange(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteUnified(&buf, nil, []byte("a\n"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if s := buf.String(); s != "@@ -0,0 +1 @@\n+a\n" {
+		t.Errorf("got %q", s)
+	}
+	buf.Reset()
+	if err := WriteUnified(&buf, []byte("a\nb\nc\n"), []byte("a\nc\n"), &Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if s := buf.String(); s != "@@ -2 +1,0 @@ a\n-b\n" {
+		t.Errorf("got %q", s)
+	}
+}
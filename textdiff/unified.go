@@ -0,0 +1,140 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package textdiff
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// A Hunk is a group of edits shown together in a unified diff,
+// along with surrounding context lines.
+type Hunk struct {
+	OldPos, OldLines int
+	NewPos, NewLines int
+	Edits            []Edit
+}
+
+// Hunks groups edits into hunks with the given number of context
+// lines. Edits separated by at most twice that number of lines
+// belong to the same hunk.
+func Hunks(edits []Edit, oldLen, newLen, context int) []Hunk {
+	var hunks []Hunk
+	for len(edits) > 0 {
+		n := 1
+		for n < len(edits) {
+			prev, e := edits[n-1], edits[n]
+			if e.OldPos-(prev.OldPos+prev.OldLines) > 2*context {
+				break
+			}
+			n++
+		}
+		first, last := edits[0], edits[n-1]
+		oldEnd, newEnd := last.OldPos+last.OldLines, last.NewPos+last.NewLines
+		pre := minInt(context, first.OldPos, first.NewPos)
+		post := minInt(context, oldLen-oldEnd, newLen-newEnd)
+		h := Hunk{
+			OldPos: first.OldPos - pre, OldLines: oldEnd + post - (first.OldPos - pre),
+			NewPos: first.NewPos - pre, NewLines: newEnd + post - (first.NewPos - pre),
+			Edits: edits[:n],
+		}
+		hunks = append(hunks, h)
+		edits = edits[n:]
+	}
+	return hunks
+}
+
+func minInt(n int, others ...int) int {
+	for _, m := range others {
+		if m < n {
+			n = m
+		}
+	}
+	return n
+}
+
+// WriteUnified writes the differences between old and new as the
+// hunks of a unified diff, without file headers. Nothing is written
+// if the texts do not differ.
+func WriteUnified(w io.Writer, old, new []byte, opts *Options) error {
+	if opts == nil {
+		opts = &defaultOptions
+	}
+	a, b := SplitLines(old), SplitLines(new)
+	edits := Diff(a, b, opts)
+	return writeHunks(w, a, b, Hunks(edits, len(a), len(b), opts.Context))
+}
+
+func writeHunks(w io.Writer, a, b [][]byte, hunks []Hunk) error {
+	bw := bufio.NewWriter(w)
+	for _, h := range hunks {
+		fmt.Fprintf(bw, "@@ -%s +%s @@", hunkRange(h.OldPos, h.OldLines), hunkRange(h.NewPos, h.NewLines))
+		if fn := funcName(a, h.OldPos); fn != nil {
+			bw.WriteByte(' ')
+			bw.Write(fn)
+		}
+		bw.WriteByte('\n')
+		i, j := h.OldPos, h.NewPos
+		for _, e := range h.Edits {
+			// Context lines are taken from the new text, which
+			// matters when whitespace is ignored.
+			for ; j < e.NewPos; i, j = i+1, j+1 {
+				writeLine(bw, ' ', b[j])
+			}
+			for ; i < e.OldPos+e.OldLines; i++ {
+				writeLine(bw, '-', a[i])
+			}
+			for ; j < e.NewPos+e.NewLines; j++ {
+				writeLine(bw, '+', b[j])
+			}
+		}
+		for ; j < h.NewPos+h.NewLines; j++ {
+			writeLine(bw, ' ', b[j])
+		}
+	}
+	return bw.Flush()
+}
+
+func writeLine(w *bufio.Writer, prefix byte, line []byte) {
+	w.WriteByte(prefix)
+	w.Write(line)
+	if len(line) == 0 || line[len(line)-1] != '\n' {
+		w.WriteString("\n\\ No newline at end of file\n")
+	}
+}
+
+// hunkRange formats a line range for a hunk header: line numbers
+// start at 1, and an empty range is denoted by the preceding line.
+func hunkRange(pos, n int) string {
+	switch n {
+	case 0:
+		return fmt.Sprintf("%d,0", pos)
+	case 1:
+		return fmt.Sprintf("%d", pos+1)
+	}
+	return fmt.Sprintf("%d,%d", pos+1, n)
+}
+
+// funcName returns the function context of a hunk starting at line
+// pos: like Git's default, it is the last line before pos starting
+// with a letter, an underscore or a dollar sign, truncated to 80
+// bytes.
+func funcName(lines [][]byte, pos int) []byte {
+	for i := pos - 1; i >= 0; i-- {
+		l := lines[i]
+		if len(l) == 0 {
+			continue
+		}
+		if c := l[0]; 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '_' || c == '$' {
+			if len(l) > 80 {
+				l = l[:80]
+			}
+			return bytes.TrimRight(l, " \t\n\v\f\r")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,356 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package treediff
+
+import (
+	"bytes"
+	"path"
+	"sort"
+
+	"github.com/remyoudompheng/gigot/objects"
+)
+
+// This file implements rename and copy detection, following
+// diffcore-rename.c in Git sources.
+//
+// Destinations are added files. Sources are deleted files, and
+// also modified files when looking for copies, or all files of the
+// old tree when looking for copies harder. Identical files are
+// paired first, then remaining files are paired by decreasing
+// similarity. A source that is paired several times is a copy,
+// except that the last pairing of a deleted file is a rename.
+
+// A renameSource is a file that may have been renamed or copied.
+type renameSource struct {
+	path    string
+	entry   objects.TreeElem
+	deleted int // The index of the deletion in changes, or -1.
+	used    int // Number of pairings.
+}
+
+// A renamePair pairs an added file with its origin.
+type renamePair struct {
+	dst   int // The index of the addition in changes.
+	src   *renameSource
+	score int
+}
+
+func (d *differ) detectRenames(old objects.Hash) error {
+	var srcs []*renameSource
+	var dsts []int
+	known := make(map[string]bool)
+	for i, c := range d.changes {
+		switch {
+		case c.Type == Added:
+			dsts = append(dsts, i)
+		case c.Type == Deleted:
+			srcs = append(srcs, &renameSource{
+				path:    c.OldPath,
+				entry:   objects.TreeElem{Mode: c.OldMode, Hash: c.OldHash},
+				deleted: i,
+			})
+		case c.Type == Modified && d.opts.DetectCopies:
+			srcs = append(srcs, &renameSource{
+				path:    c.OldPath,
+				entry:   objects.TreeElem{Mode: c.OldMode, Hash: c.OldHash},
+				deleted: -1,
+			})
+		}
+		known[c.OldPath] = true
+	}
+	if len(dsts) == 0 {
+		return nil
+	}
+	if d.opts.FindCopiesHarder {
+		err := d.walkTree("", old, func(p string, e objects.TreeElem) {
+			if !known[p] {
+				srcs = append(srcs, &renameSource{path: p, entry: e, deleted: -1})
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	// Remove files which cannot be renamed.
+	ok := srcs[:0]
+	for _, s := range srcs {
+		if renamable(s.entry) {
+			ok = append(ok, s)
+		}
+	}
+	srcs = ok
+	if len(srcs) == 0 {
+		return nil
+	}
+
+	pairs := d.exactRenames(srcs, dsts)
+	paired := make(map[int]bool)
+	for _, p := range pairs {
+		paired[p.dst] = true
+	}
+	inexact, err := d.inexactRenames(srcs, dsts, paired)
+	if err != nil {
+		return err
+	}
+	pairs = append(pairs, inexact...)
+	d.applyRenames(pairs)
+	return nil
+}
+
+// renamable reports whether a file can take part in a rename: empty
+// files and gitlinks are excluded.
+func renamable(e objects.TreeElem) bool {
+	return !isGitlink(e.Mode) && e.Hash != emptyBlob
+}
+
+var emptyBlob = objects.NewHash([]byte("blob 0\x00"))
+
+// compatible reports whether a source can be paired with a
+// destination of the given mode.
+func compatible(s *renameSource, e objects.TreeElem) bool {
+	return fileType(s.entry.Mode) == fileType(e.Mode)
+}
+
+// exactRenames pairs destinations with identical sources, preferring
+// unused deleted sources with the same base name.
+func (d *differ) exactRenames(srcs []*renameSource, dsts []int) []renamePair {
+	byHash := make(map[objects.Hash][]*renameSource)
+	for _, s := range srcs {
+		byHash[s.entry.Hash] = append(byHash[s.entry.Hash], s)
+	}
+	var pairs []renamePair
+	for _, i := range dsts {
+		c := d.changes[i]
+		e := objects.TreeElem{Mode: c.NewMode, Hash: c.NewHash}
+		if !renamable(e) {
+			continue
+		}
+		var best *renameSource
+		bestRank := 0
+		for _, s := range byHash[c.NewHash] {
+			if !compatible(s, e) {
+				continue
+			}
+			rank := 0
+			switch {
+			case s.deleted >= 0 && s.used == 0:
+				rank = 2
+			case d.opts.DetectCopies:
+				rank = 1
+			default:
+				continue
+			}
+			if path.Base(s.path) == path.Base(c.NewPath) {
+				rank += 2
+			}
+			if rank > bestRank {
+				best, bestRank = s, rank
+			}
+		}
+		if best != nil {
+			best.used++
+			pairs = append(pairs, renamePair{dst: i, src: best, score: 100})
+		}
+	}
+	return pairs
+}
+
+// inexactRenames pairs remaining destinations with sources by
+// decreasing similarity.
+func (d *differ) inexactRenames(srcs []*renameSource, dsts []int, paired map[int]bool) ([]renamePair, error) {
+	var candidates []renamePair
+	for _, i := range dsts {
+		if paired[i] {
+			continue
+		}
+		c := d.changes[i]
+		e := objects.TreeElem{Mode: c.NewMode, Hash: c.NewHash}
+		if !renamable(e) {
+			continue
+		}
+		sigDst, err := d.signature(c.NewHash)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range srcs {
+			if !compatible(s, e) || (s.used > 0 && !d.opts.DetectCopies) {
+				continue
+			}
+			sigSrc, err := d.signature(s.entry.Hash)
+			if err != nil {
+				return nil, err
+			}
+			score := similarity(sigSrc, sigDst, d.opts.MinScore)
+			if score >= d.opts.MinScore {
+				candidates = append(candidates, renamePair{dst: i, src: s, score: score})
+			}
+		}
+	}
+	sort.Stable(pairsByScore(candidates))
+
+	var pairs []renamePair
+	// First pass: each source is used at most once. Second pass:
+	// sources can be copied several times.
+	for pass := 0; pass < 2; pass++ {
+		if pass == 1 && !d.opts.DetectCopies {
+			break
+		}
+		for _, p := range candidates {
+			if paired[p.dst] || (pass == 0 && p.src.used > 0) {
+				continue
+			}
+			paired[p.dst] = true
+			p.src.used++
+			pairs = append(pairs, p)
+		}
+	}
+	return pairs, nil
+}
+
+type pairsByScore []renamePair
+
+func (s pairsByScore) Len() int           { return len(s) }
+func (s pairsByScore) Less(i, j int) bool { return s[i].score > s[j].score }
+func (s pairsByScore) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// applyRenames turns paired additions into renames and copies,
+// and drops the deletions of renamed files.
+func (d *differ) applyRenames(pairs []renamePair) {
+	// Process pairs in path order, so that the last pairing of a
+	// deleted file is the rename.
+	sort.Slice(pairs, func(i, j int) bool {
+		return d.changes[pairs[i].dst].NewPath < d.changes[pairs[j].dst].NewPath
+	})
+	drop := make(map[int]bool)
+	for _, p := range pairs {
+		c := &d.changes[p.dst]
+		c.Type = Copied
+		c.OldPath = p.src.path
+		c.OldMode = p.src.entry.Mode
+		c.OldHash = p.src.entry.Hash
+		c.Score = p.score
+		p.src.used--
+		if p.src.deleted >= 0 && p.src.used == 0 {
+			c.Type = Renamed
+			drop[p.src.deleted] = true
+		}
+	}
+	changes := d.changes[:0]
+	for i, c := range d.changes {
+		if !drop[i] {
+			changes = append(changes, c)
+		}
+	}
+	d.changes = changes
+}
+
+// walkTree calls fn for each file of a tree, recursively.
+func (d *differ) walkTree(base string, h objects.Hash, fn func(p string, e objects.TreeElem)) error {
+	entries, err := d.readTree(h)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		p := path.Join(base, e.Name)
+		if isTree(e.Mode) {
+			if err := d.walkTree(p, e.Hash, fn); err != nil {
+				return err
+			}
+		} else {
+			fn(p, e)
+		}
+	}
+	return nil
+}
+
+// A signature summarizes the contents of a blob for similarity
+// estimation: it counts the bytes of each distinct chunk.
+type signature struct {
+	size   int
+	chunks map[uint32]int
+}
+
+// maxChunk is the maximal length of a chunk. Chunks end at
+// newlines, so that text files are compared by lines.
+const maxChunk = 64
+
+func (d *differ) signature(h objects.Hash) (*signature, error) {
+	if sig, ok := d.sigs[h]; ok {
+		return sig, nil
+	}
+	o, err := d.store.Get(h)
+	if err != nil {
+		return nil, err
+	}
+	blob, ok := o.(objects.Blob)
+	if !ok {
+		return nil, errNotBlob
+	}
+	sig := newSignature(blob.Data)
+	if d.sigs == nil {
+		d.sigs = make(map[objects.Hash]*signature)
+	}
+	d.sigs[h] = sig
+	return sig, nil
+}
+
+func newSignature(data []byte) *signature {
+	const fnvOffset, fnvPrime = 2166136261, 16777619
+	sig := &signature{size: len(data), chunks: make(map[uint32]int)}
+	// Line endings of text files are normalized.
+	text := !IsBinary(data)
+	var h uint32 = fnvOffset
+	n := 0
+	for i, c := range data {
+		if text && c == '\r' && i+1 < len(data) && data[i+1] == '\n' {
+			continue
+		}
+		h = (h ^ uint32(c)) * fnvPrime
+		n++
+		if c == '\n' || n == maxChunk {
+			sig.chunks[h] += n
+			h, n = fnvOffset, 0
+		}
+	}
+	if n > 0 {
+		sig.chunks[h] += n
+	}
+	return sig
+}
+
+// IsBinary reports whether data looks like binary data: like Git,
+// it looks for a NUL byte in the first 8000 bytes.
+func IsBinary(data []byte) bool {
+	if len(data) > 8000 {
+		data = data[:8000]
+	}
+	return bytes.IndexByte(data, 0) >= 0
+}
+
+// similarity returns the similarity of two blobs in percent, as the
+// proportion of the larger blob made of chunks found in the other.
+// Pairs of blobs whose sizes are too different to reach minScore
+// are not examined and have similarity 0.
+func similarity(a, b *signature, minScore int) int {
+	max, min := a.size, b.size
+	if max < min {
+		max, min = min, max
+	}
+	if max == 0 {
+		return 100
+	}
+	if (max-min)*100 > max*(100-minScore) {
+		return 0
+	}
+	common := 0
+	for h, n := range a.chunks {
+		m := b.chunks[h]
+		if m < n {
+			n = m
+		}
+		common += n
+	}
+	return common * 100 / max
+}
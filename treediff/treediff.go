@@ -0,0 +1,252 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// package treediff compares Git trees, in the manner of
+// git-diff-tree(1) with the -r option.
+//
+// Renames and copies can be detected from the similarity of
+// blob contents, as with the -M and -C options of Git.
+package treediff
+
+import (
+	"errors"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/remyoudompheng/gigot/objects"
+)
+
+// A ChangeType is the kind of a change between two trees.
+type ChangeType int
+
+const (
+	Added       ChangeType = iota + 1 // The file was created.
+	Deleted                           // The file was removed.
+	Modified                          // The contents or permissions of the file changed.
+	TypeChanged                       // The file changed between regular file, symlink and gitlink.
+	Renamed                           // The file was moved, possibly with modifications.
+	Copied                            // The file was copied, possibly with modifications.
+)
+
+// String returns the status letter used by Git for the change.
+func (t ChangeType) String() string {
+	switch t {
+	case Added:
+		return "A"
+	case Deleted:
+		return "D"
+	case Modified:
+		return "M"
+	case TypeChanged:
+		return "T"
+	case Renamed:
+		return "R"
+	case Copied:
+		return "C"
+	}
+	return "?"
+}
+
+// A Change describes the difference between two versions of a file.
+// Paths are relative to the root of the compared trees. For added
+// files, the old path, mode and hash are empty, and likewise for
+// deleted files.
+type Change struct {
+	Type             ChangeType
+	OldPath, NewPath string
+	OldMode, NewMode os.FileMode
+	OldHash, NewHash objects.Hash
+	Score            int // The similarity of renames and copies, in percent.
+}
+
+// Options control the detection of renames and copies.
+type Options struct {
+	DetectRenames bool
+	// DetectCopies also looks for copies of modified files.
+	// It implies DetectRenames.
+	DetectCopies bool
+	// FindCopiesHarder also looks for copies of unmodified files.
+	// It implies DetectCopies.
+	FindCopiesHarder bool
+	// MinScore is the minimal similarity of renames and copies,
+	// in percent. The default is 50.
+	MinScore int
+}
+
+var (
+	errNotTree = errors.New("treediff: object is not a tree")
+	errNotBlob = errors.New("treediff: object is not a blob")
+)
+
+// DiffTrees compares the trees old and new, recursively, and returns
+// the list of changes sorted by path. A zero hash stands for the
+// empty tree. Renames and copies are only reported if requested
+// in opts, which may be nil.
+func DiffTrees(store objects.ObjectStore, old, new objects.Hash, opts *Options) ([]Change, error) {
+	d := &differ{store: store}
+	if opts != nil {
+		d.opts = *opts
+	}
+	if d.opts.FindCopiesHarder {
+		d.opts.DetectCopies = true
+	}
+	if d.opts.DetectCopies {
+		d.opts.DetectRenames = true
+	}
+	if d.opts.MinScore <= 0 {
+		d.opts.MinScore = 50
+	}
+	if err := d.diffTrees("", old, new); err != nil {
+		return nil, err
+	}
+	if d.opts.DetectRenames {
+		if err := d.detectRenames(old); err != nil {
+			return nil, err
+		}
+	}
+	sort.Stable(changesByPath(d.changes))
+	return d.changes, nil
+}
+
+type differ struct {
+	store   objects.ObjectStore
+	opts    Options
+	changes []Change
+	sigs    map[objects.Hash]*signature
+}
+
+// isTree reports whether a tree entry is a subtree. Gitlinks are
+// not subtrees.
+func isTree(mode os.FileMode) bool {
+	return mode&os.ModeDir != 0 && mode&os.ModeSymlink == 0
+}
+
+// isGitlink reports whether a tree entry is a gitlink, that is,
+// a commit of a submodule.
+func isGitlink(mode os.FileMode) bool {
+	return fileType(mode) == os.ModeDir|os.ModeSymlink
+}
+
+// fileType returns the type bits of a mode, which distinguish
+// regular files, symlinks and gitlinks.
+func fileType(mode os.FileMode) os.FileMode {
+	return mode & (os.ModeDir | os.ModeSymlink)
+}
+
+// entryKey returns the sort key of a tree entry: Git sorts
+// subtrees as if their name ended with a slash.
+func entryKey(e objects.TreeElem) string {
+	if isTree(e.Mode) {
+		return e.Name + "/"
+	}
+	return e.Name
+}
+
+func (d *differ) readTree(h objects.Hash) ([]objects.TreeElem, error) {
+	if h == (objects.Hash{}) {
+		return nil, nil
+	}
+	o, err := d.store.Get(h)
+	if err != nil {
+		return nil, err
+	}
+	t, ok := o.(objects.Tree)
+	if !ok {
+		return nil, errNotTree
+	}
+	return t.Entries, nil
+}
+
+// diffTrees compares two trees found at path base.
+func (d *differ) diffTrees(base string, old, new objects.Hash) error {
+	if old == new {
+		return nil
+	}
+	a, err := d.readTree(old)
+	if err != nil {
+		return err
+	}
+	b, err := d.readTree(new)
+	if err != nil {
+		return err
+	}
+	for len(a) > 0 || len(b) > 0 {
+		switch {
+		case len(b) == 0 || len(a) > 0 && entryKey(a[0]) < entryKey(b[0]):
+			err = d.removed(base, a[0])
+			a = a[1:]
+		case len(a) == 0 || entryKey(b[0]) < entryKey(a[0]):
+			err = d.added(base, b[0])
+			b = b[1:]
+		default:
+			err = d.changed(base, a[0], b[0])
+			a, b = a[1:], b[1:]
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *differ) removed(base string, e objects.TreeElem) error {
+	p := path.Join(base, e.Name)
+	if isTree(e.Mode) {
+		return d.diffTrees(p, e.Hash, objects.Hash{})
+	}
+	d.changes = append(d.changes, Change{
+		Type:    Deleted,
+		OldPath: p, OldMode: e.Mode, OldHash: e.Hash,
+	})
+	return nil
+}
+
+func (d *differ) added(base string, e objects.TreeElem) error {
+	p := path.Join(base, e.Name)
+	if isTree(e.Mode) {
+		return d.diffTrees(p, objects.Hash{}, e.Hash)
+	}
+	d.changes = append(d.changes, Change{
+		Type:    Added,
+		NewPath: p, NewMode: e.Mode, NewHash: e.Hash,
+	})
+	return nil
+}
+
+// changed compares two entries with the same name and kind.
+func (d *differ) changed(base string, a, b objects.TreeElem) error {
+	p := path.Join(base, a.Name)
+	if isTree(a.Mode) {
+		return d.diffTrees(p, a.Hash, b.Hash)
+	}
+	if a.Hash == b.Hash && a.Mode == b.Mode {
+		return nil
+	}
+	c := Change{
+		Type:    Modified,
+		OldPath: p, OldMode: a.Mode, OldHash: a.Hash,
+		NewPath: p, NewMode: b.Mode, NewHash: b.Hash,
+	}
+	if fileType(a.Mode) != fileType(b.Mode) {
+		c.Type = TypeChanged
+	}
+	d.changes = append(d.changes, c)
+	return nil
+}
+
+// Path returns the path of the file after the change, or before
+// the change for deletions.
+func (c Change) Path() string {
+	if c.Type == Deleted {
+		return c.OldPath
+	}
+	return c.NewPath
+}
+
+type changesByPath []Change
+
+func (s changesByPath) Len() int           { return len(s) }
+func (s changesByPath) Less(i, j int) bool { return s[i].Path() < s[j].Path() }
+func (s changesByPath) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
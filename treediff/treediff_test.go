@@ -0,0 +1,240 @@
+// Copyright 2012 Rémy Oudompheng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package treediff
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/remyoudompheng/gigot/objects"
+)
+
+// A testFile describes a file of a test tree. Symlinks and
+// executables are denoted by their mode.
+type testFile struct {
+	path string
+	mode os.FileMode
+	data string
+}
+
+func testStore(t *testing.T) (*objects.LooseStore, func()) {
+	dir, err := ioutil.TempDir("", "gigot-treediff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return objects.NewLooseStore(dir), func() { os.RemoveAll(dir) }
+}
+
+// putTree stores a tree holding the given files, which must be
+// sorted by path.
+func putTree(t *testing.T, store objects.ObjectStore, files []testFile) objects.Hash {
+	var tree objects.Tree
+	for len(files) > 0 {
+		f := files[0]
+		if i := strings.IndexByte(f.path, '/'); i >= 0 {
+			// Gather the files of the subdirectory.
+			dir := f.path[:i+1]
+			var sub []testFile
+			for len(files) > 0 && strings.HasPrefix(files[0].path, dir) {
+				f := files[0]
+				f.path = f.path[len(dir):]
+				sub = append(sub, f)
+				files = files[1:]
+			}
+			tree.Entries = append(tree.Entries, objects.TreeElem{
+				Name: dir[:i], Mode: os.ModeDir, Hash: putTree(t, store, sub)})
+			continue
+		}
+		h, err := store.Put(objects.Blob{Data: []byte(f.data)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		mode := f.mode
+		if mode == 0 {
+			mode = 0644
+		}
+		tree.Entries = append(tree.Entries, objects.TreeElem{Name: f.path, Mode: mode, Hash: h})
+		files = files[1:]
+	}
+	h, err := store.Put(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// formatChanges formats changes like git diff-tree --name-status.
+func formatChanges(changes []Change) string {
+	var lines []string
+	for _, c := range changes {
+		switch c.Type {
+		case Added:
+			lines = append(lines, fmt.Sprintf("A %s", c.NewPath))
+		case Deleted:
+			lines = append(lines, fmt.Sprintf("D %s", c.OldPath))
+		case Renamed, Copied:
+			lines = append(lines, fmt.Sprintf("%s%03d %s %s", c.Type, c.Score, c.OldPath, c.NewPath))
+		default:
+			lines = append(lines, fmt.Sprintf("%s %s", c.Type, c.NewPath))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// lines returns n distinct lines of text.
+func lines(prefix string, n int) string {
+	s := ""
+	for i := 0; i < n; i++ {
+		s += fmt.Sprintf("%s line %d\n", prefix, i)
+	}
+	return s
+}
+
+func TestDiffTrees(t *testing.T) {
+	store, cleanup := testStore(t)
+	defer cleanup()
+	old := putTree(t, store, []testFile{
+		{path: "a", data: "a\n"},
+		{path: "dir/b", data: "b\n"},
+		{path: "dir/c", data: "c\n"},
+		{path: "dir/sub/d", data: "d\n"},
+		{path: "e", data: "e\n"},
+		{path: "f", mode: os.ModeSymlink, data: "a"},
+		{path: "x", data: "x\n"},
+	})
+	new := putTree(t, store, []testFile{
+		{path: "a", data: "a\n"},
+		{path: "dir/b", data: "bb\n"},
+		{path: "dir/d", data: "d\n"},
+		{path: "dir/sub/d", data: "d\n"},
+		{path: "e", mode: 0755, data: "e\n"},
+		{path: "f", data: "a"},
+		{path: "g/h", data: "h\n"},
+		{path: "x/y", data: "x\n"},
+	})
+	changes, err := DiffTrees(store, old, new, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := formatChanges(changes)
+	expect := "M dir/b\nD dir/c\nA dir/d\nM e\nT f\nA g/h\nD x\nA x/y"
+	if got != expect {
+		t.Errorf("got:\n%s\nexpected:\n%s", got, expect)
+	}
+	if c := changes[3]; c.OldMode != 0644 || c.NewMode != 0755 || c.OldHash != c.NewHash {
+		t.Errorf("bad mode change %+v", c)
+	}
+
+	// Compare with the empty tree.
+	changes, err = DiffTrees(store, objects.Hash{}, old, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = formatChanges(changes)
+	expect = "A a\nA dir/b\nA dir/c\nA dir/sub/d\nA e\nA f\nA x"
+	if got != expect {
+		t.Errorf("got:\n%s\nexpected:\n%s", got, expect)
+	}
+	changes, err = DiffTrees(store, old, old, nil)
+	if err != nil || len(changes) != 0 {
+		t.Errorf("got %v, %v for identical trees", changes, err)
+	}
+}
+
+func TestDetectRenames(t *testing.T) {
+	store, cleanup := testStore(t)
+	defer cleanup()
+	text := lines("text", 20)
+	old := putTree(t, store, []testFile{
+		{path: "copied", data: lines("copied", 20)},
+		{path: "exact", data: "exact\n"},
+		{path: "inexact", data: text},
+		{path: "modified", data: lines("modified", 20)},
+		{path: "unrelated", data: lines("unrelated", 20)},
+	})
+	new := putTree(t, store, []testFile{
+		{path: "copied", data: lines("copied", 20)},
+		{path: "copy", data: lines("copied", 20)},
+		{path: "dir/exact", data: "exact\n"},
+		{path: "modified", data: lines("modified", 19)},
+		{path: "moved", data: strings.Replace(text, "line 7", "line seven", 1)},
+		{path: "new", data: lines("new", 20)},
+		{path: "similar", data: lines("modified", 20) + "more\n"},
+	})
+
+	for _, test := range []struct {
+		opts   Options
+		expect string
+	}{
+		{Options{},
+			"A copy\nA dir/exact\nD exact\nD inexact\nM modified\nA moved\nA new\nA similar\nD unrelated"},
+		{Options{DetectRenames: true},
+			"A copy\nR100 exact dir/exact\nM modified\nR093 inexact moved\nA new\nA similar\nD unrelated"},
+		{Options{DetectRenames: true, MinScore: 99},
+			"A copy\nR100 exact dir/exact\nD inexact\nM modified\nA moved\nA new\nA similar\nD unrelated"},
+		{Options{DetectCopies: true},
+			"A copy\nR100 exact dir/exact\nM modified\nR093 inexact moved\nA new\nC098 modified similar\nD unrelated"},
+		{Options{FindCopiesHarder: true},
+			"C100 copied copy\nR100 exact dir/exact\nM modified\nR093 inexact moved\nA new\nC098 modified similar\nD unrelated"},
+	} {
+		changes, err := DiffTrees(store, old, new, &test.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := formatChanges(changes); got != test.expect {
+			t.Errorf("%+v: got:\n%s\nexpected:\n%s", test.opts, got, test.expect)
+		}
+	}
+}
+
+func TestRenameCopies(t *testing.T) {
+	// A deleted file copied twice: the last copy is a rename.
+	store, cleanup := testStore(t)
+	defer cleanup()
+	old := putTree(t, store, []testFile{
+		{path: "a", data: lines("a", 10)},
+	})
+	new := putTree(t, store, []testFile{
+		{path: "b", data: lines("a", 10)},
+		{path: "c", data: lines("a", 10)},
+	})
+	changes, err := DiffTrees(store, old, new, &Options{DetectCopies: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, expect := formatChanges(changes), "C100 a b\nR100 a c"; got != expect {
+		t.Errorf("got:\n%s\nexpected:\n%s", got, expect)
+	}
+	changes, err = DiffTrees(store, old, new, &Options{DetectRenames: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, expect := formatChanges(changes), "R100 a b\nA c"; got != expect {
+		t.Errorf("got:\n%s\nexpected:\n%s", got, expect)
+	}
+}
+
+func TestSimilarity(t *testing.T) {
+	for _, test := range []struct {
+		a, b  string
+		score int
+	}{
+		{"", "", 100},
+		{"a\nb\nc\nd\n", "a\nb\nc\nd\n", 100},
+		{"a\nb\nc\nd\n", "a\nb\nc\n", 75},
+		{"a\nb\nc\nd\n", "a\nb\n", 0}, // too different in size.
+		{"a\r\nb\r\n", "a\nb\n", 66},
+		{"a\nb\nc\nd\n", "d\nc\nb\na\n", 100},
+		{"a\nb\nc\nd\n", "e\nf\ng\nh\n", 0},
+	} {
+		score := similarity(newSignature([]byte(test.a)), newSignature([]byte(test.b)), 60)
+		if score != test.score {
+			t.Errorf("similarity(%q, %q) = %d, expected %d", test.a, test.b, score, test.score)
+		}
+	}
+}